@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+)
+
+// sampling frequencies by index of MPEG-4 audio
+var aacSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// number of samples in an AAC frame
+const AACFrameSamples = 1024
+
+// audio parameters of an AAC stream
+type AACConfig struct {
+	ObjectType      int
+	SampleRateIndex int
+	SampleRate      int
+	Channels        int
+}
+
+// MPEG-4 AudioSpecificConfig
+func (config AACConfig) AudioSpecificConfig() []byte {
+	return []byte{byte(config.ObjectType<<3 | config.SampleRateIndex>>1), byte((config.SampleRateIndex&1)<<7 | config.Channels<<3)}
+}
+
+// RFC 6381 codec string
+func (config AACConfig) Codec() string {
+	return fmt.Sprintf("mp4a.40.%d", config.ObjectType)
+}
+
+// split ADTS frames, return config of first frame, raw frames and unused bytes (partial frame)
+func ParseADTS(data []byte) (AACConfig, [][]byte, []byte) {
+	var config AACConfig
+	var frames [][]byte
+
+	for len(data) >= 7 {
+		// resynchronize on syncword
+		if data[0] != 0xFF || data[1]&0xF6 != 0xF0 {
+			data = data[1:]
+			continue
+		}
+
+		headerlength := 7
+		if data[1]&0x01 == 0 {
+			// CRC present
+			headerlength = 9
+		}
+
+		framelength := int(data[3]&0x03)<<11 | int(data[4])<<3 | int(data[5])>>5
+
+		if framelength < headerlength {
+			data = data[1:]
+			continue
+		}
+
+		if framelength > len(data) {
+			break
+		}
+
+		if len(frames) == 0 {
+			config.ObjectType = int(data[2]>>6) + 1
+			config.SampleRateIndex = int(data[2]>>2) & 0x0F
+			config.Channels = int(data[2]&0x01)<<2 | int(data[3]>>6)
+
+			if config.SampleRateIndex < len(aacSampleRates) {
+				config.SampleRate = aacSampleRates[config.SampleRateIndex]
+			}
+		}
+
+		frames = append(frames, data[headerlength:framelength])
+		data = data[framelength:]
+	}
+
+	return config, frames, data
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// build an ADTS frame of AAC LC (MPEG-4) around a payload
+func adtsFrame(samplerateindex int, channels int, crc bool, payload []byte) []byte {
+	header := 7
+	protectionabsent := byte(1)
+	if crc {
+		header = 9
+		protectionabsent = 0
+	}
+
+	length := header + len(payload)
+
+	frame := []byte{0xFF, 0xF0 | protectionabsent,
+		byte(1<<6 | samplerateindex<<2 | channels>>2),
+		byte(channels&3<<6 | length>>11),
+		byte(length >> 3),
+		byte(length&7<<5 | 0x1F),
+		0xFC}
+
+	if crc {
+		frame = append(frame, 0x12, 0x34)
+	}
+
+	return append(frame, payload...)
+}
+
+func TestParseADTS(t *testing.T) {
+	frame1 := adtsFrame(3, 2, false, []byte{1, 2, 3, 4})
+	frame2 := adtsFrame(3, 2, false, []byte{5, 6})
+	crcframe := adtsFrame(4, 1, true, []byte{7, 8, 9})
+
+	tests := []struct {
+		name   string
+		data   []byte
+		config AACConfig
+		frames [][]byte
+		rest   []byte
+	}{
+		{"two frames", append(append([]byte{}, frame1...), frame2...),
+			AACConfig{ObjectType: 2, SampleRateIndex: 3, SampleRate: 48000, Channels: 2}, [][]byte{{1, 2, 3, 4}, {5, 6}}, []byte{}},
+		{"frame with CRC", crcframe,
+			AACConfig{ObjectType: 2, SampleRateIndex: 4, SampleRate: 44100, Channels: 1}, [][]byte{{7, 8, 9}}, []byte{}},
+		{"resynchronize after garbage", append([]byte{0x00, 0xFF, 0x12}, frame2...),
+			AACConfig{ObjectType: 2, SampleRateIndex: 3, SampleRate: 48000, Channels: 2}, [][]byte{{5, 6}}, []byte{}},
+		{"partial frame kept", append(append([]byte{}, frame1...), frame2[:8]...),
+			AACConfig{ObjectType: 2, SampleRateIndex: 3, SampleRate: 48000, Channels: 2}, [][]byte{{1, 2, 3, 4}}, frame2[:8]},
+		{"header only", frame1[:7], AACConfig{}, nil, frame1[:7]},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, frames, rest := ParseADTS(test.data)
+
+			if config != test.config {
+				t.Errorf("config = %+v, want %+v", config, test.config)
+			}
+			if !reflect.DeepEqual(frames, test.frames) {
+				t.Errorf("frames = % X, want % X", frames, test.frames)
+			}
+			if len(rest) != len(test.rest) || (len(rest) > 0 && !reflect.DeepEqual(rest, test.rest)) {
+				t.Errorf("rest = % X, want % X", rest, test.rest)
+			}
+		})
+	}
+}
+
+func TestAACConfig(t *testing.T) {
+	config := AACConfig{ObjectType: 2, SampleRateIndex: 3, SampleRate: 48000, Channels: 2}
+
+	if got, want := config.AudioSpecificConfig(), []byte{0x11, 0x90}; !reflect.DeepEqual(got, want) {
+		t.Errorf("AudioSpecificConfig = % X, want % X", got, want)
+	}
+	if got := config.Codec(); got != "mp4a.40.2" {
+		t.Errorf("Codec = %s, want mp4a.40.2", got)
+	}
+}
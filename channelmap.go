@@ -2,12 +2,19 @@ package main
 
 import (
 	"fmt"
+	"log"
+	"mime"
 	"net/http"
+	"path"
+	"sort"
 	"strings"
 )
 
 const ChannelMapPath = "/channelmap/"
 
+// path where images from logo directory are served
+const LogoPath = "/logos/"
+
 func RegisterDynamicChannelMap(m DynamicChannelMap) {
 	c := m.GetChannelInfo()
 
@@ -28,11 +35,9 @@ func channelmapHandler(w http.ResponseWriter, r *http.Request) {
 
 	subpath = strings.TrimLeft(subpath, "/")
 
-	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
-
 	// not extension, just return list of services
 	if subpath == "serviceslist.xml" {
-		deviceconfig.channelmapListWrite(w, r.Host)
+		deviceconfig.channelmapListWrite(w, r)
 		return
 	}
 
@@ -62,95 +67,272 @@ func channelmapHandler(w http.ResponseWriter, r *http.Request) {
 
 	switch splitpath[1] {
 	case "serviceslist.xml":
-		channelmap.channelMapWrite(w, r.Host, splitpath[0])
+		channelmap.channelMapWrite(w, r, splitpath[0])
 	default:
 		http.Error(w, "404 not found.", http.StatusNotFound)
 	}
 }
 
-func (channelmap *ChannelMap) WriteConfig(w http.ResponseWriter, host string, name string) {
-	w.Write([]byte("<sld:ProviderOffering>\n"))
-	w.Write([]byte("<sld:Provider>\n"))
-	w.Write([]byte("<sld:Name>"))
-	w.Write([]byte(channelmap.Provider))
-	w.Write([]byte("</sld:Name>\n"))
-	w.Write([]byte("</sld:Provider>\n"))
-
-	//
-	w.Write([]byte("<sld:ServiceListOffering>\n"))
-	w.Write([]byte("<sld:ServiceListName>"))
-	w.Write([]byte(name))
-	w.Write([]byte("</sld:ServiceListName>\n"))
-	w.Write([]byte("<sld:ServiceListURI contentType=\"application/xml\">\n"))
-	w.Write([]byte("<dvbisd:URI>\n"))
-	fmt.Fprintf(w, "http://%s%s%s/serviceslist.xml", host, ChannelMapPath, name)
-	w.Write([]byte("</dvbisd:URI>\n"))
-	w.Write([]byte("</sld:ServiceListURI>\n"))
-	w.Write([]byte("<sld:TargetCountry>DEU</sld:TargetCountry>\n"))
-	w.Write([]byte("</sld:ServiceListOffering>\n"))
-
-	w.Write([]byte("</sld:ProviderOffering>\n"))
+// describe a channel map for service list discovery
+func (channelmap *ChannelMap) ProviderOffering(host string, name string) DVBIProviderOffering {
+	var offering DVBIProviderOffering
+	var list DVBIServiceListOffering
+
+	offering.Provider.Name = channelmap.Provider
+
+	list.ServiceListName = name
+	list.ServiceListURI.ContentType = "application/xml"
+	list.ServiceListURI.URI = fmt.Sprintf("http://%s%s%s/serviceslist.xml", host, ChannelMapPath, name)
+	list.RegulatorListFlag = channelmap.RegulatorList
+	list.Languages = channelmap.Languages
+	list.TargetCountry = channelmap.TargetCountries
+
+	if len(list.TargetCountry) == 0 {
+		list.TargetCountry = deviceconfig.TargetCountries
+	}
+
+	for _, genre := range channelmap.Genres {
+		list.Genres = append(list.Genres, DVBIGenre{Type: "main", Href: genre})
+	}
+
+	delivery := channelmap.Delivery
+
+	// all services are delivered as DASH unless configured otherwise
+	if len(delivery) == 0 {
+		delivery = []string{DeliveryDASH}
+	}
+
+	for _, name := range delivery {
+		if !list.Delivery.Set(name) {
+			log.Printf("Channel map %s: unknown delivery %s\n", list.ServiceListName, name)
+		}
+	}
+
+	offering.ServiceListOfferings = []DVBIServiceListOffering{list}
+
+	return offering
+}
+
+// get names of a map sorted alphabetically
+func sortedChannelMapNames(m map[string]ChannelMap) []string {
+	names := make([]string, 0, len(m))
+
+	for name := range m {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
 }
 
-func (config DeviceConfig) channelmapListWrite(w http.ResponseWriter, host string) {
-	w.Write([]byte("<?xml version=\"1.0\" encoding=\"UTF-8\"?>"))
-	w.Write([]byte("<sld:ServiceListEntryPoints xmlns:sld=\"urn:dvb:metadata:servicelistdiscovery:2019\" xmlns:dvbisd=\"urn:dvb:metadata:servicediscovery:2019\" xmlns:mpeg7=\"urn:tva:mpeg7:2008\" xmlns:xsi=\"http://www.w3.org/2001/XMLSchema-instance\" xsi:schemaLocation=\"urn:dvb:metadata:servicelistdiscovery:2019 dvbi_service_list_discovery_v1.0.xsd\">"))
-	w.Write([]byte("<sld:ServiceListRegistryEntity regulatorFlag=\"false\">\n"))
-	w.Write([]byte("</sld:ServiceListRegistryEntity>\n"))
+// build the service list discovery document listing all channel maps
+func (config DeviceConfig) ServiceListEntryPoints(host string) *DVBIServiceListEntryPoints {
+	entrypoints := NewDVBIServiceListEntryPoints()
+
+	entrypoints.RegistryEntity.Name = config.RegistryName
+	if entrypoints.RegistryEntity.Name == "" {
+		entrypoints.RegistryEntity.Name = config.Name
+	}
 
 	// list all static channels maps
-	for name, channelmap := range config.ChannelMaps {
-		// provider header
-		channelmap.WriteConfig(w, host, name)
+	for _, name := range sortedChannelMapNames(config.ChannelMaps) {
+		channelmap := config.ChannelMaps[name]
+		entrypoints.ProviderOfferings = append(entrypoints.ProviderOfferings, channelmap.ProviderOffering(host, name))
 	}
 
 	// list all dynamic channel maps
-	for name, dynamicchannelmap := range config.dynamicchannelmaps {
+	dynamicnames := make([]string, 0, len(config.dynamicchannelmaps))
+	for name := range config.dynamicchannelmaps {
+		dynamicnames = append(dynamicnames, name)
+	}
+	sort.Strings(dynamicnames)
+
+	for _, name := range dynamicnames {
 		// get quick description of channel map
-		channelmap := dynamicchannelmap.GetChannelInfo()
-		if (channelmap.Description != "" ) {
-			channelmap.WriteConfig(w, host, name)
+		channelmap := config.dynamicchannelmaps[name].GetChannelInfo()
+		if channelmap.Description != "" {
+			entrypoints.ProviderOfferings = append(entrypoints.ProviderOfferings, channelmap.ProviderOffering(host, name))
 		}
 	}
 
-	w.Write([]byte("</sld:ServiceListEntryPoints>\n"))
+	return entrypoints
+}
+
+func (config DeviceConfig) channelmapListWrite(w http.ResponseWriter, r *http.Request) {
+	// modification date only depends on content, not on host used by client or query
+	lastmodified := servicelistversions.ApplyDocument("", config.ServiceListEntryPoints(""))
+
+	entrypoints := config.ServiceListEntryPoints(r.Host)
+	NewServiceListQuery(r).Filter(entrypoints)
+
+	serveVersionedXML(w, r, entrypoints, lastmodified)
 }
 
 func (channelmap ChannelMap) GenerateServiceRef(channel Channel) string {
 	return "tag:" + channelmap.Provider + ",2022:" + strings.ReplaceAll(strings.ToLower(channel.Name), " ", "_")
 }
 
-func (channelmap ChannelMap) channelMapWrite(w http.ResponseWriter, host string, name string) {
-	w.Write([]byte("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n"))
-	w.Write([]byte("<ServiceList xmlns=\"urn:dvb:metadata:servicediscovery:2019\" xmlns:xsi=\"http://www.w3.org/2001/XMLSchema-instance\" xmlns:tva=\"urn:tva:metadata:2019\" version=\"1\" xsi:schemaLocation=\"urn:dvb:metadata:servicediscovery:2019 ../dvbi_v1.0.xsd\">\n"))
+// get URL of an image, names which are not URLs are files of the logo directory
+func imageURL(host string, image string) string {
+	if strings.HasPrefix(image, "http://") || strings.HasPrefix(image, "https://") {
+		return image
+	}
+
+	return fmt.Sprintf("http://%s%s%s", host, LogoPath, strings.TrimLeft(image, "/"))
+}
+
+// create related material pointing to an image
+func NewRelatedImage(howrelated string, host string, image string) DVBIRelatedMaterial {
+	var material DVBIRelatedMaterial
+
+	material.HowRelated.Href = howrelated
+	material.MediaLocator.MediaUri.URI = imageURL(host, image)
+	material.MediaLocator.MediaUri.ContentType = mime.TypeByExtension(path.Ext(image))
+
+	return material
+}
+
+// convert configured regions to DVB-I regions
+func makeRegions(regions []Region) []DVBIRegion {
+	result := make([]DVBIRegion, 0, len(regions))
+
+	for _, region := range regions {
+		var r DVBIRegion
+
+		r.RegionID = region.ID
+		r.CountryCodes = region.CountryCodes
+		if region.Name != "" {
+			r.RegionNames = []DVBIText{{Text: region.Name}}
+		}
+		r.Regions = makeRegions(region.Regions)
+
+		result = append(result, r)
+	}
+
+	return result
+}
+
+// path of HLS playlist of a channel, empty if none
+func (channelmap ChannelMap) HLSSource(channel Channel) string {
+	if channel.HLSSource != "" {
+		return channel.HLSSource
+	}
+
+	// transcoded channels have HLS playlist in the same directory as DASH manifest
+	if channelmap.HLS && strings.HasSuffix(channel.Source, "/"+DASHManifestName) {
+		return strings.TrimSuffix(channel.Source, DASHManifestName) + HLSMasterPlaylistName
+	}
+
+	return ""
+}
+
+// get channel numbers sorted in increasing order
+func (channelmap ChannelMap) SortedNumbers() []int {
+	numbers := make([]int, 0, len(channelmap.Channels))
+
+	for number := range channelmap.Channels {
+		numbers = append(numbers, number)
+	}
+
+	sort.Ints(numbers)
+
+	return numbers
+}
+
+// build the DVB-I service list of a channel map
+func (channelmap ChannelMap) ServiceList(host string, name string) *DVBIServiceList {
+	sl := NewDVBIServiceList()
 
-	fmt.Fprintf(w, "<Name>%s</Name>\n", name)
-	fmt.Fprintf(w, "<ProviderName>%s</ProviderName>\n", channelmap.Provider)
+	sl.Name = name
+	sl.ProviderName = channelmap.Provider
 
-	// LCN table
-	w.Write([]byte("<LCNTableList>\n<LCNTable>\n"))
+	if channelmap.Logo != "" {
+		sl.RelatedMaterial = append(sl.RelatedMaterial, NewRelatedImage(HowRelatedServiceListLogo, host, channelmap.Logo))
+	}
 
-	for number, channel := range channelmap.Channels {
-		fmt.Fprintf(w, "<LCN channelNumber=\"%d\" serviceRef=\"%s\"/>\n", number, channelmap.GenerateServiceRef(channel))
+	if len(channelmap.Regions) > 0 {
+		sl.RegionList = &DVBIRegionList{Version: 1, Regions: makeRegions(channelmap.Regions)}
 	}
 
-	w.Write([]byte("</LCNTable>\n</LCNTableList>\n"))
+	// program guide for all services
+	sl.ContentGuideSource = NewContentGuideSource(host, channelmap.Provider)
+
+	var lcntable DVBILCNTable
+
+	for _, number := range channelmap.SortedNumbers() {
+		channel := channelmap.Channels[number]
+		serviceref := channelmap.GenerateServiceRef(channel)
+
+		lcntable.LCNs = append(lcntable.LCNs, DVBILCN{ChannelNumber: number, ServiceRef: serviceref})
+
+		var service DVBIService
+		var instance DVBIServiceInstance
+
+		instance.Priority = 1
+		instance.SourceType = DVBISourceTypeDASH
+		instance.DASHDeliveryParameters = &DVBIDASHDeliveryParameters{
+			UriBasedLocation: DVBIExtendedURI{ContentType: "application/dash+xml", URI: fmt.Sprintf("http://%s/%s", host, channel.Source)},
+		}
+
+		for _, drm := range channel.DRMSystems {
+			instance.DRMSystems = append(instance.DRMSystems, DVBIDRMSystem{EncryptionScheme: drm.EncryptionScheme, CPSIndex: drm.CPSIndex, DRMSystemID: drm.SystemID})
+		}
+
+		service.Version = 1
+		service.UniqueIdentifier = serviceref
+		service.ServiceInstances = []DVBIServiceInstance{instance}
+
+		if hlssource := channelmap.HLSSource(channel); hlssource != "" {
+			var hlsinstance DVBIServiceInstance
+
+			hlsinstance.Priority = 2
+			hlsinstance.OtherDeliveryParameters = &DVBIOtherDeliveryParameters{
+				ExtensionName:    "hls",
+				UriBasedLocation: DVBIExtendedURI{ContentType: HLSContentType, URI: fmt.Sprintf("http://%s/%s", host, hlssource)},
+			}
+
+			service.ServiceInstances = append(service.ServiceInstances, hlsinstance)
+		}
+		service.ServiceName = channel.Name
+		service.ProviderName = channelmap.Provider
+		service.ContentGuideServiceRef = channel.GetContentGuideServiceRef()
+		service.TargetRegions = channel.TargetRegions
+
+		if channel.Logo != "" {
+			service.RelatedMaterial = append(service.RelatedMaterial, NewRelatedImage(HowRelatedServiceLogo, host, channel.Logo))
+		}
+
+		if channel.OutOfServiceImage != "" {
+			service.RelatedMaterial = append(service.RelatedMaterial, NewRelatedImage(HowRelatedOutOfService, host, channel.OutOfServiceImage))
+		}
+
+		if channel.Genre != "" {
+			service.ServiceGenre = &DVBIGenre{Type: "main", Href: channel.Genre}
+		}
+
+		if channel.Description != "" {
+			service.ServiceDescription = []DVBIText{{Lang: channel.DescriptionLanguage, Text: channel.Description}}
+		}
+
+		sl.Services = append(sl.Services, service)
+	}
+
+	sl.LCNTables = []DVBILCNTable{lcntable}
+
+	return sl
+}
+
+func (channelmap ChannelMap) channelMapWrite(w http.ResponseWriter, r *http.Request, name string) {
+	// versions only depend on content, not on host used by client
+	reference := channelmap.ServiceList("", name)
+	lastmodified := servicelistversions.ApplyServiceList(name, reference)
 
-	for _, channel := range channelmap.Channels {
-		w.Write([]byte("<Service version=\"1\">\n"))
-		fmt.Fprintf(w, "<UniqueIdentifier>%s</UniqueIdentifier>\n", channelmap.GenerateServiceRef(channel))
-		w.Write([]byte("<ServiceInstance priority=\"1\">\n"))
-		w.Write([]byte("<SourceType>urn:dvb:metadata:source:dvb-dash</SourceType>\n"))
-		w.Write([]byte("<DASHDeliveryParameters>\n"))
-		w.Write([]byte("<UriBasedLocation contentType=\"application/dash+xml\">\n"))
-		fmt.Fprintf(w, "<URI>http://%s/%s</URI>\n", host, channel.Source)
-		w.Write([]byte("</UriBasedLocation>\n"))
-		w.Write([]byte("</DASHDeliveryParameters>\n"))
-		w.Write([]byte("</ServiceInstance>\n"))
-		fmt.Fprintf(w, "<ServiceName>%s</ServiceName>\n", channel.Name)
-		fmt.Fprintf(w, "<ProviderName>%s</ProviderName>\n", channelmap.Provider)
-		w.Write([]byte("</Service>\n"))
+	sl := channelmap.ServiceList(r.Host, name)
+	sl.Version = reference.Version
+	for i := range sl.Services {
+		sl.Services[i].Version = reference.Services[i].Version
 	}
 
-	w.Write([]byte("</ServiceList>"))
+	serveVersionedXML(w, r, sl, lastmodified)
 }
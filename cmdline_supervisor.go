@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// delay before first restart of a tool when not configured, doubled for each following restart
+const restartDelay time.Duration = time.Second
+const restartMaxDelay time.Duration = time.Minute
+
+// a tool running longer than this is healthy again, its restart count is reset
+const restartStableTime time.Duration = time.Minute
+
+// period of output checks of tools with an output timeout
+const outputCheckTime time.Duration = time.Second
+
+// time given to read the last output of an exited tool
+const outputDrainTime time.Duration = time.Second
+
+// time given to a tool to exit after its exit command, it is killed after
+const exitTimeout time.Duration = 5 * time.Second
+
+var errToolStopped = errors.New("tool is stopped")
+
+// status of a tool and its restarts
+type CommandLineToolStatus struct {
+	Command  string `json:"command"`
+	Running  bool   `json:"running"`
+	Restarts int    `json:"restarts"`
+	ExitCode int    `json:"exitcode"`
+}
+
+// set a function called when the tool failed and is not restarted anymore, it is not called when the tool is stopped
+func (t *CommandLineTool) SetExitHandler(handler func(error)) {
+	t.exithandler = handler
+}
+
+// get running state, restarts and last exit code
+func (t *CommandLineTool) Status() CommandLineToolStatus {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return CommandLineToolStatus{t.config.Command, t.running, t.restarts, t.exitcode}
+}
+
+// record output of the tool, it is not stalled
+func (t *CommandLineTool) touchOutput() {
+	atomic.StoreInt64(&t.lastoutput, time.Now().UnixNano())
+}
+
+// delay before a restart, doubled for each restart in a row
+func (t *CommandLineTool) restartDelay(restarts int) time.Duration {
+	delay := t.config.RestartDelay
+	if delay <= 0 {
+		delay = restartDelay
+	}
+
+	for i := 0; i < restarts && delay < restartMaxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > restartMaxDelay {
+		delay = restartMaxDelay
+	}
+
+	return delay
+}
+
+// let readers get the last output of an exited process then close its pipes, children of the tool may keep them open
+func drainOutput(readers *sync.WaitGroup, pipes ...io.Closer) {
+	drained := make(chan struct{})
+
+	go func() {
+		readers.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(outputDrainTime):
+	}
+
+	for _, pipe := range pipes {
+		pipe.Close()
+	}
+}
+
+// wait for the process to exit, kill it when no output arrived for output timeout, return the reason of exit
+func (t *CommandLineTool) waitProcess(cmd *exec.Cmd) error {
+	t.mutex.Lock()
+	readers, pipes := t.readers, []io.Closer{t.pipestdout, t.pipestderr}
+	if t.pipeout != nil {
+		pipes = append(pipes, t.pipeout)
+	}
+	t.mutex.Unlock()
+
+	// the process is waited directly, Cmd.Wait would close pipes before the last output is read
+	exited := make(chan *os.ProcessState, 1)
+
+	go func() {
+		state, _ := cmd.Process.Wait()
+		drainOutput(readers, pipes...)
+		exited <- state
+	}()
+
+	var check <-chan time.Time
+	if t.config.OutputTimeout > 0 {
+		ticker := time.NewTicker(outputCheckTime)
+		defer ticker.Stop()
+		check = ticker.C
+	}
+
+	stalled := false
+
+	for {
+		select {
+		case state := <-exited:
+			code := state.ExitCode()
+
+			t.mutex.Lock()
+			t.running = false
+			t.exitcode = code
+			t.mutex.Unlock()
+
+			if stalled {
+				return fmt.Errorf("%s gave no output for %s", t.config.Command, t.config.OutputTimeout)
+			}
+
+			return fmt.Errorf("%s exited with code %d", t.config.Command, code)
+
+		case <-check:
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(&t.lastoutput)))
+
+			if !stalled && idle >= t.config.OutputTimeout {
+				log.Printf("Command %s gave no output for %s, killing it\n", t.config.Command, idle.Round(time.Second))
+				stalled = true
+				cmd.Process.Kill()
+			}
+		}
+	}
+}
+
+// watch the process of the tool, restart it with backoff when it exits or stalls until stopped or restart limit is reached
+func (t *CommandLineTool) supervise(cmd *exec.Cmd) {
+	defer close(t.done)
+
+	restarts := 0
+
+	for {
+		started := time.Now()
+		reason := t.waitProcess(cmd)
+
+		t.mutex.Lock()
+		stopping := t.stopping
+		code := t.exitcode
+		t.mutex.Unlock()
+
+		if stopping {
+			log.Printf("Command %s exited with code %d\n", t.config.Command, code)
+			return
+		}
+
+		log.Printf("Command %s failed: %s\n", t.config.Command, reason)
+
+		if time.Since(started) > restartStableTime {
+			restarts = 0
+		}
+
+		for {
+			if restarts >= t.config.MaxRestarts {
+				if t.config.MaxRestarts > 0 {
+					log.Printf("Command %s failed %d times in a row, not restarted\n", t.config.Command, restarts+1)
+				}
+
+				// the handler usually stops the tool, which waits for the supervisor
+				if t.exithandler != nil {
+					go t.exithandler(reason)
+				}
+				return
+			}
+
+			delay := t.restartDelay(restarts)
+			restarts++
+
+			log.Printf("Restarting command %s in %s (%d of %d)\n", t.config.Command, delay, restarts, t.config.MaxRestarts)
+
+			select {
+			case <-t.stopped:
+				return
+			case <-time.After(delay):
+			}
+
+			var err error
+			cmd, err = t.launch()
+
+			if err == nil {
+				break
+			}
+
+			if err == errToolStopped {
+				return
+			}
+
+			log.Printf("cannot restart command %s\n%s\n", t.config.Command, err)
+			reason = err
+		}
+
+		t.mutex.Lock()
+		t.restarts++
+		t.mutex.Unlock()
+	}
+}
@@ -2,13 +2,15 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
 	"os/exec"
-	"regexp"
+	"sync"
+	"time"
 
 	"github.com/Comcast/gots/packet"
 )
@@ -17,24 +19,32 @@ import (
 type CommandLineToolConfig struct {
 	// command to execute for the tool
 	Command string `yaml:"command"` 
-	// arguments to the command
-	Args    string `yaml:"args"`
+	// arguments to the command, a command line or a list
+	Args    ToolArgs `yaml:"args,omitempty"`
 	// working directory
-	WorkDir string `yaml:"workdir"`
+	WorkDir string `yaml:"workdir,omitempty"`
 	// send data to tool using UDP socket instead of stdin (leave to 0 to use stdin)
-	PortIn uint16 `yaml:"portin"`
+	PortIn uint16 `yaml:"portin,omitempty"`
 	// get data from tool using UDP socket instead of stdout (leave to 0 to use stdout)
-	PortOut uint16 `yaml:"portout"`
+	PortOut uint16 `yaml:"portout,omitempty"`
 	// port where to send control command to
-	PortCommand uint16 `yaml:"portcommand"`
+	PortCommand uint16 `yaml:"portcommand,omitempty"`
 	// value to add to port for this specific instance (make it easier to have several instance running)
-	PortOffset uint16 `yaml:"portoffset"`
+	PortOffset uint16 `yaml:"portoffset,omitempty"`
 	// how to exit tool send this string to stdin to exit, if empty exits by killing process
-	ExitCommand string `yaml:"exitcommand"`
+	ExitCommand string `yaml:"exitcommand,omitempty"`
 	// don't print stdout
-	MuteStdOut bool  `yaml:"mutestdout"`
+	MuteStdOut bool  `yaml:"mutestdout,omitempty"`
 	// push some dummy data on exit
-	DummyDataOnExit bool `yaml:"dummydataonexit"`
+	DummyDataOnExit bool `yaml:"dummydataonexit,omitempty"`
+	// restart the tool when it exits or stalls, at most this number of times in a row (0 never restarts)
+	MaxRestarts int `yaml:"maxrestarts,omitempty"`
+	// delay before first restart, doubled for each following restart (1s if not set)
+	RestartDelay time.Duration `yaml:"restartdelay,omitempty"`
+	// the tool is stalled and killed when it gave no output for this time (0 never checks)
+	OutputTimeout time.Duration `yaml:"outputtimeout,omitempty"`
+	// how ports are opened: udp (default), udp-dynamic, unix or pipe, see ToolTransportUDP
+	Transport string `yaml:"transport,omitempty"`
 }
 
 // object to execute an external command tool while piping in and out data with either socket or standard IO
@@ -42,31 +52,66 @@ type CommandLineTool struct {
 	// internal parameters for the tool
 	config CommandLineToolConfig
 
+	// arguments of the command once parameters are replaced
+	args []string
+	// protect process, its state and output pipes, they are replaced when the tool restarts
+	mutex sync.Mutex
 	// command to call the tool
-	tool       exec.Cmd
-	pipestdin  io.WriteCloser
+	tool       *exec.Cmd
 	pipestdout io.ReadCloser
 	pipestderr io.ReadCloser
-	// current connection to send UDP packets if required
-	currentinconnection *net.UDPConn
-	// current connection to receive UDP packets if required
-	currentoutconnection *net.UDPConn
-	// current connection to send UDP command if required
-	currentcommandconnection *net.UDPConn
-
-	// the golang channel to output MPEG TS Packets
+	// console output readers of the process
+	readers *sync.WaitGroup
+	// output pipe of the process with pipe transport
+	pipeout io.ReadCloser
+	// protect writes to stdin, data input and command of the process
+	inputmutex sync.Mutex
+	pipestdin  io.WriteCloser
+	// current connection (or pipe) to send packets if required
+	datain io.WriteCloser
+	// current connection to receive packets if required
+	dataout net.PacketConn
+	// current connection (or pipe) to send command if required
+	command io.WriteCloser
+	// directory of Unix sockets
+	socketdir string
+
+	// the golang channel to output MPEG TS Packets, protected by mutex
 	outChannel MpegTSChannel
+	// readers sending to the output channel, it is closed once they returned
+	outputs sync.WaitGroup
+
+	// set by Stop, the supervisor does not restart the tool anymore
+	stopping bool
+	stopped  chan struct{}
+	// closed when the supervisor exits
+	done chan struct{}
+	// time of last output in unix nanoseconds, to find a stalled tool
+	lastoutput int64
+	// state reported by the supervisor
+	running  bool
+	restarts int
+	exitcode int
+	// called when the tool failed and is not restarted anymore
+	exithandler func(error)
+	// last output lines of the tool
+	toollog *ToolLog
 }
 
 // ======================== Various handler to process data output
-// read std output from tool and print to console (can be used for std err or std out)
-func (t *CommandLineTool) handleStdReader(reader io.ReadCloser) {
-	bufreader := bufio.NewReader(reader)
-
-	for {
-		str, err := bufreader.ReadString('\n')
-		if err != nil {
-			break
+// read std output from tool, keep it in tool log and print to console (can be used for std err or std out)
+func (t *CommandLineTool) handleStdReader(reader io.ReadCloser, stream string, readers *sync.WaitGroup) {
+	defer readers.Done()
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 1024), maxToolLine)
+	scanner.Split(scanToolLines)
+
+	for scanner.Scan() {
+		str := scanner.Text()
+		t.touchOutput()
+		if t.toollog != nil {
+			t.toollog.Add(stream, str)
 		}
 		if (!t.config.MuteStdOut) {
 			fmt.Print(str)
@@ -74,51 +119,124 @@ func (t *CommandLineTool) handleStdReader(reader io.ReadCloser) {
 	}
 }
 
+// longest line of tool output, longer lines are cut in several lines
+const maxToolLine = 4096
+
+// split tool output in lines ended by \n, \r\n or \r (progress lines of ffmpeg), the end of line is kept
+func scanToolLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	for i, b := range data {
+		if i >= maxToolLine {
+			return i, data[:i], nil
+		}
+
+		switch b {
+		case '\n':
+			return i + 1, data[:i+1], nil
+		case '\r':
+			// wait for next byte to keep \r\n together
+			if i+1 < len(data) {
+				if data[i+1] == '\n' {
+					return i + 2, data[:i+2], nil
+				}
+				return i + 1, data[:i+1], nil
+			}
+			if atEOF || len(data) >= maxToolLine {
+				return i + 1, data[:i+1], nil
+			}
+			return 0, nil, nil
+		}
+	}
+
+	if len(data) >= maxToolLine {
+		return maxToolLine, data[:maxToolLine], nil
+	}
+
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+
+	return 0, nil, nil
+}
+
+// get output channel once for a reader, nil if no output is used
+func (t *CommandLineTool) outputPipe() MpegTSChannel {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.outChannel
+}
+
+// forward a packet to the output channel, return false when the tool is stopped and packets are not read anymore
+func (t *CommandLineTool) sendPacket(out MpegTSChannel, pkt packet.Packet) bool {
+	if out == nil {
+		return true
+	}
+
+	select {
+	case out <- pkt:
+		return true
+	case <-t.stopped:
+		return false
+	}
+}
+
 // handle TS packet coming from std out
-func (t *CommandLineTool) handleTSReader() {
+func (t *CommandLineTool) handleTSReader(reader io.Reader, readers *sync.WaitGroup) {
+	defer t.outputs.Done()
+	defer readers.Done()
+
+	out := t.outputPipe()
+
 	// i := 0
 	for {
 		readpacket := new(packet.Packet)
 
-		readlen, err := t.pipestdout.Read(readpacket[:])
+		// pipes can return part of a packet, a partial packet at end is dropped
+		_, err := io.ReadFull(reader, readpacket[:])
 
 		if err != nil {
 			return
 		}
 
-		// check size of read packet
-		if readlen != packet.PacketSize {
-			// assume that source file contains partial packet, loop so that next read will read EOF
-			continue
-		}
+		t.touchOutput()
 
 
 		//i++
 		// forward to output channel	
-		if (t.outChannel != nil) {
-			//if ((i % 1024) == 0) { log.Print("O") }
-			t.outChannel <- *readpacket
+		//if ((i % 1024) == 0) { log.Print("O") }
+		if !t.sendPacket(out, *readpacket) {
+			return
 		}
 	}
 }
 
 // handle socket output from tool and send to output channel if present
 func (t *CommandLineTool) handleSocketReader() {
-	buffer := make([]byte, 1500)
+	defer t.outputs.Done()
+
+	out := t.outputPipe()
+
+	// Unix datagrams can be larger than UDP ones
+	buffer := make([]byte, 65536)
 
 	for {
-		packetsize, _, err := t.currentoutconnection.ReadFrom(buffer)
+		packetsize, _, err := t.dataout.ReadFrom(buffer)
 		index := 0
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			continue
 		}
 
+		t.touchOutput()
+
 		for packetsize >= packet.PacketSize {
 			readpacket := new(packet.Packet)
 			copy(readpacket[:], buffer[index:index+packet.PacketSize])
 			// forward to output channel	
-			if (t.outChannel != nil) {
-				t.outChannel <- *readpacket
+			if !t.sendPacket(out, *readpacket) {
+				return
 			}
 			packetsize -= packet.PacketSize
 			index += packet.PacketSize
@@ -136,6 +254,7 @@ func CreateCommandLineTool(config CommandLineToolConfig) *CommandLineTool {
 	var err error
 	t := new(CommandLineTool)
 	t.config = config
+	t.stopped = make(chan struct{})
 
 	// create working directory if it does not exists
 	if t.config.WorkDir != "" {
@@ -148,8 +267,16 @@ func CreateCommandLineTool(config CommandLineToolConfig) *CommandLineTool {
 	return t
 }
 
+// keep output lines of the tool in a log, set before start
+func (t *CommandLineTool) SetLog(l *ToolLog) {
+	t.toollog = l
+}
+
 // return output channel (create if required)
 func (t *CommandLineTool) GetOutputPipe() MpegTSChannel {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
 	if (t.outChannel == nil) {
 		t.outChannel = make(MpegTSChannel)
 	}
@@ -159,6 +286,9 @@ func (t *CommandLineTool) GetOutputPipe() MpegTSChannel {
 
 // set an existing output channel
 func (t *CommandLineTool) SetOutputPipe(c MpegTSChannel)  {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
 	t.outChannel = c
 }
 
@@ -178,127 +308,193 @@ func (t *CommandLineTool) SetInputPipe(c MpegTSChannel) {
 	} ()
 }
 
-// run the tool with given parameters (as a string map)
-func (t *CommandLineTool) Start(params map[string]string) error {
-	var err error
+// run the tool with given parameters, a supervisor restarts it as configured
+func (t *CommandLineTool) Start(params ToolParameters) error {
+	// tool parameters are added to the given ones
+	toolparams := make(ToolParameters)
+	for name, values := range params {
+		toolparams[name] = values
+	}
 
-	args := os.Expand(t.config.Args, func(s string) string {
-		switch s {
-		case "_portin_":
-			return fmt.Sprintf("%d", t.config.PortIn + t.config.PortOffset)
-		case "_portout_":
-			return fmt.Sprintf("%d", t.config.PortOut + t.config.PortOffset)
-		case "_portcommand_":
-			return fmt.Sprintf("%d", t.config.PortCommand + t.config.PortOffset)
-		case "_workdir_":
-			return t.config.WorkDir
-		default:
-			return params[s]
-		}
-	})
+	// sockets are kept when the tool restarts, input may already be used by packets
+	t.inputmutex.Lock()
+	transport, err := t.openTransport()
+	t.inputmutex.Unlock()
+
+	if err != nil {
+		t.closeTransport()
+		return err
+	}
+
+	for name, values := range transport {
+		toolparams[name] = values
+	}
+
+	toolparams.Set("_workdir_", t.config.WorkDir)
+
+	// parameters are substituted in each argument, values never split into several arguments
+	t.args = ExpandArgs(t.config.Args.Tokens(), toolparams)
 
-	// regexep to parse argument string (to isolate quoted string)
-	r := regexp.MustCompile("'.+'|\".+\"|\\S+")
+	log.Printf("running command %s\nwith args = %q", t.config.Command, t.args)
 
-	log.Printf("running command %s\nwith args = %s", t.config.Command, args)
+	if t.dataout != nil {
+		t.outputs.Add(1)
+		go t.handleSocketReader()
+	}
 
-	// parse command line into array of strings and create the command wrapper
-	t.tool = *exec.Command(t.config.Command, r.FindAllString(args, -1)...) // this will take in account quote around arguments
+	// Stop waits for the supervisor once the tool is launched
+	done := make(chan struct{})
+
+	t.mutex.Lock()
+	t.done = done
+	t.mutex.Unlock()
+
+	// run the tool
+	cmd, err := t.launch()
+
+	// check if any error while running
+	if err != nil {
+		close(done)
+		return err
+	}
+
+	go t.supervise(cmd)
+
+	// no error
+	return nil
+}
+
+// start a process of the tool with its pipes, also used to restart the tool
+func (t *CommandLineTool) launch() (*exec.Cmd, error) {
+	cmd := exec.Command(t.config.Command, t.args...)
+
+	// set directory if present
+	if t.config.WorkDir != "" {
+		cmd.Dir = t.config.WorkDir
+	}
 
 	// get stdin to flow data
-	t.pipestdin, err = t.tool.StdinPipe()
+	stdin, err := cmd.StdinPipe()
 
 	if err != nil {
 		log.Print(err)
 	}
 
 	// get output
-	t.pipestdout, err = t.tool.StdoutPipe()
+	stdout, err := cmd.StdoutPipe()
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if t.config.PortOut != 0 {
-		log.Printf("Read output from UDP port %d", t.config.PortOut + t.config.PortOffset)
-		var err error
-		listenport := fmt.Sprintf(":%d", t.config.PortOut + t.config.PortOffset )
-		//vt.currentconnection, err = net.DialUDP("udp", listenport)
-		addr, _ := net.ResolveUDPAddr("udp", listenport)
-		t.currentoutconnection, err = net.ListenUDP("udp", addr)
-		err = t.currentoutconnection.SetReadBuffer(2 * 1024 * 1024)
+	// get error output
+	stderr, err := cmd.StderrPipe()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// pipe transport gives new pipes to each process
+	pipes := new(toolPipes)
+	if t.config.Transport == ToolTransportPipe {
+		pipes, err = t.openPipes()
 
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		go t.handleSocketReader()
+		cmd.ExtraFiles = pipes.toolends
+	}
 
-		// dump to console
-		go t.handleStdReader(t.pipestdout)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
 
-	} else {
-		// get date from stdout
-		go t.handleTSReader()
+	// do not start again a tool being stopped
+	if t.stopping {
+		pipes.Close()
+		return nil, errToolStopped
 	}
 
-	// get error output
-	t.pipestderr, err = t.tool.StderrPipe()
+	err = cmd.Start()
+
+	// ends of the tool are now in the process
+	for _, f := range pipes.toolends {
+		f.Close()
+	}
+	pipes.toolends = nil
 
 	if err != nil {
-		return err
+		pipes.Close()
+		return nil, err
 	}
 
-	// dump error to console
-	go t.handleStdReader(t.pipestderr)
+	t.tool = cmd
+	t.pipestdout = stdout
+	t.pipestderr = stderr
+	t.readers = new(sync.WaitGroup)
+	t.running = true
+	t.touchOutput()
 
-	// if input is configured to use socket create a socket to push data
-	if t.config.PortIn != 0 {
-		var target net.UDPAddr
-		var err error
+	// input of a previous process is not used anymore
+	t.inputmutex.Lock()
+	if t.pipestdin != nil {
+		t.pipestdin.Close()
+	}
+	t.pipestdin = stdin
 
-		target.Port = int(t.config.PortIn + t.config.PortOffset)
-		t.currentinconnection, err = net.DialUDP("udp", nil, &target)
-		if err != nil {
-			log.Printf("cannot open port %d for streaming to tool", t.config.PortIn + t.config.PortOffset)
+	if pipes.in != nil {
+		if t.datain != nil {
+			t.datain.Close()
 		}
-
-		err = t.currentinconnection.SetWriteBuffer(1024 * 1024)
+		t.datain = pipes.in
 	}
 
-	// port to send command to the tool
-	if t.config.PortCommand != 0 {
-		var target net.UDPAddr
-		var err error
-
-		target.Port = int(t.config.PortCommand + t.config.PortOffset)
-		t.currentcommandconnection, err = net.DialUDP("udp", nil, &target)
-		if err != nil {
-			log.Printf("cannot open port %d for command to tool", t.config.PortCommand + t.config.PortOffset)
+	if pipes.command != nil {
+		if t.command != nil {
+			t.command.Close()
 		}
-	}	
-
-	// set directory if present
-	if t.config.WorkDir != "" {
-		t.tool.Dir = t.config.WorkDir
+		t.command = pipes.command
+	}
+	t.inputmutex.Unlock()
+
+	t.pipeout = nil
+	if pipes.out != nil {
+		t.pipeout = pipes.out
+		t.readers.Add(1)
+		t.outputs.Add(1)
+		go t.handleTSReader(pipes.out, t.readers)
 	}
 
-	// run the tool
-	err = t.tool.Start()
-
-	// check if any error while running
-	if err != nil {
-		return err
+	if t.config.PortOut != 0 {
+		// dump to console
+		t.readers.Add(1)
+		go t.handleStdReader(stdout, "stdout", t.readers)
+	} else {
+		// get date from stdout
+		t.readers.Add(1)
+		t.outputs.Add(1)
+		go t.handleTSReader(stdout, t.readers)
 	}
 
-	// no error
-	return nil
+	// dump error to console
+	t.readers.Add(1)
+	go t.handleStdReader(stderr, "stderr", t.readers)
+
+	return cmd, nil
 }
 
 // process one packet of data at the input
 func (t *CommandLineTool) ProcessPacket(p packet.Packet) {
-	if t.currentinconnection != nil {
-		t.currentinconnection.Write(p[:])
+	t.inputmutex.Lock()
+	defer t.inputmutex.Unlock()
+
+	t.writePacket(p)
+}
+
+// write one packet to the tool (input lock must be held)
+func (t *CommandLineTool) writePacket(p packet.Packet) {
+	if t.datain != nil {
+		t.datain.Write(p[:])
 	} else {
 		if t.pipestdin != nil {
 			t.pipestdin.Write(p[:])
@@ -306,77 +502,112 @@ func (t *CommandLineTool) ProcessPacket(p packet.Packet) {
 	}
 }
 
-// stop the tool 
+// stop the tool and its supervisor
 func (t *CommandLineTool) Stop() {
+	t.mutex.Lock()
+	if t.stopping {
+		t.mutex.Unlock()
+		return
+	}
+	t.stopping = true
+	close(t.stopped)
+	cmd := t.tool
+	done := t.done
+	t.mutex.Unlock()
+
 	log.Printf("Stopping command %s\n", t.config.Command)
-	
-	// close all pipes
-	if (t.pipestdin != nil) {
+
+	t.inputmutex.Lock()
+	if t.pipestdin != nil {
 		// if an exit command is defined, write it on stdin
 		if t.config.ExitCommand != "" {
-			if (t.config.PortCommand != 0) {
-				log.Printf("Send exit command %s to port %d\n", t.config.Command, t.config.PortCommand + t.config.PortOffset)
-				t.currentcommandconnection.Write([]byte(t.config.ExitCommand))
+			if t.config.PortCommand != 0 {
+				log.Printf("Send exit command %s to command port\n", t.config.Command)
+				if t.command != nil {
+					t.command.Write([]byte(t.config.ExitCommand))
+				}
 			} else {
 				log.Printf("Send exit command %s to stdin\n", t.config.Command)
 				t.pipestdin.Write([]byte(t.config.ExitCommand))
 			}
 
 			// send a few dummy packets on the TS interface to force processing of exit commmand (required by some tools)
-			if (t.config.DummyDataOnExit) {
+			if t.config.DummyDataOnExit {
 				log.Printf("Feed empty packets to stdin\n")
-				dummypacket := [188]byte{ 0x47, 0x1F, 0xFF, 0x00}
+				dummypacket := [188]byte{0x47, 0x1F, 0xFF, 0x00}
 
-				for i:=0 ; i<128 ; i++ {
-					t.ProcessPacket(dummypacket)
+				for i := 0; i < 128; i++ {
+					t.writePacket(dummypacket)
 				}
 			}
 		}
 	}
+	t.inputmutex.Unlock()
 
 	// check if a process has been launched
-	if (t.tool.Process != nil) {
+	if cmd != nil {
 		// if no exit command is defined, just kill the process
 		if t.config.ExitCommand == "" {
 			log.Printf("Force fully kill command\n")
-			t.tool.Process.Kill()
+			cmd.Process.Kill()
 			//t.tool.Process.Signal(os.Interrupt)
 		}
+	}
 
+	// wait for tool to stop, the supervisor does not restart it
+	if done != nil {
 		log.Printf("Wait for command exit\n")
-		// wait for tool to stop
-		t.tool.Wait()
+
+		select {
+		case <-done:
+		case <-time.After(exitTimeout):
+			// tool ignored its exit command
+			log.Printf("Command %s did not exit after %s, killing it\n", t.config.Command, exitTimeout)
+
+			t.mutex.Lock()
+			cmd = t.tool
+			t.mutex.Unlock()
+
+			if cmd != nil {
+				cmd.Process.Kill()
+			}
+			<-done
+		}
 	}
 
 	// close all pipes
-	if (t.pipestdin != nil) {
+	t.inputmutex.Lock()
+	if t.pipestdin != nil {
 		t.pipestdin.Close()
 	}
-	if (t.pipestdout != nil) {
+	t.inputmutex.Unlock()
+
+	if t.pipestdout != nil {
 		t.pipestdout.Close()
 	}
-	if (t.pipestderr != nil) {
+	if t.pipestderr != nil {
 		t.pipestderr.Close()
-	}	
+	}
 
 	// close existing connections
-	if t.currentoutconnection != nil {
-		t.currentoutconnection.Close()
-	}
+	t.closeTransport()
 
-	if t.currentinconnection != nil {
-		t.currentinconnection.Close()
-	}
-	
-	if t.currentcommandconnection != nil {
-		t.currentcommandconnection.Close()
+	// close output pipe once no reader sends to it anymore
+	t.outputs.Wait()
+
+	t.mutex.Lock()
+	out := t.outChannel
+	t.outChannel = nil
+	t.mutex.Unlock()
+
+	if out != nil {
+		close(out)
 	}
 
-	// close output pipe
-	if (t.outChannel != nil) {
-		close(t.outChannel)
-		t.outChannel = nil
+	// end live tails of the log, lines are kept
+	if t.toollog != nil {
+		t.toollog.Close()
 	}
 
-	log.Printf("Command %s stopped\n", t.config.Command)	
-} 
+	log.Printf("Command %s stopped\n", t.config.Command)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestScanToolLines(t *testing.T) {
+	long := strings.Repeat("x", maxToolLine+10)
+
+	tests := []struct {
+		name   string
+		output string
+		want   []string
+	}{
+		{"new lines", "a\nb\n", []string{"a\n", "b\n"}},
+		{"progress lines", "frame=1\rframe=2\rdone\n", []string{"frame=1\r", "frame=2\r", "done\n"}},
+		{"crlf", "a\r\nb\r\n", []string{"a\r\n", "b\r\n"}},
+		{"last line without end", "a\nb", []string{"a\n", "b"}},
+		{"last progress line", "a\r", []string{"a\r"}},
+		{"long line", long + "\n", []string{long[:maxToolLine], long[maxToolLine:] + "\n"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// one byte at a time to split \r\n between reads
+			scanner := bufio.NewScanner(iotest.OneByteReader(strings.NewReader(test.output)))
+			scanner.Buffer(make([]byte, 0, 16), maxToolLine)
+			scanner.Split(scanToolLines)
+
+			var got []string
+			for scanner.Scan() {
+				got = append(got, scanner.Text())
+			}
+
+			if err := scanner.Err(); err != nil {
+				t.Fatalf("scan error %s", err)
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("lines = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// how data and commands are exchanged with a tool when portin, portout or portcommand is set
+const (
+	// UDP ports from configuration plus port offset
+	ToolTransportUDP = "udp"
+	// free UDP ports chosen by the server on loopback
+	ToolTransportUDPDynamic = "udp-dynamic"
+	// Unix datagram sockets in a temporary directory
+	ToolTransportUnix = "unix"
+	// pipes given to the tool as extra file descriptors (3 and following)
+	ToolTransportPipe = "pipe"
+)
+
+// check if a transport name is known (empty is UDP)
+func IsToolTransport(name string) bool {
+	switch name {
+	case "", ToolTransportUDP, ToolTransportUDPDynamic, ToolTransportUnix, ToolTransportPipe:
+		return true
+	}
+
+	return false
+}
+
+// datagram socket sending to a path, packets are dropped until the tool has created its socket
+type unixgramWriter struct {
+	conn   *net.UnixConn
+	target *net.UnixAddr
+}
+
+func (w *unixgramWriter) Write(p []byte) (int, error) {
+	return w.conn.WriteToUnix(p, w.target)
+}
+
+func (w *unixgramWriter) Close() error {
+	return w.conn.Close()
+}
+
+// get a free UDP port on loopback, the tool binds it
+func freeUDPPort() (int, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).Port, nil
+}
+
+// port of a channel for UDP transports, 0 if the channel is not used
+func (t *CommandLineTool) udpPort(base uint16) (int, error) {
+	if base == 0 {
+		return 0, nil
+	}
+
+	if t.config.Transport == ToolTransportUDPDynamic {
+		return freeUDPPort()
+	}
+
+	return int(base + t.config.PortOffset), nil
+}
+
+// open sockets of the tool, they are kept when the tool restarts
+// return the addresses given to the tool as _portin_, _portout_ and _portcommand_ parameters
+func (t *CommandLineTool) openTransport() (ToolParameters, error) {
+	params := make(ToolParameters)
+
+	switch t.config.Transport {
+	case "", ToolTransportUDP, ToolTransportUDPDynamic:
+		// the tool listens for input and commands, the server listens for output
+		portin, err := t.udpPort(t.config.PortIn)
+		if err != nil {
+			return nil, err
+		}
+		portcommand, err := t.udpPort(t.config.PortCommand)
+		if err != nil {
+			return nil, err
+		}
+
+		portout := 0
+		if t.config.PortOut != 0 {
+			// a free port is chosen by listening to port 0
+			addr := &net.UDPAddr{Port: int(t.config.PortOut + t.config.PortOffset)}
+			if t.config.Transport == ToolTransportUDPDynamic {
+				addr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+			}
+
+			conn, err := net.ListenUDP("udp", addr)
+			if err != nil {
+				return nil, err
+			}
+			t.dataout = conn
+
+			portout = conn.LocalAddr().(*net.UDPAddr).Port
+			log.Printf("Read output from UDP port %d", portout)
+
+			err = conn.SetReadBuffer(2 * 1024 * 1024)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// if input is configured to use socket create a socket to push data
+		if portin != 0 {
+			conn, err := net.DialUDP("udp", nil, &net.UDPAddr{Port: portin})
+			if err != nil {
+				log.Printf("cannot open port %d for streaming to tool", portin)
+			} else {
+				conn.SetWriteBuffer(1024 * 1024)
+				t.datain = conn
+			}
+		}
+
+		// port to send command to the tool
+		if portcommand != 0 {
+			conn, err := net.DialUDP("udp", nil, &net.UDPAddr{Port: portcommand})
+			if err != nil {
+				log.Printf("cannot open port %d for command to tool", portcommand)
+			} else {
+				t.command = conn
+			}
+		}
+
+		params.Set("_portin_", strconv.Itoa(portin))
+		params.Set("_portout_", strconv.Itoa(portout))
+		params.Set("_portcommand_", strconv.Itoa(portcommand))
+
+	case ToolTransportUnix:
+		dir, err := ioutil.TempDir("", "dvbhb-tool")
+		if err != nil {
+			return nil, err
+		}
+		t.socketdir = dir
+
+		if t.config.PortOut != 0 {
+			path := filepath.Join(dir, "out")
+			log.Printf("Read output from socket %s", path)
+
+			conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+			if err != nil {
+				return nil, err
+			}
+			conn.SetReadBuffer(2 * 1024 * 1024)
+			t.dataout = conn
+			params.Set("_portout_", path)
+		}
+
+		// sockets of the tool are in and command, the server sends from its own sockets
+		open := func(name string) (io.WriteCloser, string, error) {
+			path := filepath.Join(dir, name)
+
+			conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path + ".server", Net: "unixgram"})
+			if err != nil {
+				return nil, "", err
+			}
+
+			return &unixgramWriter{conn, &net.UnixAddr{Name: path, Net: "unixgram"}}, path, nil
+		}
+
+		if t.config.PortIn != 0 {
+			writer, path, err := open("in")
+			if err != nil {
+				return nil, err
+			}
+			t.datain = writer
+			params.Set("_portin_", path)
+		}
+
+		if t.config.PortCommand != 0 {
+			writer, path, err := open("command")
+			if err != nil {
+				return nil, err
+			}
+			t.command = writer
+			params.Set("_portcommand_", path)
+		}
+
+	case ToolTransportPipe:
+		// pipes are created for each process, descriptors are numbered in order of in, out and command
+		fd := 3
+		for _, p := range []struct {
+			name string
+			port uint16
+		}{{"_portin_", t.config.PortIn}, {"_portout_", t.config.PortOut}, {"_portcommand_", t.config.PortCommand}} {
+			if p.port != 0 {
+				params.Set(p.name, strconv.Itoa(fd))
+				fd++
+			}
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown transport %s for tool %s", t.config.Transport, t.config.Command)
+	}
+
+	return params, nil
+}
+
+// pipes of a process for pipe transport
+type toolPipes struct {
+	// ends kept by the server, nil when not used
+	in      *os.File
+	out     *os.File
+	command *os.File
+	// ends given to the tool, closed in the server once the process is started
+	toolends []*os.File
+}
+
+func (p *toolPipes) Close() {
+	for _, f := range append([]*os.File{p.in, p.out, p.command}, p.toolends...) {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+// create pipes of a new process, descriptors are numbered in order of in, out and command like openTransport
+func (t *CommandLineTool) openPipes() (*toolPipes, error) {
+	p := new(toolPipes)
+
+	if t.config.PortIn != 0 {
+		r, w, err := os.Pipe()
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.in = w
+		p.toolends = append(p.toolends, r)
+	}
+
+	if t.config.PortOut != 0 {
+		r, w, err := os.Pipe()
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.out = r
+		p.toolends = append(p.toolends, w)
+	}
+
+	if t.config.PortCommand != 0 {
+		r, w, err := os.Pipe()
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.command = w
+		p.toolends = append(p.toolends, r)
+	}
+
+	return p, nil
+}
+
+// close sockets of the tool and remove their directory
+func (t *CommandLineTool) closeTransport() {
+	if t.dataout != nil {
+		t.dataout.Close()
+	}
+
+	t.inputmutex.Lock()
+	if t.datain != nil {
+		t.datain.Close()
+	}
+	if t.command != nil {
+		t.command.Close()
+	}
+	t.inputmutex.Unlock()
+
+	if t.socketdir != "" {
+		os.RemoveAll(t.socketdir)
+	}
+}
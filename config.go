@@ -18,6 +18,10 @@ func (config *DeviceConfig) ReadConfig(configFileName string) error {
 		return err
 	}
 
+	// keep source to report positions when validating
+	config.filename = configFileName
+	config.source = source
+
 	config.dynamicchannelmaps = make(map[string]DynamicChannelMap)
 	config.dynamiccontent = make(map[string]DynamicContent)
 	
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// prefix of channel sources served by the transcode manager
+const transcodeSourcePrefix = "dynamic/transcode/"
+
+// a configuration problem with its position in the file
+type ConfigError struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e *ConfigError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.File, e.Message)
+	}
+
+	return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Message)
+}
+
+// collect errors of a YAML document
+type configValidator struct {
+	file string
+	root *yaml.Node
+	errs []error
+}
+
+// create a validator on the content of a file
+func newConfigValidator(file string, source []byte) (*configValidator, error) {
+	v := &configValidator{file: file}
+
+	var document yaml.Node
+
+	err := yaml.Unmarshal(source, &document)
+	if err != nil {
+		return nil, err
+	}
+
+	if document.Kind == yaml.DocumentNode && len(document.Content) > 0 {
+		v.root = document.Content[0]
+	}
+
+	return v, nil
+}
+
+// add an error at the position of a node (no position if node is nil)
+func (v *configValidator) errorAt(node *yaml.Node, format string, args ...interface{}) {
+	e := &ConfigError{File: v.file, Message: fmt.Sprintf(format, args...)}
+
+	if node != nil {
+		e.Line = node.Line
+		e.Column = node.Column
+	}
+
+	v.errs = append(v.errs, e)
+}
+
+// get key and value nodes of an entry of a mapping node (nil if not found)
+func mappingEntry(node *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i], node.Content[i+1]
+		}
+	}
+
+	return nil, nil
+}
+
+// follow a path of keys from a node, nil if not found
+func mappingValue(node *yaml.Node, path ...string) *yaml.Node {
+	for _, key := range path {
+		_, node = mappingEntry(node, key)
+	}
+
+	return node
+}
+
+// get key and value nodes of all entries of a mapping node
+func mappingEntries(node *yaml.Node) [][2]*yaml.Node {
+	var entries [][2]*yaml.Node
+
+	if node == nil || node.Kind != yaml.MappingNode {
+		return entries
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		entries = append(entries, [2]*yaml.Node{node.Content[i], node.Content[i+1]})
+	}
+
+	return entries
+}
+
+// get item nodes of a sequence node
+func sequenceItems(node *yaml.Node) []*yaml.Node {
+	if node == nil || node.Kind != yaml.SequenceNode {
+		return nil
+	}
+
+	return node.Content
+}
+
+var yamlUnmarshalerType = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+
+// get YAML keys of the fields of a struct type with their type, inline structs give their own keys
+func yamlFields(t reflect.Type, fields map[string]reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		// private fields are not decoded
+		if field.PkgPath != "" {
+			continue
+		}
+
+		tag := strings.Split(field.Tag.Get("yaml"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+
+		inline := false
+		for _, flag := range tag[1:] {
+			inline = inline || flag == "inline"
+		}
+
+		if inline && field.Type.Kind() == reflect.Struct {
+			yamlFields(field.Type, fields)
+			continue
+		}
+
+		name := tag[0]
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+
+		fields[name] = field.Type
+	}
+}
+
+// report keys of mapping nodes which are not fields of the type decoded from the node, they are ignored by decoding
+func (v *configValidator) checkKnownKeys(node *yaml.Node, t reflect.Type, path string) {
+	if node == nil {
+		return
+	}
+
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	// types decoding themselves accept their own content
+	if reflect.PtrTo(t).Implements(yamlUnmarshalerType) {
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		fields := make(map[string]reflect.Type)
+		yamlFields(t, fields)
+
+		for _, entry := range mappingEntries(node) {
+			key := entry[0].Value
+			fieldtype, found := fields[key]
+
+			switch {
+			case key == "<<":
+				// merge key, merged mapping is checked where it is defined
+			case !found && path == "":
+				v.errorAt(entry[0], "unknown key %s", key)
+			case !found:
+				v.errorAt(entry[0], "unknown key %s in %s", key, path)
+			default:
+				v.checkKnownKeys(entry[1], fieldtype, strings.TrimPrefix(path+"."+key, "."))
+			}
+		}
+
+	case reflect.Map:
+		for _, entry := range mappingEntries(node) {
+			v.checkKnownKeys(entry[1], t.Elem(), strings.TrimPrefix(path+"."+entry[0].Value, "."))
+		}
+
+	case reflect.Slice, reflect.Array:
+		for i, item := range sequenceItems(node) {
+			v.checkKnownKeys(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+	}
+}
+
+// a port used by a tool instance
+type configPortUse struct {
+	owner string
+	node  *yaml.Node
+}
+
+// check values of a configuration which was read, return all problems found with their position
+func (config *DeviceConfig) Validate() []error {
+	v, err := newConfigValidator(config.filename, config.source)
+	if err != nil {
+		return []error{&ConfigError{File: config.filename, Message: err.Error()}}
+	}
+
+	root := v.root
+
+	// misspelled keys are ignored by decoding
+	v.checkKnownKeys(root, reflect.TypeOf(*config), "")
+
+	if config.ServerPort < 0 || config.ServerPort > 65535 {
+		v.errorAt(mappingValue(root, "serverport"), "serverport %d is not a valid port", config.ServerPort)
+	}
+
+	if config.TunerWait < 0 {
+		v.errorAt(mappingValue(root, "tunerwait"), "tunerwait %s is negative", config.TunerWait)
+	}
+
+	for _, item := range sequenceItems(mappingValue(root, "priorityclients")) {
+		if parseClientNetwork(item.Value) == nil {
+			v.errorAt(item, "priorityclients entry %s is not an address or network", item.Value)
+		}
+	}
+
+	config.validateTuners(v)
+
+	if len(config.Feeds) > 0 && config.TunerConfig.Command == "" {
+		v.errorAt(mappingValue(root, "feeds"), "tunerconfig has no command but feeds are configured")
+	}
+
+	// aliases must point to a feed
+	for _, entry := range mappingEntries(mappingValue(root, "aliases")) {
+		split := strings.SplitN(entry[1].Value, "/", 2)
+
+		if len(split) != 2 || split[1] == "" {
+			v.errorAt(entry[1], "alias %s target %s is not in the form feed/program", entry[0].Value, entry[1].Value)
+			continue
+		}
+
+		if _, found := config.Feeds[split[0]]; !found {
+			v.errorAt(entry[1], "alias %s target %s uses unknown feed %s", entry[0].Value, entry[1].Value, split[0])
+		}
+	}
+
+	for _, item := range sequenceItems(mappingValue(root, "remuxfeeds")) {
+		feed := strings.SplitN(item.Value, "/", 2)[0]
+
+		if _, found := config.Feeds[feed]; !found {
+			v.errorAt(item, "remuxfeeds uses unknown feed %s", feed)
+		}
+	}
+
+	config.validateChannelMaps(v)
+	config.validatePorts(v)
+
+	return v.errs
+}
+
+// tuner indices used by the transcode manager, sorted
+func (config *DeviceConfig) tunerIndices() []int {
+	used := make(map[int]bool)
+
+	for _, index := range config.TunerList {
+		used[index] = true
+	}
+
+	for i := 0; i < config.MaxTuner; i++ {
+		used[i] = true
+	}
+
+	indices := make([]int, 0, len(used))
+	for index := range used {
+		indices = append(indices, index)
+	}
+	sort.Ints(indices)
+
+	return indices
+}
+
+func (config *DeviceConfig) validateTuners(v *configValidator) {
+	maxtunernode := mappingValue(v.root, "maxtuner")
+	tunerlistnode := mappingValue(v.root, "tunerlist")
+
+	if config.MaxTuner < 0 {
+		v.errorAt(maxtunernode, "maxtuner %d is negative", config.MaxTuner)
+	}
+
+	seen := make(map[int]*yaml.Node)
+
+	for i, item := range sequenceItems(tunerlistnode) {
+		if i >= len(config.TunerList) {
+			break
+		}
+
+		index := config.TunerList[i]
+
+		if index < 0 {
+			v.errorAt(item, "tunerlist holds negative tuner %d", index)
+		}
+
+		if first, found := seen[index]; found {
+			v.errorAt(item, "tuner %d is already in tunerlist at line %d", index, first.Line)
+		}
+		seen[index] = item
+	}
+
+	// tunerlist tuners are used first, then tuners 0 to maxtuner-1
+	if len(config.TunerList) > 0 && config.MaxTuner > 0 {
+		v.errorAt(maxtunernode, "maxtuner and tunerlist are both set, tuners 0 to %d are used in addition to tunerlist", config.MaxTuner-1)
+	}
+
+	if len(config.Feeds) > 0 && len(config.tunerIndices()) == 0 {
+		v.errorAt(mappingValue(v.root, "feeds"), "feeds are configured but neither maxtuner nor tunerlist gives a tuner")
+	}
+}
+
+// get feed and program of a transcoded channel source, false if not a transcode source
+func transcodeSourceProgram(source string) (string, string, bool) {
+	position := strings.Index(source, transcodeSourcePrefix)
+	if position < 0 {
+		return "", "", false
+	}
+
+	split := strings.SplitN(source[position+len(transcodeSourcePrefix):], "/", 3)
+
+	if len(split) < 3 {
+		return split[0], "", true
+	}
+
+	return split[0], split[1], true
+}
+
+func (config *DeviceConfig) validateChannelMaps(v *configValidator) {
+	for _, mapentry := range mappingEntries(mappingValue(v.root, "channelmaps")) {
+		mapname := mapentry[0].Value
+
+		// numbers decoded from keys, several spellings can give the same number
+		numbers := make(map[int]*yaml.Node)
+
+		for _, entry := range mappingEntries(mappingValue(mapentry[1], "channels")) {
+			var number int
+
+			if err := entry[0].Decode(&number); err != nil {
+				v.errorAt(entry[0], "channel number %s of channel map %s is not a number", entry[0].Value, mapname)
+				continue
+			}
+
+			if first, found := numbers[number]; found {
+				v.errorAt(entry[0], "channel number %d of channel map %s is already used at line %d", number, mapname, first.Line)
+			}
+			numbers[number] = entry[0]
+
+			sourcenode := mappingValue(entry[1], "source")
+
+			if sourcenode == nil || sourcenode.Value == "" {
+				v.errorAt(entry[0], "channel %d of channel map %s has no source", number, mapname)
+				continue
+			}
+
+			feed, program, transcoded := transcodeSourceProgram(sourcenode.Value)
+
+			if !transcoded {
+				continue
+			}
+
+			if program == "" {
+				v.errorAt(sourcenode, "source %s is not in the form %s<feed>/<program>/<file>", sourcenode.Value, transcodeSourcePrefix)
+				continue
+			}
+
+			// aliases are resolved before feeds
+			if _, found := config.Aliases[feed+"/"+program]; found {
+				continue
+			}
+
+			if _, found := config.Feeds[feed]; !found {
+				v.errorAt(sourcenode, "source %s uses unknown feed %s", sourcenode.Value, feed)
+			}
+		}
+	}
+}
+
+// number of transcode instances which can run at the same time
+func (config *DeviceConfig) transcodeInstances() int {
+	tuners := config.tunerIndices()
+
+	count := 0
+	if len(tuners) > 0 {
+		count = tuners[len(tuners)-1] + 1
+	}
+
+	if !config.ShareTuners {
+		return count
+	}
+
+	// with shared tuners, each program of channel maps can run at the same time
+	programs := make(map[string]bool)
+
+	for _, channelmap := range config.ChannelMaps {
+		for _, channel := range channelmap.Channels {
+			if feed, program, transcoded := transcodeSourceProgram(channel.Source); transcoded {
+				programs[feed+"/"+program] = true
+			}
+		}
+	}
+
+	if len(programs) > count {
+		count = len(programs)
+	}
+
+	return count
+}
+
+// check that UDP ports of tools do not overlap for all tuner and instance indices
+func (config *DeviceConfig) validatePorts(v *configValidator) {
+	used := make(map[int]configPortUse)
+
+	check := func(name string, tool CommandLineToolConfig, toolnode *yaml.Node, offsets []int) {
+		if !IsToolTransport(tool.Transport) {
+			v.errorAt(mappingValue(toolnode, "transport"), "%s transport %s is not udp, udp-dynamic, unix or pipe", name, tool.Transport)
+			return
+		}
+
+		// other transports do not use configured port numbers
+		if tool.Transport != "" && tool.Transport != ToolTransportUDP {
+			return
+		}
+
+		ports := []struct {
+			key  string
+			base uint16
+		}{{"portin", tool.PortIn}, {"portout", tool.PortOut}, {"portcommand", tool.PortCommand}}
+
+		for _, p := range ports {
+			if p.base == 0 {
+				continue
+			}
+
+			node := mappingValue(toolnode, p.key)
+
+			for _, offset := range offsets {
+				port := int(p.base) + offset
+				owner := fmt.Sprintf("%s %s (index %d)", name, p.key, offset)
+
+				if port > 65535 {
+					v.errorAt(node, "port %d of %s is not a valid port", port, owner)
+					break
+				}
+
+				if first, found := used[port]; found {
+					line := 0
+					if first.node != nil {
+						line = first.node.Line
+					}
+					v.errorAt(node, "port %d of %s is also used by %s at line %d", port, owner, first.owner, line)
+					break
+				}
+
+				used[port] = configPortUse{owner, node}
+			}
+		}
+	}
+
+	// tuner and transcoder use their index as port offset
+	check("tunerconfig", config.TunerConfig, mappingValue(v.root, "tunerconfig"), config.tunerIndices())
+
+	instances := make([]int, config.transcodeInstances())
+	for i := range instances {
+		instances[i] = i
+	}
+	check("transcodeconfig", config.TranscodeConfig, mappingValue(v.root, "transcodeconfig"), instances)
+
+	// helper tools run once with their configured offset
+	for i, item := range sequenceItems(mappingValue(v.root, "helpertools")) {
+		if i < len(config.HelperTools) {
+			tool := config.HelperTools[i]
+			check(fmt.Sprintf("helpertools %d", i), tool, item, []int{int(tool.PortOffset)})
+		}
+	}
+}
+
+// check a virtual tuner configuration file, return all problems found with their position
+func ValidateVirtualTunerConfig(file string) []error {
+	source, err := ioutil.ReadFile(file)
+	if err != nil {
+		return []error{&ConfigError{File: file, Message: err.Error()}}
+	}
+
+	v, err := newConfigValidator(file, source)
+	if err != nil {
+		return []error{&ConfigError{File: file, Message: err.Error()}}
+	}
+
+	v.checkKnownKeys(v.root, reflect.TypeOf(VirtualTunerConfig{}), "")
+
+	// LCN must be unique over all frequencies
+	lcns := make(map[int]*yaml.Node)
+
+	for _, frequency := range mappingEntries(mappingValue(v.root, "frequencies")) {
+		for _, service := range mappingEntries(mappingValue(frequency[1], "services")) {
+			node := mappingValue(service[1], "lcn")
+
+			var lcn int
+			if node == nil || node.Decode(&lcn) != nil || lcn == 0 {
+				continue
+			}
+
+			if first, found := lcns[lcn]; found {
+				v.errorAt(node, "LCN %d of service %s on %s is already used at line %d", lcn, service[0].Value, frequency[0].Value, first.Line)
+			}
+			lcns[lcn] = node
+		}
+	}
+
+	return v.errs
+}
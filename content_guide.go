@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ContentGuidePath = "/contentguide/"
+
+// endpoints of the content guide (relative to ContentGuidePath)
+const (
+	ContentGuideSchedulePath = "schedule"
+	ContentGuideProgramPath  = "program"
+)
+
+// classification scheme of programme genres
+const contentSubjectScheme = "urn:dvb:metadata:cs:ContentSubject:2019:"
+
+// terms for content_nibble_level_1 of EIT content descriptor, undefined, children (an audience, not a subject),
+// special characteristics, reserved and user defined values have no term
+var contentSubjectTerms = map[int]string{
+	0x1: "3.4",   // movie/drama: fiction/drama
+	0x2: "3.1.1", // news/current affairs: news
+	0x3: "3.5",   // show/game show: amusement/entertainment
+	0x4: "3.2",   // sports
+	0x6: "3.6",   // music/ballet/dance: music
+	0x7: "3.1.4", // arts/culture: arts and media
+	0x8: "3.1.3", // social/political issues/economics: general non-fiction
+	0x9: "3.1.6", // education/science/factual topics: sciences
+	0xA: "3.3",   // leisure hobbies
+}
+
+// terms of content_nibble_level_2 more precise than their level 1
+var contentSubjectDetailedTerms = map[[2]int]string{
+	{0x2, 0x3}: "3.1",   // documentary: non-fiction/information
+	{0x2, 0x4}: "3.1.3", // discussion/interview/debate: general non-fiction
+	{0x7, 0x3}: "3.1.2", // religion: philosophies of life
+	{0x8, 0x3}: "3.1.7", // remarkable people: human interest
+	{0x9, 0x5}: "3.1.5", // social/spiritual sciences: humanities
+	{0x9, 0x7}: "3.1.5", // languages: humanities
+}
+
+// get ContentSubject term of an EIT genre, empty if it has none
+func contentSubjectHref(genre EpgGenre) string {
+	term, found := contentSubjectDetailedTerms[[2]int{genre.Level1, genre.Level2}]
+	if !found {
+		term, found = contentSubjectTerms[genre.Level1]
+	}
+
+	if !found {
+		return ""
+	}
+
+	return contentSubjectScheme + term
+}
+
+// authority used to build programme CRIDs
+const contentGuideCRIDPrefix = "crid://dvb-hb/"
+
+// TV-Anytime document returned by the content guide
+type tvaMain struct {
+	XMLName            xml.Name              `xml:"TVAMain"`
+	Xmlns              string                `xml:"xmlns,attr"`
+	XmlnsMpeg7         string                `xml:"xmlns:mpeg7,attr"`
+	ProgramDescription tvaProgramDescription `xml:"ProgramDescription"`
+}
+
+type tvaProgramDescription struct {
+	ProgramInformation []tvaProgramInformation `xml:"ProgramInformationTable>ProgramInformation"`
+	Schedules          []tvaSchedule           `xml:"ProgramLocationTable>Schedule"`
+}
+
+type tvaProgramInformation struct {
+	ProgramID        string              `xml:"programId,attr"`
+	BasicDescription tvaBasicDescription `xml:"BasicDescription"`
+}
+
+type tvaBasicDescription struct {
+	Titles           []tvaText             `xml:"Title"`
+	Synopsis         []tvaText             `xml:"Synopsis"`
+	Genres           []tvaGenre            `xml:"Genre"`
+	ParentalGuidance []tvaParentalGuidance `xml:"ParentalGuidance"`
+}
+
+type tvaText struct {
+	Lang   string `xml:"xml:lang,attr,omitempty"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length string `xml:"length,attr,omitempty"`
+	Text   string `xml:",chardata"`
+}
+
+type tvaGenre struct {
+	Type string `xml:"type,attr"`
+	Href string `xml:"href,attr"`
+}
+
+type tvaParentalGuidance struct {
+	MinimumAge int `xml:"mpeg7:MinimumAge"`
+}
+
+type tvaSchedule struct {
+	ServiceIDRef string             `xml:"serviceIDRef,attr"`
+	Start        string             `xml:"start,attr,omitempty"`
+	End          string             `xml:"end,attr,omitempty"`
+	Events       []tvaScheduleEvent `xml:"ScheduleEvent"`
+}
+
+type tvaScheduleEvent struct {
+	Program            tvaProgram `xml:"Program"`
+	PublishedStartTime string     `xml:"PublishedStartTime"`
+	PublishedDuration  string     `xml:"PublishedDuration"`
+}
+
+type tvaProgram struct {
+	CRID string `xml:"crid,attr"`
+}
+
+// service reference used by the content guide for a channel, empty if channel has no DVB triplet
+func (channel Channel) GetContentGuideServiceRef() string {
+	if channel.ContentGuideServiceRef != "" {
+		return channel.ContentGuideServiceRef
+	}
+
+	if channel.SID == 0 {
+		return ""
+	}
+
+	return FormatDvbServiceRef(DvbServiceKey{channel.ONID, channel.TSID, channel.SID})
+}
+
+// format a triplet as a dvb:// locator
+func FormatDvbServiceRef(key DvbServiceKey) string {
+	return fmt.Sprintf("dvb://%x.%x.%x", key.OriginalNetworkID, key.TransportStreamID, key.ServiceID)
+}
+
+// parse a dvb://onid.tsid.sid locator
+func ParseDvbServiceRef(ref string) (DvbServiceKey, bool) {
+	var key DvbServiceKey
+
+	if !strings.HasPrefix(ref, "dvb://") {
+		return key, false
+	}
+
+	parts := strings.Split(ref[len("dvb://"):], ".")
+
+	if len(parts) != 3 {
+		return key, false
+	}
+
+	values := make([]int, 3)
+
+	for i := range parts {
+		value, err := strconv.ParseUint(parts[i], 16, 16)
+		if err != nil {
+			return key, false
+		}
+		values[i] = int(value)
+	}
+
+	return DvbServiceKey{values[0], values[1], values[2]}, true
+}
+
+// CRID of an event
+func contentGuideCRID(key DvbServiceKey, event EpgEvent) string {
+	return fmt.Sprintf("%s%x.%x.%x/%x", contentGuideCRIDPrefix, key.OriginalNetworkID, key.TransportStreamID, key.ServiceID, event.EventID)
+}
+
+// get service and event id from a CRID
+func parseContentGuideCRID(crid string) (DvbServiceKey, int, bool) {
+	if !strings.HasPrefix(crid, contentGuideCRIDPrefix) {
+		return DvbServiceKey{}, 0, false
+	}
+
+	parts := strings.SplitN(crid[len(contentGuideCRIDPrefix):], "/", 2)
+
+	if len(parts) != 2 {
+		return DvbServiceKey{}, 0, false
+	}
+
+	key, ok := ParseDvbServiceRef("dvb://" + parts[0])
+	eventid, err := strconv.ParseUint(parts[1], 16, 16)
+
+	if !ok || err != nil {
+		return DvbServiceKey{}, 0, false
+	}
+
+	return key, int(eventid), true
+}
+
+// format a duration as ISO 8601 (PTnHnMnS)
+func formatISODuration(d time.Duration) string {
+	seconds := int(d.Seconds())
+	result := "PT"
+
+	if seconds >= 3600 {
+		result += fmt.Sprintf("%dH", seconds/3600)
+	}
+	if seconds%3600 >= 60 {
+		result += fmt.Sprintf("%dM", (seconds%3600)/60)
+	}
+	if seconds%60 != 0 || seconds == 0 {
+		result += fmt.Sprintf("%dS", seconds%60)
+	}
+
+	return result
+}
+
+// format a time as used in TV-Anytime documents
+func formatTVATime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05Z")
+}
+
+// build description of one event, false if event can't be shown (no title)
+func makeProgramInformation(key DvbServiceKey, event EpgEvent) (tvaProgramInformation, bool) {
+	var info tvaProgramInformation
+
+	info.ProgramID = contentGuideCRID(key, event)
+
+	for _, text := range event.Texts {
+		if text.Title != "" {
+			info.BasicDescription.Titles = append(info.BasicDescription.Titles, tvaText{Lang: text.Language, Type: "main", Text: text.Title})
+		}
+		if text.Synopsis != "" {
+			info.BasicDescription.Synopsis = append(info.BasicDescription.Synopsis, tvaText{Lang: text.Language, Length: "medium", Text: text.Synopsis})
+		}
+		if text.ExtendedSynopsis != "" {
+			info.BasicDescription.Synopsis = append(info.BasicDescription.Synopsis, tvaText{Lang: text.Language, Length: "long", Text: text.ExtendedSynopsis})
+		}
+	}
+
+	if len(info.BasicDescription.Titles) == 0 {
+		return info, false
+	}
+
+	for _, genre := range event.Genres {
+		href := contentSubjectHref(genre)
+		if href == "" {
+			continue
+		}
+
+		// several content nibbles can give the same term
+		duplicate := false
+		for _, previous := range info.BasicDescription.Genres {
+			duplicate = duplicate || previous.Href == href
+		}
+		if duplicate {
+			continue
+		}
+
+		genretype := "main"
+		if len(info.BasicDescription.Genres) > 0 {
+			genretype = "secondary"
+		}
+		info.BasicDescription.Genres = append(info.BasicDescription.Genres, tvaGenre{Type: genretype, Href: href})
+	}
+
+	for _, rating := range event.ParentalRatings {
+		info.BasicDescription.ParentalGuidance = append(info.BasicDescription.ParentalGuidance, tvaParentalGuidance{MinimumAge: rating.MinimumAge})
+	}
+
+	return info, true
+}
+
+// add events of a service to document
+func (doc *tvaMain) addSchedule(key DvbServiceKey, ref string, start time.Time, end time.Time, events []EpgEvent) {
+	var schedule tvaSchedule
+
+	schedule.ServiceIDRef = ref
+	if !start.IsZero() {
+		schedule.Start = formatTVATime(start)
+	}
+	if !end.IsZero() {
+		schedule.End = formatTVATime(end)
+	}
+
+	for _, event := range events {
+		info, ok := makeProgramInformation(key, event)
+
+		if !ok {
+			continue
+		}
+
+		doc.ProgramDescription.ProgramInformation = append(doc.ProgramDescription.ProgramInformation, info)
+		schedule.Events = append(schedule.Events, tvaScheduleEvent{
+			Program:            tvaProgram{CRID: info.ProgramID},
+			PublishedStartTime: formatTVATime(event.Start),
+			PublishedDuration:  formatISODuration(event.Duration),
+		})
+	}
+
+	doc.ProgramDescription.Schedules = append(doc.ProgramDescription.Schedules, schedule)
+}
+
+// parse a time given in seconds since epoch, zero time if absent
+func parseEpochParameter(r *http.Request, name string) (time.Time, error) {
+	value := r.URL.Query().Get(name)
+
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	seconds, err := strconv.ParseInt(value, 10, 64)
+
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(seconds, 0), nil
+}
+
+func contentguideHandler(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, ContentGuidePath) {
+		http.Error(w, "404 not found.", http.StatusNotFound)
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	subpath := strings.Trim(r.URL.Path[len(ContentGuidePath):], "/")
+
+	doc := tvaMain{Xmlns: TVAMetadataNamespace, XmlnsMpeg7: MPEG7Namespace}
+	query := r.URL.Query()
+
+	switch subpath {
+	case ContentGuideSchedulePath:
+		// services can be given as sid or sids[]
+		refs := append(query["sid"], query["sids[]"]...)
+
+		if len(refs) == 0 {
+			http.Error(w, "400 missing service.", http.StatusBadRequest)
+			return
+		}
+
+		start, err := parseEpochParameter(r, "start")
+		if err != nil {
+			http.Error(w, "400 invalid start.", http.StatusBadRequest)
+			return
+		}
+
+		end, err := parseEpochParameter(r, "end")
+		if err != nil {
+			http.Error(w, "400 invalid end.", http.StatusBadRequest)
+			return
+		}
+
+		nownext := query.Get("now_next") == "true"
+
+		for _, ref := range refs {
+			key, ok := ParseDvbServiceRef(ref)
+
+			// unknown services give an empty schedule
+			if !ok {
+				doc.ProgramDescription.Schedules = append(doc.ProgramDescription.Schedules, tvaSchedule{ServiceIDRef: ref})
+				continue
+			}
+
+			if nownext {
+				doc.addSchedule(key, ref, time.Time{}, time.Time{}, epgstore.GetNowNext(key, time.Now()))
+			} else {
+				doc.addSchedule(key, ref, start, end, epgstore.GetEvents(key, start, end))
+			}
+		}
+
+	case ContentGuideProgramPath:
+		key, eventid, ok := parseContentGuideCRID(query.Get("pid"))
+
+		if !ok {
+			http.Error(w, "404 not found.", http.StatusNotFound)
+			return
+		}
+
+		event, found := epgstore.GetEvent(key, eventid)
+
+		if !found {
+			http.Error(w, "404 not found.", http.StatusNotFound)
+			return
+		}
+
+		doc.addSchedule(key, FormatDvbServiceRef(key), time.Time{}, time.Time{}, []EpgEvent{event})
+
+	default:
+		http.Error(w, "404 not found.", http.StatusNotFound)
+		return
+	}
+
+	writeXMLResponse(w, doc)
+}
+
+// describe the content guide for a service list
+func NewContentGuideSource(host string, provider string) *DVBIContentGuideSource {
+	cgs := new(DVBIContentGuideSource)
+
+	cgs.CGSID = "cgs-1"
+	cgs.ProviderName = provider
+	cgs.ScheduleInfoEndpoint = DVBIExtendedURI{ContentType: "application/xml", URI: fmt.Sprintf("http://%s%s%s", host, ContentGuidePath, ContentGuideSchedulePath)}
+	cgs.ProgramInfoEndpoint = &DVBIExtendedURI{ContentType: "application/xml", URI: fmt.Sprintf("http://%s%s%s", host, ContentGuidePath, ContentGuideProgramPath)}
+
+	return cgs
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProgramInformationGenres(t *testing.T) {
+	tests := []struct {
+		name   string
+		genres []EpgGenre
+		want   []tvaGenre
+	}{
+		{"movie", []EpgGenre{{Level1: 0x1, Level2: 0x4}}, []tvaGenre{{"main", "urn:dvb:metadata:cs:ContentSubject:2019:3.4"}}},
+		{"news", []EpgGenre{{Level1: 0x2, Level2: 0x1}}, []tvaGenre{{"main", "urn:dvb:metadata:cs:ContentSubject:2019:3.1.1"}}},
+		{"documentary", []EpgGenre{{Level1: 0x2, Level2: 0x3}}, []tvaGenre{{"main", "urn:dvb:metadata:cs:ContentSubject:2019:3.1"}}},
+		{"religion", []EpgGenre{{Level1: 0x7, Level2: 0x3}}, []tvaGenre{{"main", "urn:dvb:metadata:cs:ContentSubject:2019:3.1.2"}}},
+		{"unknown genres are left out", []EpgGenre{{Level1: 0x0}, {Level1: 0x5, Level2: 0x5}, {Level1: 0xB, Level2: 0x3}, {Level1: 0xF}, {Level1: 0x4, Level2: 0x3}},
+			[]tvaGenre{{"main", "urn:dvb:metadata:cs:ContentSubject:2019:3.2"}}},
+		{"secondary genre without duplicate", []EpgGenre{{Level1: 0x6, Level2: 0x1}, {Level1: 0x6, Level2: 0x4}, {Level1: 0x7}},
+			[]tvaGenre{{"main", "urn:dvb:metadata:cs:ContentSubject:2019:3.6"}, {"secondary", "urn:dvb:metadata:cs:ContentSubject:2019:3.1.4"}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			event := EpgEvent{EventID: 1, Texts: []EpgText{{Language: "eng", Title: "Title"}}, Genres: test.genres}
+
+			info, ok := makeProgramInformation(DvbServiceKey{}, event)
+			if !ok {
+				t.Fatal("no program information")
+			}
+
+			if !reflect.DeepEqual(info.BasicDescription.Genres, test.want) {
+				t.Errorf("genres = %v, want %v", info.BasicDescription.Genres, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/xml"
+)
+
+const (
+	DASHNamespace   = "urn:mpeg:dash:schema:mpd:2011"
+	DASHDVBProfiles = "urn:dvb:dash:profile:dvb-dash:2014,urn:dvb:dash:profile:dvb-dash:isoff-ext-live:2014"
+)
+
+// ================= live manifest (MPD of urn:mpeg:dash:schema:mpd:2011)
+
+type DASHMPD struct {
+	XMLName                    xml.Name   `xml:"MPD"`
+	Xmlns                      string     `xml:"xmlns,attr"`
+	Profiles                   string     `xml:"profiles,attr"`
+	Type                       string     `xml:"type,attr"`
+	AvailabilityStartTime      string     `xml:"availabilityStartTime,attr"`
+	PublishTime                string     `xml:"publishTime,attr"`
+	MinimumUpdatePeriod        string     `xml:"minimumUpdatePeriod,attr,omitempty"`
+	MinBufferTime              string     `xml:"minBufferTime,attr"`
+	TimeShiftBufferDepth       string     `xml:"timeShiftBufferDepth,attr,omitempty"`
+	SuggestedPresentationDelay string     `xml:"suggestedPresentationDelay,attr,omitempty"`
+	MaxSegmentDuration         string     `xml:"maxSegmentDuration,attr,omitempty"`
+	Period                     DASHPeriod `xml:"Period"`
+}
+
+type DASHPeriod struct {
+	ID             string              `xml:"id,attr"`
+	Start          string              `xml:"start,attr"`
+	AdaptationSets []DASHAdaptationSet `xml:"AdaptationSet"`
+}
+
+type DASHAdaptationSet struct {
+	ContentType               string               `xml:"contentType,attr"`
+	MimeType                  string               `xml:"mimeType,attr"`
+	Lang                      string               `xml:"lang,attr,omitempty"`
+	SegmentAlignment          bool                 `xml:"segmentAlignment,attr"`
+	StartWithSAP              int                  `xml:"startWithSAP,attr"`
+	AudioChannelConfiguration *DASHDescriptor      `xml:"AudioChannelConfiguration,omitempty"`
+	Role                      *DASHDescriptor      `xml:"Role,omitempty"`
+	SegmentTemplate           DASHSegmentTemplate  `xml:"SegmentTemplate"`
+	Representations           []DASHRepresentation `xml:"Representation"`
+}
+
+type DASHDescriptor struct {
+	SchemeIDURI string `xml:"schemeIdUri,attr"`
+	Value       string `xml:"value,attr"`
+}
+
+type DASHSegmentTemplate struct {
+	Timescale      int                  `xml:"timescale,attr"`
+	Initialization string               `xml:"initialization,attr"`
+	Media          string               `xml:"media,attr"`
+	Timeline       []DASHSegmentElement `xml:"SegmentTimeline>S"`
+}
+
+// a run of segments with the same duration
+type DASHSegmentElement struct {
+	T int64 `xml:"t,attr"`
+	D int64 `xml:"d,attr"`
+	R int   `xml:"r,attr,omitempty"`
+}
+
+type DASHRepresentation struct {
+	ID                string `xml:"id,attr"`
+	Codecs            string `xml:"codecs,attr"`
+	Bandwidth         int    `xml:"bandwidth,attr"`
+	Width             int    `xml:"width,attr,omitempty"`
+	Height            int    `xml:"height,attr,omitempty"`
+	AudioSamplingRate int    `xml:"audioSamplingRate,attr,omitempty"`
+}
+
+// descriptor values
+const (
+	dashRoleScheme               = "urn:mpeg:dash:role:2011"
+	dashAudioChannelConfigScheme = "urn:mpeg:dash:23003:3:audio_channel_configuration:2011"
+)
+
+// a segment present on disk
+type dashSegment struct {
+	time     int64
+	duration int64
+	size     int
+}
+
+// build a segment timeline from consecutive segments
+func makeDASHTimeline(segments []dashSegment) []DASHSegmentElement {
+	var timeline []DASHSegmentElement
+
+	for _, segment := range segments {
+		if n := len(timeline); n > 0 {
+			last := &timeline[n-1]
+			if last.D == segment.duration && last.T+last.D*int64(last.R+1) == segment.time {
+				last.R++
+				continue
+			}
+		}
+
+		timeline = append(timeline, DASHSegmentElement{T: segment.time, D: segment.duration})
+	}
+
+	return timeline
+}
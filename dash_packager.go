@@ -0,0 +1,596 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Comcast/gots/packet"
+)
+
+// segment duration and number of segments kept available
+const (
+	dashSegmentDuration = 2 * time.Second
+	dashSegmentWindow   = 10
+)
+
+// timestamps moving further than this from the previous ones are a discontinuity of the source
+// (looping file, restarted tool), the media timeline is then continued from the last samples
+const dashMaxTimestampJump = 10 * MpegTimestampClock
+
+// duration of a video frame before two frames were seen (25 fps)
+const dashDefaultFrameDuration = MpegTimestampClock / 25
+
+// name of the manifest, same as the one written by external transcoders
+const DASHManifestName = "out.mpd"
+
+// one track of the packager
+type dashTrack struct {
+	name        string
+	contenttype string
+	mimetype    string
+	timescale   int
+	codec       string
+	language    string
+	width       int
+	height      int
+	samplerate  int
+	channels    int
+
+	initialized bool
+	sequence    uint32
+	// added to source timestamps (90kHz) after discontinuities so that media time keeps increasing,
+	// each track continues after its own last sample
+	shift int64
+	// samples of the segment being built
+	samples []MP4Sample
+	// segments available on disk
+	segments []dashSegment
+}
+
+// in process transcoder which only remuxes H.264/AAC TS to DVB-DASH and HLS (no re-encoding)
+type DashPackager struct {
+	mutex     sync.Mutex
+	outputdir string
+
+	demux      *MpegDemux
+	patparser  *MpegPIDPSIParser
+	pmtparser  *MpegPIDPSIParser
+	pmtpid     int
+	pmtversion int
+
+	videoparser *MpegPIDPESParser
+	audioparser *MpegPIDPESParser
+	videopid    int
+	audiopid    int
+
+	unwrapper MpegTimestampUnwrapper
+	// decode time of first video frame, origin of media timeline
+	base              int64
+	started           bool
+	availabilitystart time.Time
+	// media time of last video frame and expected time of next one
+	videoseen bool
+	videolast int64
+	videonext int64
+
+	sps    *H264SPS
+	spsnal []byte
+	ppsnal []byte
+
+	// partial ADTS frame of previous PES
+	audiopending []byte
+	// time of next audio frame in samples
+	audionext int64
+	audiosync bool
+
+	video dashTrack
+	audio dashTrack
+}
+
+func NewDashPackager() *DashPackager {
+	p := new(DashPackager)
+
+	return p
+}
+
+// start packaging in given directory, previous state is lost
+func (p *DashPackager) Start(outputdir string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if outputdir == "" {
+		outputdir = "."
+	}
+
+	err := os.MkdirAll(outputdir, 0755)
+	if err != nil {
+		log.Printf("cannot create working directory %s for packager\n%s", outputdir, err)
+	}
+
+	p.outputdir = outputdir
+	p.pmtpid = -1
+	p.pmtversion = -1
+	p.videopid = -1
+	p.audiopid = -1
+	p.pmtparser = nil
+	p.videoparser = nil
+	p.audioparser = nil
+	p.unwrapper = MpegTimestampUnwrapper{}
+	p.started = false
+	p.videoseen = false
+	p.sps = nil
+	p.spsnal = nil
+	p.ppsnal = nil
+	p.audiopending = nil
+	p.audiosync = false
+	p.video = dashTrack{name: "video", contenttype: "video", mimetype: "video/mp4", timescale: MpegTimestampClock}
+	p.audio = dashTrack{name: "audio", contenttype: "audio", mimetype: "audio/mp4"}
+
+	p.demux = NewMpegDemux()
+	p.patparser = NewMpegPIDPSIParser(MaxPSISectionSize, p.handlePAT)
+	p.demux.AddParser(PIDPAT, p.patparser)
+}
+
+func (p *DashPackager) ProcessPacket(pkt packet.Packet) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.demux != nil {
+		p.demux.ProcessPacket(pkt)
+	}
+}
+
+// stop packaging, files are kept until the directory is cleaned
+func (p *DashPackager) Stop() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.demux = nil
+
+	log.Printf("DASH packager in %s stopped\n", p.outputdir)
+}
+
+// follow the first program of the PAT
+func (p *DashPackager) handlePAT(section []byte) {
+	pat, err := ParsePAT(section)
+
+	if err != nil || !pat.Section.CurrentNext || len(pat.Programs) == 0 {
+		return
+	}
+
+	pmtpid := pat.Programs[0].PID
+
+	if pmtpid == p.pmtpid {
+		return
+	}
+
+	if p.pmtparser != nil {
+		p.demux.RemoveParser(p.pmtpid, p.pmtparser)
+	}
+
+	p.pmtpid = pmtpid
+	p.pmtversion = -1
+	p.pmtparser = NewMpegPIDPSIParser(MaxPSISectionSize, p.handlePMT)
+	p.demux.AddParser(pmtpid, p.pmtparser)
+}
+
+// select first H.264 video and first ADTS AAC audio
+func (p *DashPackager) handlePMT(section []byte) {
+	pmt, err := ParsePMT(section)
+
+	if err != nil || pmt.Version == p.pmtversion {
+		return
+	}
+
+	p.pmtversion = pmt.Version
+
+	videopid, audiopid := -1, -1
+	language := ""
+
+	for _, es := range pmt.Streams {
+		if es.StreamType == StreamTypeH264 && videopid < 0 {
+			videopid = es.PID
+		}
+
+		if es.StreamType == StreamTypeADTSAAC && audiopid < 0 {
+			audiopid = es.PID
+			if len(es.Languages) > 0 {
+				language = es.Languages[0]
+			}
+		}
+	}
+
+	if videopid < 0 {
+		log.Printf("DASH packager: program %d has no H.264 video, it needs to be transcoded\n", pmt.ProgramNumber)
+	}
+
+	if audiopid < 0 {
+		log.Printf("DASH packager: program %d has no AAC audio, video only\n", pmt.ProgramNumber)
+	}
+
+	if videopid != p.videopid {
+		if p.videoparser != nil {
+			p.demux.RemoveParser(p.videopid, p.videoparser)
+			p.videoparser = nil
+		}
+		p.videopid = videopid
+		if videopid >= 0 {
+			p.videoparser = NewMpegPIDPESParser(p.handleVideo)
+			p.demux.AddParser(videopid, p.videoparser)
+		}
+	}
+
+	if audiopid != p.audiopid {
+		if p.audioparser != nil {
+			p.demux.RemoveParser(p.audiopid, p.audioparser)
+			p.audioparser = nil
+		}
+		p.audiopid = audiopid
+		if audiopid >= 0 {
+			p.audioparser = NewMpegPIDPESParser(p.handleAudio)
+			p.demux.AddParser(audiopid, p.audioparser)
+		}
+	}
+
+	p.audio.language = language
+}
+
+// store SPS and PPS of the stream, the first ones are used for init segment
+func (p *DashPackager) storeParameterSet(nal []byte) {
+	switch nal[0] & 0x1F {
+	case H264NALSPS:
+		if p.sps == nil {
+			sps, err := ParseH264SPS(nal)
+			if err == nil {
+				p.sps = sps
+				p.spsnal = append([]byte(nil), nal...)
+			}
+		}
+	case H264NALPPS:
+		if p.ppsnal == nil {
+			p.ppsnal = append([]byte(nil), nal...)
+		}
+	}
+}
+
+// one PES is one access unit
+func (p *DashPackager) handleVideo(pes *MpegPES) {
+	if pes.PTS == MpegNoTimestamp {
+		return
+	}
+
+	var data []byte
+	randomaccess := false
+	firstslice := true
+
+	for _, nal := range SplitAnnexB(pes.Data) {
+		if len(nal) == 0 {
+			continue
+		}
+
+		switch nal[0] & 0x1F {
+		case H264NALSPS, H264NALPPS:
+			// parameter sets are in init segment
+			p.storeParameterSet(nal)
+			continue
+		case H264NALAUD:
+			continue
+		case H264NALIDR:
+			randomaccess = true
+		case H264NALSlice:
+			// some broadcasters only send I pictures without IDR
+			if firstslice {
+				randomaccess = randomaccess || H264IsIntraSlice(nal)
+				firstslice = false
+			}
+		}
+
+		data = be32(data, uint32(len(nal)))
+		data = append(data, nal...)
+	}
+
+	if len(data) == 0 {
+		return
+	}
+
+	dts := p.unwrapper.Unwrap(pes.DTS) + p.video.shift
+	offset := (pes.PTS - pes.DTS + mpegTimestampWrap) % mpegTimestampWrap
+
+	if !p.started {
+		// start on a random access point once decoder configuration is known
+		if !randomaccess || p.sps == nil || p.ppsnal == nil {
+			return
+		}
+
+		p.started = true
+		p.base = dts
+		p.availabilitystart = time.Now().UTC().Truncate(time.Second).Add(time.Second)
+
+		p.video.codec = p.sps.Codec()
+		p.video.width = p.sps.Width
+		p.video.height = p.sps.Height
+		p.writeInit(&p.video, MP4Track{Handler: "vide", Timescale: p.video.timescale, Width: p.sps.Width, Height: p.sps.Height,
+			SampleEntry: MP4AVCSampleEntry(p.sps.Width, p.sps.Height, H264DecoderConfiguration(p.sps, p.spsnal, p.ppsnal))})
+
+		log.Printf("DASH packager in %s started with %s %dx%d\n", p.outputdir, p.video.codec, p.video.width, p.video.height)
+	}
+
+	t := dts - p.base
+
+	// decode time of video always increases, the stream continues after last frame
+	if p.videoseen && (pes.Discontinuity || t <= p.videolast || t > p.videolast+dashMaxTimestampJump) {
+		t = p.rebase(&p.video, t, p.videonext)
+		p.videoseen = false
+	}
+
+	if t < 0 {
+		return
+	}
+
+	duration := int64(dashDefaultFrameDuration)
+	if p.videoseen {
+		duration = t - p.videolast
+	}
+
+	p.videoseen = true
+	p.videolast = t
+	p.videonext = t + duration
+
+	// segments start on random access points once long enough
+	if randomaccess && len(p.video.samples) > 0 && t-p.video.samples[0].DecodeTime >= int64(dashSegmentDuration.Seconds()*float64(p.video.timescale)) {
+		p.flush(&p.video, t)
+	}
+
+	// wait for a random access point after a flush
+	if len(p.video.samples) == 0 && !randomaccess {
+		return
+	}
+
+	p.video.samples = append(p.video.samples, MP4Sample{DecodeTime: t, CompositionOffset: int32(offset), Sync: randomaccess, Data: data})
+}
+
+// PES contains ADTS frames, a frame can continue in next PES
+func (p *DashPackager) handleAudio(pes *MpegPES) {
+	// audio starts with video
+	if !p.started {
+		p.audiopending = nil
+		return
+	}
+
+	continued := len(p.audiopending) > 0
+	config, frames, rest := ParseADTS(append(p.audiopending, pes.Data...))
+	p.audiopending = append([]byte(nil), rest...)
+
+	if len(frames) == 0 || config.SampleRate == 0 {
+		return
+	}
+
+	if !p.audio.initialized {
+		p.audio.timescale = config.SampleRate
+		p.audio.codec = config.Codec()
+		p.audio.samplerate = config.SampleRate
+		p.audio.channels = config.Channels
+		p.writeInit(&p.audio, MP4Track{Handler: "soun", Timescale: config.SampleRate, Language: p.audio.language, SampleEntry: MP4AACSampleEntry(config)})
+	}
+
+	// follow PTS only if drifting to keep exact frame durations
+	if !continued && pes.PTS != MpegNoTimestamp {
+		pts := p.unwrapper.Unwrap(pes.PTS) + p.audio.shift - p.base
+
+		// a jump of the clock continues the stream after the last frame
+		if p.audiosync {
+			next := p.audionext * MpegTimestampClock / int64(p.audio.timescale)
+
+			// going back more than a frame would overlap samples already written
+			frame := int64(AACFrameSamples) * MpegTimestampClock / int64(p.audio.timescale)
+
+			if pes.Discontinuity || pts < next-frame || pts > next+dashMaxTimestampJump {
+				pts = p.rebase(&p.audio, pts, next)
+			}
+		}
+
+		t := pts * int64(p.audio.timescale) / MpegTimestampClock
+
+		if !p.audiosync || t-p.audionext > AACFrameSamples || p.audionext-t > AACFrameSamples {
+			p.audionext = t
+			p.audiosync = true
+		}
+	}
+
+	if !p.audiosync {
+		return
+	}
+
+	for _, frame := range frames {
+		if p.audionext >= 0 {
+			if len(p.audio.samples) > 0 && p.audionext-p.audio.samples[0].DecodeTime >= int64(dashSegmentDuration.Seconds()*float64(p.audio.timescale)) {
+				p.flush(&p.audio, p.audionext)
+			}
+
+			p.audio.samples = append(p.audio.samples, MP4Sample{DecodeTime: p.audionext, Sync: true, Data: frame})
+		}
+
+		p.audionext += AACFrameSamples
+	}
+}
+
+// move source timestamps of a track after a discontinuity so that time t (90kHz media time) becomes target,
+// buffered samples are written as a segment, video then waits for its next random access point
+func (p *DashPackager) rebase(track *dashTrack, t int64, target int64) int64 {
+	log.Printf("DASH packager in %s: %s timestamp discontinuity of %.3fs, media timeline continued\n", p.outputdir, track.name, float64(t-target)/MpegTimestampClock)
+
+	track.shift += target - t
+
+	if len(track.samples) > 0 {
+		end := target
+		if track == &p.audio {
+			end = p.audionext
+		}
+		p.flush(track, end)
+	}
+
+	return target
+}
+
+// write a file so that readers never see it partially written
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+
+	err := ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func (track *dashTrack) initName() string {
+	return track.name + "_init.mp4"
+}
+
+func (track *dashTrack) mediaTemplate() string {
+	return track.name + "_$Time$.m4s"
+}
+
+func (track *dashTrack) segmentName(t int64) string {
+	return fmt.Sprintf("%s_%d.m4s", track.name, t)
+}
+
+func (p *DashPackager) writeInit(track *dashTrack, description MP4Track) {
+	err := writeFileAtomic(filepath.Join(p.outputdir, track.initName()), MP4InitSegment(description))
+
+	if err != nil {
+		log.Printf("DASH packager cannot write init segment: %s\n", err)
+	}
+
+	track.initialized = true
+}
+
+// write buffered samples as a segment ending at given time
+func (p *DashPackager) flush(track *dashTrack, end int64) {
+	samples := track.samples
+	track.samples = nil
+
+	for i := range samples {
+		next := end
+		if i+1 < len(samples) {
+			next = samples[i+1].DecodeTime
+		}
+
+		if next > samples[i].DecodeTime {
+			samples[i].Duration = uint32(next - samples[i].DecodeTime)
+		}
+	}
+
+	track.sequence++
+	segment := MP4MediaSegment(track.sequence, samples)
+	start := samples[0].DecodeTime
+
+	err := writeFileAtomic(filepath.Join(p.outputdir, track.segmentName(start)), segment)
+
+	if err != nil {
+		log.Printf("DASH packager cannot write segment: %s\n", err)
+		return
+	}
+
+	track.segments = append(track.segments, dashSegment{time: start, duration: end - start, size: len(segment)})
+
+	// remove segments which are out of time shift buffer
+	for len(track.segments) > dashSegmentWindow {
+		os.Remove(filepath.Join(p.outputdir, track.segmentName(track.segments[0].time)))
+		track.segments = track.segments[1:]
+	}
+
+	p.writeManifest()
+	p.writePlaylists()
+}
+
+// average bitrate of available segments
+func (track *dashTrack) bandwidth() int {
+	var size, duration int64
+
+	for _, segment := range track.segments {
+		size += int64(segment.size)
+		duration += segment.duration
+	}
+
+	if duration == 0 {
+		return 0
+	}
+
+	return int(size * 8 * int64(track.timescale) / duration)
+}
+
+func (track *dashTrack) adaptationSet() DASHAdaptationSet {
+	var as DASHAdaptationSet
+
+	as.ContentType = track.contenttype
+	as.MimeType = track.mimetype
+	as.Lang = track.language
+	as.SegmentAlignment = true
+	as.StartWithSAP = 1
+	as.Role = &DASHDescriptor{SchemeIDURI: dashRoleScheme, Value: "main"}
+
+	if track.channels != 0 {
+		as.AudioChannelConfiguration = &DASHDescriptor{SchemeIDURI: dashAudioChannelConfigScheme, Value: fmt.Sprintf("%d", track.channels)}
+	}
+
+	as.SegmentTemplate.Timescale = track.timescale
+	as.SegmentTemplate.Initialization = track.initName()
+	as.SegmentTemplate.Media = track.mediaTemplate()
+	as.SegmentTemplate.Timeline = makeDASHTimeline(track.segments)
+
+	as.Representations = []DASHRepresentation{{
+		ID:                track.name,
+		Codecs:            track.codec,
+		Bandwidth:         track.bandwidth(),
+		Width:             track.width,
+		Height:            track.height,
+		AudioSamplingRate: track.samplerate,
+	}}
+
+	return as
+}
+
+// write live manifest describing available segments
+func (p *DashPackager) writeManifest() {
+	if len(p.video.segments) == 0 {
+		return
+	}
+
+	mpd := DASHMPD{
+		Xmlns:                      DASHNamespace,
+		Profiles:                   DASHDVBProfiles,
+		Type:                       "dynamic",
+		AvailabilityStartTime:      p.availabilitystart.Format("2006-01-02T15:04:05Z"),
+		PublishTime:                time.Now().UTC().Format("2006-01-02T15:04:05Z"),
+		MinimumUpdatePeriod:        formatISODuration(dashSegmentDuration),
+		MinBufferTime:              formatISODuration(2 * dashSegmentDuration),
+		TimeShiftBufferDepth:       formatISODuration(dashSegmentWindow * dashSegmentDuration),
+		SuggestedPresentationDelay: formatISODuration(3 * dashSegmentDuration),
+		MaxSegmentDuration:         formatISODuration(2 * dashSegmentDuration),
+	}
+
+	mpd.Period.ID = "0"
+	mpd.Period.Start = "PT0S"
+	mpd.Period.AdaptationSets = append(mpd.Period.AdaptationSets, p.video.adaptationSet())
+
+	if len(p.audio.segments) > 0 {
+		mpd.Period.AdaptationSets = append(mpd.Period.AdaptationSets, p.audio.adaptationSet())
+	}
+
+	out, err := MarshalXMLDocument(mpd)
+
+	if err == nil {
+		err = writeFileAtomic(filepath.Join(p.outputdir, DASHManifestName), out)
+	}
+
+	if err != nil {
+		log.Printf("DASH packager cannot write manifest: %s\n", err)
+	}
+}
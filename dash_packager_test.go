@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+)
+
+// media timeline of video continues over timestamp jumps of the source
+func TestDashPackagerDiscontinuity(t *testing.T) {
+	p := NewDashPackager()
+	p.Start(t.TempDir())
+
+	sps := []byte{0x67, 0x42, 0xC0, 0x1F, 0xEC, 0xA0, 0x28, 0x02, 0xDC, 0x80}
+	pps := []byte{0x68, 0xCE, 0x3C, 0x80}
+	startcode := []byte{0, 0, 0, 1}
+
+	// one second GOPs of 25 frames starting at given DTS
+	feed := func(dts int64, frames int, discontinuity bool) {
+		for i := 0; i < frames; i++ {
+			var data []byte
+			if i%25 == 0 {
+				data = append(data, startcode...)
+				data = append(data, sps...)
+				data = append(data, startcode...)
+				data = append(data, pps...)
+				data = append(data, startcode...)
+				data = append(data, H264NALIDR|0x60, 0x88, 0x84)
+			} else {
+				data = append(data, startcode...)
+				data = append(data, H264NALSlice|0x40, 0x9A, 0x02)
+			}
+
+			ts := (dts + int64(i)*3600) % mpegTimestampWrap
+			p.handleVideo(&MpegPES{PTS: ts, DTS: ts, Discontinuity: discontinuity && i == 0, Data: data})
+		}
+	}
+
+	feed(900000, 100, false)
+	// source restarts its clock
+	feed(90000, 100, false)
+	// clock jumps one hour forward
+	feed(900000+3600*MpegTimestampClock, 100, false)
+	// small jump signalled by discontinuity indicator
+	feed(900000+3600*MpegTimestampClock+100*3600+7200, 100, true)
+
+	segments := p.video.segments
+	if len(segments) < 5 {
+		t.Fatalf("got %d video segments, want at least 5", len(segments))
+	}
+
+	if segments[0].time != 0 {
+		t.Errorf("first segment starts at %d, want 0", segments[0].time)
+	}
+
+	for i := 1; i < len(segments); i++ {
+		if end := segments[i-1].time + segments[i-1].duration; segments[i].time != end {
+			t.Errorf("segment %d starts at %d, previous one ends at %d", i, segments[i].time, end)
+		}
+	}
+
+	// all frames fed are on the timeline without gap
+	last := segments[len(segments)-1]
+	if end, want := last.time+last.duration+int64(len(p.video.samples))*3600, int64(400*3600); end != want {
+		t.Errorf("timeline ends at %d, want %d", end, want)
+	}
+}
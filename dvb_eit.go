@@ -0,0 +1,222 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// descriptor tags used in EIT
+const (
+	DescriptorShortEvent     = 0x4D
+	DescriptorExtendedEvent  = 0x4E
+	DescriptorContent        = 0x54
+	DescriptorParentalRating = 0x55
+)
+
+// text of an event in one language
+type EpgText struct {
+	Language         string
+	Title            string
+	Synopsis         string
+	ExtendedSynopsis string
+}
+
+// genre from content descriptor
+type EpgGenre struct {
+	Level1 int
+	Level2 int
+	User   int
+}
+
+// minimum age for one country, from parental rating descriptor
+type EpgParentalRating struct {
+	Country    string
+	MinimumAge int
+}
+
+// an event described in EIT
+type EpgEvent struct {
+	EventID         int
+	Start           time.Time
+	Duration        time.Duration
+	RunningStatus   int
+	FreeCAMode      bool
+	Texts           []EpgText
+	Genres          []EpgGenre
+	ParentalRatings []EpgParentalRating
+}
+
+// content of one EIT section
+type DvbEIT struct {
+	TableID           int
+	ServiceID         int
+	TransportStreamID int
+	OriginalNetworkID int
+	Events            []EpgEvent
+	Section           *MpegLongSection
+}
+
+// true for EIT present/following tables
+func (eit *DvbEIT) IsPresentFollowing() bool {
+	return eit.TableID == TableIDEITPFActual || eit.TableID == TableIDEITPFOther
+}
+
+// true for tables describing the tuned transport stream
+func (eit *DvbEIT) IsActual() bool {
+	return eit.TableID == TableIDEITPFActual || (eit.TableID >= TableIDEITScheduleFirst && eit.TableID <= TableIDEITScheduleFirst+0x0F)
+}
+
+// decode an EIT p/f or schedule section
+func ParseEIT(section []byte) (*DvbEIT, error) {
+	s, err := ParseMpegLongSection(section)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if s.TableID != TableIDEITPFActual && s.TableID != TableIDEITPFOther && (s.TableID < TableIDEITScheduleFirst || s.TableID > TableIDEITScheduleLast) {
+		return nil, ErrWrongTableID
+	}
+
+	if len(s.Payload) < 6 {
+		return nil, ErrSectionTooShort
+	}
+
+	eit := new(DvbEIT)
+	eit.TableID = s.TableID
+	eit.ServiceID = s.TableIDExtension
+	eit.TransportStreamID = int(s.Payload[0])<<8 | int(s.Payload[1])
+	eit.OriginalNetworkID = int(s.Payload[2])<<8 | int(s.Payload[3])
+	eit.Section = s
+
+	data := s.Payload[6:]
+
+	for len(data) >= 12 {
+		var event EpgEvent
+		var descriptors []byte
+
+		event.EventID = int(data[0])<<8 | int(data[1])
+		event.Start = decodeDVBTime(data[2:7])
+		event.Duration = decodeDVBDuration(data[7:10])
+		event.RunningStatus = int(data[10] >> 5)
+		event.FreeCAMode = data[10]&0x10 != 0
+
+		descriptors, data, err = splitMpegLoop(data[10:])
+
+		if err != nil {
+			return nil, err
+		}
+
+		event.decodeDescriptors(ParseMpegDescriptors(descriptors))
+
+		eit.Events = append(eit.Events, event)
+	}
+
+	return eit, nil
+}
+
+// decode a 2 digit BCD value
+func decodeBCD(b byte) int {
+	return int(b>>4)*10 + int(b&0x0F)
+}
+
+// decode a 40 bits MJD + BCD UTC time, undefined time gives zero time
+func decodeDVBTime(data []byte) time.Time {
+	if data[0] == 0xFF && data[1] == 0xFF && data[2] == 0xFF && data[3] == 0xFF && data[4] == 0xFF {
+		return time.Time{}
+	}
+
+	mjd := int(data[0])<<8 | int(data[1])
+
+	return time.Date(1858, time.November, 17, decodeBCD(data[2]), decodeBCD(data[3]), decodeBCD(data[4]), 0, time.UTC).AddDate(0, 0, mjd)
+}
+
+// decode a 24 bits BCD duration
+func decodeDVBDuration(data []byte) time.Duration {
+	return time.Duration(decodeBCD(data[0]))*time.Hour + time.Duration(decodeBCD(data[1]))*time.Minute + time.Duration(decodeBCD(data[2]))*time.Second
+}
+
+// get text entry of a language, create it if needed
+func (event *EpgEvent) text(language string) *EpgText {
+	for i := range event.Texts {
+		if event.Texts[i].Language == language {
+			return &event.Texts[i]
+		}
+	}
+
+	event.Texts = append(event.Texts, EpgText{Language: language})
+	return &event.Texts[len(event.Texts)-1]
+}
+
+// fill texts, genres and ratings from event descriptors
+func (event *EpgEvent) decodeDescriptors(descriptors []MpegDescriptor) {
+	for _, d := range descriptors {
+		switch d.Tag {
+		case DescriptorShortEvent:
+			if len(d.Data) < 4 {
+				continue
+			}
+			text := event.text(decodeLanguage(d.Data[0:3]))
+			namelength := int(d.Data[3])
+			if 4+namelength+1 > len(d.Data) {
+				continue
+			}
+			text.Title = DecodeDVBText(d.Data[4 : 4+namelength])
+			rest := d.Data[4+namelength:]
+			textlength := int(rest[0])
+			if 1+textlength <= len(rest) {
+				text.Synopsis = DecodeDVBText(rest[1 : 1+textlength])
+			}
+
+		case DescriptorExtendedEvent:
+			if len(d.Data) < 5 {
+				continue
+			}
+			text := event.text(decodeLanguage(d.Data[1:4]))
+			itemslength := int(d.Data[4])
+			if 5+itemslength+1 > len(d.Data) {
+				continue
+			}
+			// items are skipped, only free text is kept
+			rest := d.Data[5+itemslength:]
+			textlength := int(rest[0])
+			if 1+textlength <= len(rest) {
+				text.ExtendedSynopsis += DecodeDVBText(rest[1 : 1+textlength])
+			}
+
+		case DescriptorContent:
+			for data := d.Data; len(data) >= 2; data = data[2:] {
+				event.Genres = append(event.Genres, EpgGenre{Level1: int(data[0] >> 4), Level2: int(data[0] & 0x0F), User: int(data[1])})
+			}
+
+		case DescriptorParentalRating:
+			for data := d.Data; len(data) >= 4; data = data[4:] {
+				// only values 0x01 to 0x0F are defined as age, others are broadcaster specific
+				if data[3] >= 0x01 && data[3] <= 0x0F {
+					event.ParentalRatings = append(event.ParentalRatings, EpgParentalRating{Country: string(data[0:3]), MinimumAge: int(data[3]) + 3})
+				}
+			}
+		}
+	}
+}
+
+// decode an ISO 639 language code
+func decodeLanguage(data []byte) string {
+	return strings.ToLower(string(data))
+}
+
+// end time of the event
+func (event *EpgEvent) End() time.Time {
+	return event.Start.Add(event.Duration)
+}
+
+// title in the first language available
+func (event *EpgEvent) Title() string {
+	for _, text := range event.Texts {
+		if text.Title != "" {
+			return text.Title
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,128 @@
+package main
+
+// descriptor tags used in NIT
+const (
+	DescriptorNetworkName    = 0x40
+	DescriptorServiceList    = 0x41
+	DescriptorLogicalChannel = 0x83
+)
+
+// a service listed in a NIT transport stream loop
+type DvbNITService struct {
+	ServiceID   int
+	ServiceType int
+	// logical channel number, 0 if none is given
+	LCN     int
+	Visible bool
+}
+
+// one transport stream of the NIT
+type DvbNITTransportStream struct {
+	TransportStreamID int
+	OriginalNetworkID int
+	Descriptors       []MpegDescriptor
+	Services          []DvbNITService
+}
+
+// content of one NIT section
+type DvbNIT struct {
+	Actual           bool
+	NetworkID        int
+	NetworkName      string
+	Descriptors      []MpegDescriptor
+	TransportStreams []DvbNITTransportStream
+	Section          *MpegLongSection
+}
+
+// decode a NIT actual or other section
+func ParseNIT(section []byte) (*DvbNIT, error) {
+	s, err := ParseMpegLongSection(section)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if s.TableID != TableIDNITActual && s.TableID != TableIDNITOther {
+		return nil, ErrWrongTableID
+	}
+
+	nit := new(DvbNIT)
+	nit.Actual = s.TableID == TableIDNITActual
+	nit.NetworkID = s.TableIDExtension
+	nit.Section = s
+
+	networkdescriptors, data, err := splitMpegLoop(s.Payload)
+
+	if err != nil {
+		return nil, err
+	}
+
+	nit.Descriptors = ParseMpegDescriptors(networkdescriptors)
+
+	for _, d := range nit.Descriptors {
+		if d.Tag == DescriptorNetworkName {
+			nit.NetworkName = DecodeDVBText(d.Data)
+		}
+	}
+
+	tsloop, _, err := splitMpegLoop(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for len(tsloop) >= 6 {
+		var ts DvbNITTransportStream
+		var descriptors []byte
+
+		ts.TransportStreamID = int(tsloop[0])<<8 | int(tsloop[1])
+		ts.OriginalNetworkID = int(tsloop[2])<<8 | int(tsloop[3])
+
+		descriptors, tsloop, err = splitMpegLoop(tsloop[4:])
+
+		if err != nil {
+			return nil, err
+		}
+
+		ts.Descriptors = ParseMpegDescriptors(descriptors)
+		ts.Services = parseNITServices(ts.Descriptors)
+
+		nit.TransportStreams = append(nit.TransportStreams, ts)
+	}
+
+	return nit, nil
+}
+
+// merge service list and logical channel descriptors of a transport stream
+func parseNITServices(descriptors []MpegDescriptor) []DvbNITService {
+	services := []DvbNITService{}
+	index := make(map[int]int)
+
+	// find or create service entry
+	get := func(sid int) *DvbNITService {
+		i, found := index[sid]
+		if !found {
+			i = len(services)
+			index[sid] = i
+			services = append(services, DvbNITService{ServiceID: sid, Visible: true})
+		}
+		return &services[i]
+	}
+
+	for _, d := range descriptors {
+		switch d.Tag {
+		case DescriptorServiceList:
+			for data := d.Data; len(data) >= 3; data = data[3:] {
+				get(int(data[0])<<8 | int(data[1])).ServiceType = int(data[2])
+			}
+		case DescriptorLogicalChannel:
+			for data := d.Data; len(data) >= 4; data = data[4:] {
+				svc := get(int(data[0])<<8 | int(data[1]))
+				svc.Visible = data[2]&0x80 != 0
+				svc.LCN = int(data[2]&0x03)<<8 | int(data[3])
+			}
+		}
+	}
+
+	return services
+}
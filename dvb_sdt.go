@@ -0,0 +1,141 @@
+package main
+
+// descriptor tags used in SDT
+const (
+	DescriptorService = 0x48
+)
+
+// service types from ETSI EN 300 468 which are shown as channels
+var dvbTelevisionServiceTypes = map[int]bool{
+	0x01: true, // digital television
+	0x11: true, // MPEG-2 HD television
+	0x16: true, // H.264 SD television
+	0x19: true, // H.264 HD television
+	0x1F: true, // HEVC television
+	0x20: true, // HEVC UHD television
+}
+
+var dvbRadioServiceTypes = map[int]bool{
+	0x02: true, // digital radio
+	0x0A: true, // advanced codec radio
+}
+
+// running status values
+const (
+	RunningStatusUndefined  = 0
+	RunningStatusNotRunning = 1
+	RunningStatusStartsSoon = 2
+	RunningStatusPausing    = 3
+	RunningStatusRunning    = 4
+	RunningStatusOffAir     = 5
+)
+
+// one service described in SDT
+type DvbSDTService struct {
+	ServiceID           int
+	EITSchedule         bool
+	EITPresentFollowing bool
+	RunningStatus       int
+	FreeCAMode          bool
+	ServiceType         int
+	ProviderName        string
+	Name                string
+	Descriptors         []MpegDescriptor
+}
+
+// content of one SDT section
+type DvbSDT struct {
+	Actual            bool
+	TransportStreamID int
+	OriginalNetworkID int
+	Services          []DvbSDTService
+	Section           *MpegLongSection
+}
+
+// decode a SDT actual or other section
+func ParseSDT(section []byte) (*DvbSDT, error) {
+	s, err := ParseMpegLongSection(section)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if s.TableID != TableIDSDTActual && s.TableID != TableIDSDTOther {
+		return nil, ErrWrongTableID
+	}
+
+	if len(s.Payload) < 3 {
+		return nil, ErrSectionTooShort
+	}
+
+	sdt := new(DvbSDT)
+	sdt.Actual = s.TableID == TableIDSDTActual
+	sdt.TransportStreamID = s.TableIDExtension
+	sdt.OriginalNetworkID = int(s.Payload[0])<<8 | int(s.Payload[1])
+	sdt.Section = s
+
+	data := s.Payload[3:]
+
+	for len(data) >= 5 {
+		var svc DvbSDTService
+		var descriptors []byte
+
+		svc.ServiceID = int(data[0])<<8 | int(data[1])
+		svc.EITSchedule = data[2]&0x02 != 0
+		svc.EITPresentFollowing = data[2]&0x01 != 0
+		svc.RunningStatus = int(data[3] >> 5)
+		svc.FreeCAMode = data[3]&0x10 != 0
+
+		descriptors, data, err = splitMpegLoop(data[3:])
+
+		if err != nil {
+			return nil, err
+		}
+
+		svc.Descriptors = ParseMpegDescriptors(descriptors)
+
+		for _, d := range svc.Descriptors {
+			if d.Tag == DescriptorService {
+				svc.ServiceType, svc.ProviderName, svc.Name = parseServiceDescriptor(d.Data)
+			}
+		}
+
+		sdt.Services = append(sdt.Services, svc)
+	}
+
+	return sdt, nil
+}
+
+// decode service_descriptor: service type, provider name and service name
+func parseServiceDescriptor(data []byte) (int, string, string) {
+	if len(data) < 2 {
+		return 0, "", ""
+	}
+
+	servicetype := int(data[0])
+	providerlength := int(data[1])
+
+	if 2+providerlength+1 > len(data) {
+		return servicetype, "", ""
+	}
+
+	provider := DecodeDVBText(data[2 : 2+providerlength])
+	data = data[2+providerlength:]
+	namelength := int(data[0])
+
+	if 1+namelength > len(data) {
+		return servicetype, provider, ""
+	}
+
+	return servicetype, provider, DecodeDVBText(data[1 : 1+namelength])
+}
+
+// true for television services
+func IsTelevisionService(servicetype int) bool {
+	return dvbTelevisionServiceTypes[servicetype]
+}
+
+// true for radio services
+func IsRadioService(servicetype int) bool {
+	return dvbRadioServiceTypes[servicetype]
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// identify a DVB service in the whole network
+type DvbServiceKey struct {
+	OriginalNetworkID int
+	TransportStreamID int
+	ServiceID         int
+}
+
+// a DVB service as described by SDT and NIT
+type DvbService struct {
+	DvbServiceKey
+	Name                string
+	Provider            string
+	ServiceType         int
+	RunningStatus       int
+	FreeCAMode          bool
+	EITSchedule         bool
+	EITPresentFollowing bool
+	// logical channel number from NIT, 0 if none
+	LCN     int
+	Visible bool
+}
+
+// identify one sub table of SDT or NIT
+type dvbSubTableKey struct {
+	TableID           int
+	TableIDExtension  int
+	OriginalNetworkID int
+}
+
+// follow SDT actual/other and NIT actual to name services and get their LCN
+type DvbServiceTracker struct {
+	mutex sync.Mutex
+	demux *MpegDemux
+
+	sdtparser *MpegPIDPSIParser
+	nitparser *MpegPIDPSIParser
+
+	// section collection by sub table
+	sections map[dvbSubTableKey]*MpegSectionSet
+	// services of sub tables being collected
+	sdtpending map[dvbSubTableKey][]DvbSDTService
+	nitpending map[dvbSubTableKey][]DvbNITTransportStream
+
+	// complete tables
+	services map[DvbServiceKey]*DvbService
+	lcns     map[DvbServiceKey]DvbNITService
+
+	// actual transport stream and network
+	actual      DvbServiceKey
+	networkid   int
+	networkname string
+
+	// closed when SDT actual or NIT actual is complete
+	sdtcomplete chan struct{}
+	nitcomplete chan struct{}
+}
+
+// create a tracker and register its parsers on a demux
+func NewDvbServiceTracker(demux *MpegDemux) *DvbServiceTracker {
+	st := new(DvbServiceTracker)
+	st.demux = demux
+	st.Reset()
+
+	return st
+}
+
+// forget everything and restart acquisition (to call after a new tune)
+func (st *DvbServiceTracker) Reset() {
+	st.Detach()
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	st.sections = make(map[dvbSubTableKey]*MpegSectionSet)
+	st.sdtpending = make(map[dvbSubTableKey][]DvbSDTService)
+	st.nitpending = make(map[dvbSubTableKey][]DvbNITTransportStream)
+	st.services = make(map[DvbServiceKey]*DvbService)
+	st.lcns = make(map[DvbServiceKey]DvbNITService)
+	st.actual = DvbServiceKey{-1, -1, -1}
+	st.networkid = -1
+	st.networkname = ""
+	st.sdtcomplete = make(chan struct{})
+	st.nitcomplete = make(chan struct{})
+
+	st.sdtparser = NewMpegPIDPSIParser(MaxSISectionSize, st.handleSDT)
+	st.nitparser = NewMpegPIDPSIParser(MaxSISectionSize, st.handleNIT)
+	st.demux.AddParser(PIDSDT, st.sdtparser)
+	st.demux.AddParser(PIDNIT, st.nitparser)
+}
+
+// unregister parsers from the demux
+func (st *DvbServiceTracker) Detach() {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if st.sdtparser != nil {
+		st.demux.RemoveParser(PIDSDT, st.sdtparser)
+		st.sdtparser = nil
+	}
+
+	if st.nitparser != nil {
+		st.demux.RemoveParser(PIDNIT, st.nitparser)
+		st.nitparser = nil
+	}
+}
+
+// record a section of a sub table, return false if it is already known (lock must be held)
+func (st *DvbServiceTracker) addSection(key dvbSubTableKey, s *MpegLongSection) bool {
+	set, found := st.sections[key]
+
+	if !found {
+		set = NewMpegSectionSet()
+		st.sections[key] = set
+	}
+
+	// a new version restarts collection
+	if set.Version() != s.Version {
+		delete(st.sdtpending, key)
+		delete(st.nitpending, key)
+	}
+
+	return set.Add(s)
+}
+
+func (st *DvbServiceTracker) handleSDT(section []byte) {
+	sdt, err := ParseSDT(section)
+
+	if err != nil || !sdt.Section.CurrentNext {
+		return
+	}
+
+	key := dvbSubTableKey{sdt.Section.TableID, sdt.TransportStreamID, sdt.OriginalNetworkID}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if !st.addSection(key, sdt.Section) {
+		return
+	}
+
+	st.sdtpending[key] = append(st.sdtpending[key], sdt.Services...)
+
+	if !st.sections[key].Complete() {
+		return
+	}
+
+	// replace services of this transport stream
+	for k := range st.services {
+		if k.OriginalNetworkID == sdt.OriginalNetworkID && k.TransportStreamID == sdt.TransportStreamID {
+			delete(st.services, k)
+		}
+	}
+
+	for _, svc := range st.sdtpending[key] {
+		service := new(DvbService)
+		service.DvbServiceKey = DvbServiceKey{sdt.OriginalNetworkID, sdt.TransportStreamID, svc.ServiceID}
+		service.Name = svc.Name
+		service.Provider = svc.ProviderName
+		service.ServiceType = svc.ServiceType
+		service.RunningStatus = svc.RunningStatus
+		service.FreeCAMode = svc.FreeCAMode
+		service.EITSchedule = svc.EITSchedule
+		service.EITPresentFollowing = svc.EITPresentFollowing
+		st.services[service.DvbServiceKey] = service
+	}
+
+	delete(st.sdtpending, key)
+
+	if sdt.Actual {
+		st.actual = DvbServiceKey{sdt.OriginalNetworkID, sdt.TransportStreamID, -1}
+		closeOnce(st.sdtcomplete)
+	}
+}
+
+func (st *DvbServiceTracker) handleNIT(section []byte) {
+	nit, err := ParseNIT(section)
+
+	// only NIT actual gives LCN of our network
+	if err != nil || !nit.Actual || !nit.Section.CurrentNext {
+		return
+	}
+
+	key := dvbSubTableKey{nit.Section.TableID, nit.NetworkID, 0}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if !st.addSection(key, nit.Section) {
+		return
+	}
+
+	st.nitpending[key] = append(st.nitpending[key], nit.TransportStreams...)
+
+	if nit.NetworkName != "" {
+		st.networkname = nit.NetworkName
+	}
+
+	if !st.sections[key].Complete() {
+		return
+	}
+
+	st.networkid = nit.NetworkID
+	st.lcns = make(map[DvbServiceKey]DvbNITService)
+
+	for _, ts := range st.nitpending[key] {
+		for _, svc := range ts.Services {
+			st.lcns[DvbServiceKey{ts.OriginalNetworkID, ts.TransportStreamID, svc.ServiceID}] = svc
+		}
+	}
+
+	delete(st.nitpending, key)
+	closeOnce(st.nitcomplete)
+}
+
+// close a signaling channel if not already closed (lock must be held)
+func closeOnce(c chan struct{}) {
+	select {
+	case <-c:
+	default:
+		close(c)
+	}
+}
+
+// wait on a signaling channel with a time out
+func waitSignal(c chan struct{}, timeout time.Duration) bool {
+	select {
+	case <-c:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// wait for SDT actual, return false on timeout
+func (st *DvbServiceTracker) WaitSDT(timeout time.Duration) bool {
+	st.mutex.Lock()
+	c := st.sdtcomplete
+	st.mutex.Unlock()
+
+	return waitSignal(c, timeout)
+}
+
+// wait for NIT actual, return false on timeout
+func (st *DvbServiceTracker) WaitNIT(timeout time.Duration) bool {
+	st.mutex.Lock()
+	c := st.nitcomplete
+	st.mutex.Unlock()
+
+	return waitSignal(c, timeout)
+}
+
+// original network id and transport stream id of the tuned stream (-1 if unknown)
+func (st *DvbServiceTracker) GetActualTransportStream() (int, int) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	return st.actual.OriginalNetworkID, st.actual.TransportStreamID
+}
+
+// network id and name from NIT actual (-1 if unknown)
+func (st *DvbServiceTracker) GetNetwork() (int, string) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	return st.networkid, st.networkname
+}
+
+// get a copy of a service with its LCN
+func (st *DvbServiceTracker) makeService(service *DvbService) DvbService {
+	result := *service
+	result.Visible = true
+
+	if lcn, found := st.lcns[service.DvbServiceKey]; found {
+		result.LCN = lcn.LCN
+		result.Visible = lcn.Visible
+	}
+
+	return result
+}
+
+// get all known services (actual and other) sorted by network, stream and service id
+func (st *DvbServiceTracker) GetServices() []DvbService {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	services := make([]DvbService, 0, len(st.services))
+
+	for _, service := range st.services {
+		services = append(services, st.makeService(service))
+	}
+
+	sort.Slice(services, func(i, j int) bool {
+		a, b := services[i], services[j]
+		if a.OriginalNetworkID != b.OriginalNetworkID {
+			return a.OriginalNetworkID < b.OriginalNetworkID
+		}
+		if a.TransportStreamID != b.TransportStreamID {
+			return a.TransportStreamID < b.TransportStreamID
+		}
+		return a.ServiceID < b.ServiceID
+	})
+
+	return services
+}
+
+// find a service of the actual transport stream by service id
+func (st *DvbServiceTracker) GetActualService(sid int) (DvbService, bool) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	key := st.actual
+	key.ServiceID = sid
+
+	service, found := st.services[key]
+
+	if !found {
+		return DvbService{}, false
+	}
+
+	return st.makeService(service), true
+}
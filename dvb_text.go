@@ -0,0 +1,154 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf16"
+)
+
+// combining marks selected by ISO/IEC 6937 non spacing diacritical characters 0xC1-0xCF
+var iso6937Diacritics = map[byte]rune{
+	0xC1: 0x0300, // grave
+	0xC2: 0x0301, // acute
+	0xC3: 0x0302, // circumflex
+	0xC4: 0x0303, // tilde
+	0xC5: 0x0304, // macron
+	0xC6: 0x0306, // breve
+	0xC7: 0x0307, // dot above
+	0xC8: 0x0308, // diaeresis
+	0xCA: 0x030A, // ring above
+	0xCB: 0x0327, // cedilla
+	0xCD: 0x030B, // double acute
+	0xCE: 0x0328, // ogonek
+	0xCF: 0x030C, // caron
+}
+
+// spacing characters of ISO/IEC 6937 upper half which differ from latin 1
+var iso6937Characters = map[byte]rune{
+	0xA4: '$', 0xA6: '#', 0xA8: '¤', 0xA9: '‘', 0xAA: '“', 0xAC: '←', 0xAD: '↑', 0xAE: '→', 0xAF: '↓',
+	0xB4: '×', 0xB8: '÷', 0xB9: '’', 0xBA: '”',
+	0xD0: '―', 0xD1: '¹', 0xD2: '®', 0xD3: '©', 0xD4: '™', 0xD5: '♪', 0xD6: '¬', 0xD7: '¦',
+	0xDC: '⅛', 0xDD: '⅜', 0xDE: '⅝', 0xDF: '⅞',
+	0xE0: 'Ω', 0xE1: 'Æ', 0xE2: 'Đ', 0xE3: 'ª', 0xE4: 'Ħ', 0xE6: 'Ĳ', 0xE7: 'Ŀ', 0xE8: 'Ł', 0xE9: 'Ø',
+	0xEA: 'Œ', 0xEB: 'º', 0xEC: 'Þ', 0xED: 'Ŧ', 0xEE: 'Ŋ', 0xEF: 'ŉ',
+	0xF0: 'ĸ', 0xF1: 'æ', 0xF2: 'đ', 0xF3: 'ð', 0xF4: 'ħ', 0xF5: 'ı', 0xF6: 'ĳ', 0xF7: 'ŀ', 0xF8: 'ł',
+	0xF9: 'ø', 0xFA: 'œ', 0xFB: 'ß', 0xFC: 'þ', 0xFD: 'ŧ', 0xFE: 'ŋ', 0xFF: '\u00AD',
+}
+
+// control codes of single byte tables (ETSI EN 300 468 annex A.1)
+const (
+	dvbTextEmphasisOn  = 0x86
+	dvbTextEmphasisOff = 0x87
+	dvbTextNewLine     = 0x8A
+)
+
+// decode a DVB SI text field (ETSI EN 300 468 annex A) into an UTF-8 string
+func DecodeDVBText(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+
+	// first byte selects character table, default (nil) is ISO/IEC 6937
+	var table *[96]rune
+
+	switch {
+	case data[0] >= 0x20:
+	case data[0] == 0x10:
+		// ISO/IEC 8859 part given by next two bytes
+		if len(data) < 3 {
+			return ""
+		}
+		table = iso8859Table(int(data[1])<<8 | int(data[2]))
+		data = data[3:]
+	case data[0] == 0x11:
+		return decodeDVBTextUCS2(data[1:])
+	case data[0] == 0x15:
+		return strings.TrimSpace(strings.Map(func(r rune) rune {
+			if r >= 0x80 && r <= 0x9F {
+				if r == dvbTextNewLine {
+					return '\n'
+				}
+				return -1
+			}
+			return r
+		}, string(data[1:])))
+	case data[0] == 0x1F:
+		// encoding_type_id not supported, skip it
+		if len(data) < 2 {
+			return ""
+		}
+		data = data[2:]
+	case data[0] <= 0x0B:
+		// ISO/IEC 8859 parts 5 to 15
+		table = iso8859Table(int(data[0]) + 4)
+		data = data[1:]
+	default:
+		// reserved or multi byte tables are not supported, latin part is common to all of them
+		table = iso8859Table(1)
+		data = data[1:]
+	}
+
+	var result strings.Builder
+
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+
+		switch {
+		case b == dvbTextNewLine:
+			result.WriteRune('\n')
+		case b == dvbTextEmphasisOn || b == dvbTextEmphasisOff:
+		case b < 0x20 || (b >= 0x80 && b <= 0x9F):
+			// other control codes are ignored
+		case b < 0x80:
+			result.WriteByte(b)
+		case table == nil:
+			if mark, found := iso6937Diacritics[b]; found {
+				// diacritic applies to the next character
+				if i+1 < len(data) {
+					i++
+					result.WriteByte(data[i])
+					result.WriteRune(mark)
+				}
+			} else if r, found := iso6937Characters[b]; found {
+				result.WriteRune(r)
+			} else {
+				result.WriteRune(rune(b))
+			}
+		default:
+			// bytes undefined in the part are ignored
+			if r := table[b-0xA0]; r != 0 {
+				result.WriteRune(r)
+			}
+		}
+	}
+
+	return strings.TrimSpace(result.String())
+}
+
+// get upper half of an ISO/IEC 8859 part, latin 1 for parts which are not known
+func iso8859Table(part int) *[96]rune {
+	if table, found := iso8859Tables[part]; found {
+		return table
+	}
+
+	return iso8859Tables[1]
+}
+
+// decode a big endian UCS-2 string
+func decodeDVBTextUCS2(data []byte) string {
+	codes := make([]uint16, 0, len(data)/2)
+
+	for i := 0; i+1 < len(data); i += 2 {
+		code := uint16(data[i])<<8 | uint16(data[i+1])
+
+		switch {
+		case code == 0xE08A:
+			codes = append(codes, '\n')
+		case code >= 0xE080 && code <= 0xE09F:
+			// control codes mapped in private area
+		default:
+			codes = append(codes, code)
+		}
+	}
+
+	return strings.TrimSpace(string(utf16.Decode(codes)))
+}
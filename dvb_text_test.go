@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestDecodeDVBText(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"empty", nil, ""},
+		{"ISO 6937 default", []byte{'C', 0xC2, 'e', 't', 0xF8}, "Ce\u0301tł"},
+		{"ISO 8859-5", []byte{0x01, 0xC0, 0xDE, 0xE1, 0xE1, 0xD8, 0xEF}, "Россия"},
+		{"ISO 8859-6", []byte{0x02, 0xC7, 0xE4, 0xCC, 0xD2, 0xC7, 0xC6, 0xD1}, "الجزائر"},
+		{"ISO 8859-7", []byte{0x03, 0xC5, 0xD1, 0xD4}, "ΕΡΤ"},
+		{"ISO 8859-8", []byte{0x04, 0xF2, 0xF8, 0xE5, 0xF5}, "ערוץ"},
+		{"ISO 8859-9", []byte{0x05, 'T', 0xDD, 'V', 0xFE}, "TİVş"},
+		{"ISO 8859-10", []byte{0x06, 0xBD, 0xBF}, "―ŋ"},
+		{"ISO 8859-11", []byte{0x07, 0xAA, 0xE8, 0xCD, 0xA7}, "ช่อง"},
+		{"ISO 8859-12 reserved is latin", []byte{0x08, 'a', 0xE9}, "aé"},
+		{"ISO 8859-13", []byte{0x09, 0xC0, 0xEB}, "Ąė"},
+		{"ISO 8859-14", []byte{0x0A, 0xA1, 0xF0}, "Ḃŵ"},
+		{"ISO 8859-15", []byte{0x0B, 0xA4, 0xBC}, "€Œ"},
+		{"ISO 8859-2 by part number", []byte{0x10, 0x00, 0x02, 0xA9, 'T', 'V'}, "ŠTV"},
+		{"ISO 8859-5 by part number", []byte{0x10, 0x00, 0x05, 0xBF, 0xD5, 0xE0, 0xD2, 0xEB, 0xD9}, "Первый"},
+		{"ISO 8859-3 undefined byte", []byte{0x10, 0x00, 0x03, 'a', 0xA5, 0xA6}, "aĤ"},
+		{"part number too short", []byte{0x10, 0x00}, ""},
+		{"UCS-2", []byte{0x11, 0x04, 0x1C, 0x00, 0x54, 0x00, 0x56}, "МTV"},
+		{"UTF-8", append([]byte{0x15}, "Ελληνικά"...), "Ελληνικά"},
+		{"control codes", []byte{'a', dvbTextEmphasisOn, 'b', dvbTextEmphasisOff, dvbTextNewLine, 'c'}, "ab\nc"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := DecodeDVBText(test.data); got != test.want {
+				t.Errorf("DecodeDVBText(% X) = %q, want %q", test.data, got, test.want)
+			}
+		})
+	}
+}
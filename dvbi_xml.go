@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+)
+
+// namespaces of DVB-I documents
+const (
+	DVBIServiceDiscoveryNamespace     = "urn:dvb:metadata:servicediscovery:2019"
+	DVBIServiceListDiscoveryNamespace = "urn:dvb:metadata:servicelistdiscovery:2019"
+	TVAMetadataNamespace              = "urn:tva:metadata:2019"
+	MPEG7Namespace                    = "urn:tva:mpeg7:2008"
+	XSINamespace                      = "http://www.w3.org/2001/XMLSchema-instance"
+)
+
+// source types of service instances
+const (
+	DVBISourceTypeDASH = "urn:dvb:metadata:source:dvb-dash"
+)
+
+// how related material is related to a service or a service list
+const (
+	HowRelatedServiceListLogo = "urn:dvb:metadata:cs:HowRelatedCS:2019:1001.1"
+	HowRelatedServiceLogo     = "urn:dvb:metadata:cs:HowRelatedCS:2019:1001.2"
+	HowRelatedOutOfService    = "urn:dvb:metadata:cs:HowRelatedCS:2019:1000.1"
+)
+
+// ================= service list (ServiceList of urn:dvb:metadata:servicediscovery:2019)
+
+type DVBIServiceList struct {
+	XMLName            xml.Name                `xml:"ServiceList"`
+	Xmlns              string                  `xml:"xmlns,attr"`
+	XmlnsXSI           string                  `xml:"xmlns:xsi,attr"`
+	XmlnsTVA           string                  `xml:"xmlns:tva,attr"`
+	Version            int                     `xml:"version,attr"`
+	SchemaLocation     string                  `xml:"xsi:schemaLocation,attr"`
+	Name               string                  `xml:"Name"`
+	ProviderName       string                  `xml:"ProviderName"`
+	RelatedMaterial    []DVBIRelatedMaterial   `xml:"RelatedMaterial"`
+	RegionList         *DVBIRegionList         `xml:"RegionList,omitempty"`
+	LCNTables          []DVBILCNTable          `xml:"LCNTableList>LCNTable"`
+	ContentGuideSource *DVBIContentGuideSource `xml:"ContentGuideSource,omitempty"`
+	Services           []DVBIService           `xml:"Service"`
+}
+
+type DVBILCNTable struct {
+	LCNs []DVBILCN `xml:"LCN"`
+}
+
+type DVBILCN struct {
+	ChannelNumber int    `xml:"channelNumber,attr"`
+	ServiceRef    string `xml:"serviceRef,attr"`
+}
+
+type DVBIService struct {
+	Version                int                   `xml:"version,attr"`
+	UniqueIdentifier       string                `xml:"UniqueIdentifier"`
+	ServiceInstances       []DVBIServiceInstance `xml:"ServiceInstance"`
+	TargetRegions          []string              `xml:"TargetRegion"`
+	ServiceName            string                `xml:"ServiceName"`
+	ProviderName           string                `xml:"ProviderName"`
+	RelatedMaterial        []DVBIRelatedMaterial `xml:"RelatedMaterial"`
+	ServiceGenre           *DVBIGenre            `xml:"ServiceGenre,omitempty"`
+	ServiceDescription     []DVBIText            `xml:"ServiceDescription"`
+	ContentGuideServiceRef string                `xml:"ContentGuideServiceRef,omitempty"`
+}
+
+// an image or link related to a service or a service list
+type DVBIRelatedMaterial struct {
+	HowRelated   DVBIHowRelated   `xml:"tva:HowRelated"`
+	MediaLocator DVBIMediaLocator `xml:"tva:MediaLocator"`
+}
+
+type DVBIHowRelated struct {
+	Href string `xml:"href,attr"`
+}
+
+type DVBIMediaLocator struct {
+	MediaUri DVBIMediaUri `xml:"tva:MediaUri"`
+}
+
+type DVBIMediaUri struct {
+	ContentType string `xml:"contentType,attr,omitempty"`
+	URI         string `xml:",chardata"`
+}
+
+type DVBIGenre struct {
+	Type string `xml:"type,attr"`
+	Href string `xml:"href,attr"`
+}
+
+// a text with its language
+type DVBIText struct {
+	Lang string `xml:"xml:lang,attr,omitempty"`
+	Text string `xml:",chardata"`
+}
+
+type DVBIRegionList struct {
+	Version int          `xml:"version,attr"`
+	Regions []DVBIRegion `xml:"Region"`
+}
+
+type DVBIRegion struct {
+	RegionID     string       `xml:"regionID,attr"`
+	CountryCodes string       `xml:"countryCodes,attr,omitempty"`
+	RegionNames  []DVBIText   `xml:"RegionName"`
+	Regions      []DVBIRegion `xml:"Region"`
+}
+
+type DVBIServiceInstance struct {
+	Priority               int                         `xml:"priority,attr"`
+	DRMSystems             []DVBIDRMSystem             `xml:"ContentProtection>DRMSystemId,omitempty"`
+	SourceType             string                      `xml:"SourceType,omitempty"`
+	DASHDeliveryParameters *DVBIDASHDeliveryParameters `xml:"DASHDeliveryParameters,omitempty"`
+	// used for delivery not defined by DVB-I (HLS)
+	OtherDeliveryParameters *DVBIOtherDeliveryParameters `xml:"OtherDeliveryParameters,omitempty"`
+}
+
+type DVBIOtherDeliveryParameters struct {
+	ExtensionName    string          `xml:"extensionName,attr"`
+	UriBasedLocation DVBIExtendedURI `xml:"UriBasedLocation"`
+}
+
+// a DRM system able to decrypt a service instance
+type DVBIDRMSystem struct {
+	EncryptionScheme string `xml:"encryptionScheme,attr,omitempty"`
+	CPSIndex         string `xml:"cpsIndex,attr,omitempty"`
+	DRMSystemID      string `xml:"DRMSystemId"`
+}
+
+type DVBIDASHDeliveryParameters struct {
+	UriBasedLocation DVBIExtendedURI `xml:"UriBasedLocation"`
+}
+
+// an URI with its content type
+type DVBIExtendedURI struct {
+	ContentType string `xml:"contentType,attr"`
+	URI         string `xml:"URI"`
+}
+
+type DVBIContentGuideSource struct {
+	CGSID                string           `xml:"CGSID,attr"`
+	ProviderName         string           `xml:"ProviderName"`
+	ScheduleInfoEndpoint DVBIExtendedURI  `xml:"ScheduleInfoEndpoint"`
+	ProgramInfoEndpoint  *DVBIExtendedURI `xml:"ProgramInfoEndpoint,omitempty"`
+}
+
+// ================= service list discovery (ServiceListEntryPoints of urn:dvb:metadata:servicelistdiscovery:2019)
+
+type DVBIServiceListEntryPoints struct {
+	XMLName           xml.Name               `xml:"sld:ServiceListEntryPoints"`
+	XmlnsSLD          string                 `xml:"xmlns:sld,attr"`
+	XmlnsDVBISD       string                 `xml:"xmlns:dvbisd,attr"`
+	XmlnsMPEG7        string                 `xml:"xmlns:mpeg7,attr"`
+	XmlnsXSI          string                 `xml:"xmlns:xsi,attr"`
+	SchemaLocation    string                 `xml:"xsi:schemaLocation,attr"`
+	RegistryEntity    DVBIRegistryEntity     `xml:"sld:ServiceListRegistryEntity"`
+	ProviderOfferings []DVBIProviderOffering `xml:"sld:ProviderOffering"`
+}
+
+type DVBIRegistryEntity struct {
+	RegulatorFlag bool   `xml:"regulatorFlag,attr"`
+	Name          string `xml:"sld:Name,omitempty"`
+}
+
+type DVBIProviderOffering struct {
+	Provider             DVBIProvider              `xml:"sld:Provider"`
+	ServiceListOfferings []DVBIServiceListOffering `xml:"sld:ServiceListOffering"`
+}
+
+type DVBIProvider struct {
+	Name string `xml:"sld:Name"`
+}
+
+type DVBIServiceListOffering struct {
+	RegulatorListFlag bool               `xml:"regulatorListFlag,attr,omitempty"`
+	ServiceListName   string             `xml:"sld:ServiceListName"`
+	ServiceListURI    DVBIServiceListURI `xml:"sld:ServiceListURI"`
+	Delivery          DVBIDelivery       `xml:"sld:Delivery"`
+	Languages         []string           `xml:"sld:Language"`
+	Genres            []DVBIGenre        `xml:"sld:Genre"`
+	TargetCountry     []string           `xml:"sld:TargetCountry"`
+}
+
+// delivery systems used by services of a list, present elements are used
+type DVBIDelivery struct {
+	DVBTDelivery        *struct{} `xml:"sld:DVBTDelivery"`
+	DVBSDelivery        *struct{} `xml:"sld:DVBSDelivery"`
+	DVBCDelivery        *struct{} `xml:"sld:DVBCDelivery"`
+	DASHDelivery        *struct{} `xml:"sld:DASHDelivery"`
+	RTSPDelivery        *struct{} `xml:"sld:RTSPDelivery"`
+	ApplicationDelivery *struct{} `xml:"sld:ApplicationDelivery"`
+}
+
+type DVBIServiceListURI struct {
+	ContentType string `xml:"contentType,attr"`
+	URI         string `xml:"dvbisd:URI"`
+}
+
+// create an empty service list with namespaces set
+func NewDVBIServiceList() *DVBIServiceList {
+	sl := new(DVBIServiceList)
+	sl.Xmlns = DVBIServiceDiscoveryNamespace
+	sl.XmlnsXSI = XSINamespace
+	sl.XmlnsTVA = TVAMetadataNamespace
+	sl.Version = 1
+	sl.SchemaLocation = DVBIServiceDiscoveryNamespace + " ../dvbi_v1.0.xsd"
+
+	return sl
+}
+
+// create an empty service list discovery document with namespaces set
+func NewDVBIServiceListEntryPoints() *DVBIServiceListEntryPoints {
+	ep := new(DVBIServiceListEntryPoints)
+	ep.XmlnsSLD = DVBIServiceListDiscoveryNamespace
+	ep.XmlnsDVBISD = DVBIServiceDiscoveryNamespace
+	ep.XmlnsMPEG7 = MPEG7Namespace
+	ep.XmlnsXSI = XSINamespace
+	ep.SchemaLocation = DVBIServiceListDiscoveryNamespace + " dvbi_service_list_discovery_v1.0.xsd"
+
+	return ep
+}
+
+// serialize a document as XML
+func MarshalXMLDocument(v interface{}) ([]byte, error) {
+	out, err := xml.MarshalIndent(v, "", " ")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), append(out, '\n')...), nil
+}
+
+// write a document as XML response
+func writeXMLResponse(w http.ResponseWriter, v interface{}) {
+	out, err := MarshalXMLDocument(v)
+
+	if err != nil {
+		http.Error(w, "500 internal error.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Write(out)
+}
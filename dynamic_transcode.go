@@ -7,25 +7,48 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-// time out to check if a client is still listening to transcode
+// time out to check if a client is still listening to transcode (a viewer leaves after tickTimeout ticks without request)
 const tickTime time.Duration = time.Second
 const tickTimeout int = 8
 const startTimeout int = 15
 
-// time out at startup of transcode
+// time out waiting for a file at startup of transcode (can be changed by timeout parameter of requests)
+const fileTimeout time.Duration = 10 * time.Second
+const fileMaxTimeout time.Duration = time.Minute
+
+// polling period when file system notification is not available
 const fileTick time.Duration = 10 * time.Millisecond
-const fileTimeout int = 1000
 
 // a running instance of transcode
 type DynamicTranscodeInstance struct {
-	Args          map[string]string
+	Args          ToolParameters
 	InstanceIndex int
-	Tuner         *CommandLineTool
-	Transcoder    *CommandLineTool
-	TimeOut       int
+	// working directory holding output of the instance
+	Dir string
+	// tuner session feeding the instance, shared with other programs of the multiplex
+	Session    *TunerSession
+	filter     *MpegProgramFilter
+	Transcoder *CommandLineTool
+	// in process transcoder used instead of transcoder tool for remuxed feeds
+	Packager Transcoder
+	// ticks before stop while no viewer is present, protected by the manager lock
+	TimeOut int
+	// clients watching the instance, protected by the manager lock
+	viewers map[viewerKey]*ViewerSession
+	// closed once tools are started, requests arriving during start wait on it
+	started chan struct{}
+	// wake up requests waiting for files of the working directory
+	files *FileWaiter
+	// request which created the instance, priority is raised by higher priority requests
+	Priority TunerPriority
+	Client   string
+	Since    time.Time
+	// reason of stop when tuner was taken by a higher priority request or a tool failed
+	preempted string
 }
 
 // the transcoder manager which create and destroy transcode instances according to client requests
@@ -36,24 +59,43 @@ type DynamicTranscodeManager struct {
 	configTranscoder CommandLineToolConfig
 	maxTuner         int
 	tunerList        []int
+	// one tuner per feed instead of one per program
+	shareTuners bool
+	// directory holding working directories of instances
+	workDir string
+	// protect instances, sessions and instance time outs (handlers and time out run concurrently)
+	mutex sync.Mutex
 	// list running trancoder instances
 	activeInstances map[string]*DynamicTranscodeInstance
+	// running tuners by feed (or by instance path if tuners are not shared)
+	sessions map[string]*TunerSession
+	// tuners being stopped, their index is not free yet
+	releasing map[*TunerSession]bool
+	// requests waiting for a tuner, closed and replaced when a tuner may be free
+	queue    []*tunerRequest
+	sequence uint64
+	released chan struct{}
+	// preemption notices for clients of stopped instances by instance path
+	notices map[string]string
 	// a ticker to check if transcode instance needs to be flushed
 	ticker *time.Ticker
 }
 
-// stop a running instance, stopping the tuner closes data channel and stop also transcoder
+// stop a running instance, removing the program from the tuner session closes data channel and stop also transcoder
 func (d *DynamicTranscodeInstance) Stop() {
 	// if (d.Transcoder != nil) {
 	// 	d.Transcoder.Stop()
 	// }
-	if d.Tuner != nil {
-		d.Tuner.Stop()
+	if d.Session != nil {
+		d.Session.RemoveProgram(d.filter)
+	}
+	if d.files != nil {
+		d.files.Close()
 	}
 }
 
 func (d *DynamicTranscodeInstance) RemoveAllContent() error {
-	path := strconv.Itoa(d.InstanceIndex)
+	path := d.Dir
 	directory, err := os.Open(path)
 	if err != nil {
 		return err
@@ -72,15 +114,40 @@ func (d *DynamicTranscodeInstance) RemoveAllContent() error {
 	return nil
 }
 
+// check if a feed (or a feed/program path) only needs remuxing to DASH
+func IsRemuxFeed(feed string, instancePath string) bool {
+	for _, name := range deviceconfig.RemuxFeeds {
+		if name == feed || name == instancePath {
+			return true
+		}
+	}
+
+	return false
+}
+
+// feed a transcoder from a channel, stop it when channel is closed
+func RunTranscoder(transcoder Transcoder, c MpegTSChannel) {
+	for pkt := range c {
+		transcoder.ProcessPacket(pkt)
+	}
+
+	transcoder.Stop()
+}
+
 // create a transcode manager
-func CreateDynamicTranscode(configTuner CommandLineToolConfig, configTranscoder CommandLineToolConfig, maxTuner int, tunerList []int) *DynamicTranscodeManager {
+func CreateDynamicTranscode(configTuner CommandLineToolConfig, configTranscoder CommandLineToolConfig, maxTuner int, tunerList []int, shareTuners bool) *DynamicTranscodeManager {
 	t := new(DynamicTranscodeManager)
 
 	t.configTuner = configTuner
 	t.configTranscoder = configTranscoder
 	t.maxTuner = maxTuner
 	t.tunerList = tunerList
+	t.shareTuners = shareTuners
 	t.activeInstances = make(map[string]*DynamicTranscodeInstance)
+	t.sessions = make(map[string]*TunerSession)
+	t.releasing = make(map[*TunerSession]bool)
+	t.released = make(chan struct{})
+	t.notices = make(map[string]string)
 	t.ticker = time.NewTicker(tickTime)
 
 	// launch the asynchronous cleaning of inactive instances
@@ -89,37 +156,163 @@ func CreateDynamicTranscode(configTuner CommandLineToolConfig, configTranscoder
 	return t
 }
 
+// set directory where instance working directories are created, transcoder tool runs there unless configured otherwise
+func (t *DynamicTranscodeManager) SetWorkDir(dir string) {
+	t.workDir = dir
+
+	if t.configTranscoder.WorkDir == "" {
+		t.configTranscoder.WorkDir = dir
+	}
+}
+
 // a function running in the backgound to cleanup inactive instances
 func (t *DynamicTranscodeManager) RunTimeOut() {
 
 	for _ = range t.ticker.C {
+		var released []*TunerSession
+
+		t.mutex.Lock()
 		for name, instance := range t.activeInstances {
+			// instances still starting are not timed out
+			if !instance.isStarted() {
+				continue
+			}
+			// instance is kept while viewers are present
+			if instance.tickViewers(name) > 0 {
+				continue
+			}
 			instance.TimeOut--
-			log.Printf("Tick Instance %s time out is %d\n", name, instance.TimeOut)
+			logDebugf("Tick Instance %s time out is %d\n", name, instance.TimeOut)
 			if instance.TimeOut <= 0 {
-				log.Printf("Stopping Instance %s after timeout\n", name)
-				instance.Stop()
-				delete(t.activeInstances, name)
+				log.Printf("Stopping Instance %s, no viewer left\n", name)
+				if session := t.stopInstance(name, instance); session != nil {
+					released = append(released, session)
+				}
 			}
 		}
+		t.mutex.Unlock()
+
+		// stopping tools takes time, do it without lock
+		for _, session := range released {
+			t.releaseSession(session)
+		}
 	}
 
 }
 
 // stop all running instances (called before exists to avoid hanging processes)
 func (t *DynamicTranscodeManager) StopAll() {
+	var released []*TunerSession
+
+	t.mutex.Lock()
+	for name, instance := range t.activeInstances {
+		if session := t.stopInstance(name, instance); session != nil {
+			released = append(released, session)
+		}
+	}
+	t.mutex.Unlock()
+
+	for _, session := range released {
+		t.releaseSession(session)
+	}
+}
+
+// check if tools of an instance are started
+func (d *DynamicTranscodeInstance) isStarted() bool {
+	select {
+	case <-d.started:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop an instance, return its tuner session if no other program of the multiplex is used (lock must be held)
+func (t *DynamicTranscodeManager) stopInstance(name string, instance *DynamicTranscodeInstance) *TunerSession {
+	instance.Stop()
+	delete(t.activeInstances, name)
+
+	session := instance.Session
+
+	if session == nil || session.Users() != 0 || t.sessions[session.Name] != session {
+		return nil
+	}
+
+	// new requests for the feed now get a new session, the tuner stays reserved until stopped
+	delete(t.sessions, session.Name)
+	t.releasing[session] = true
+
+	return session
+}
+
+// stop a tuner session which is not used anymore (lock must not be held)
+func (t *DynamicTranscodeManager) releaseSession(session *TunerSession) {
+	log.Printf("Releasing tuner %d used by %s\n", session.TunerIndex, session.Name)
+	session.Stop()
+
+	t.mutex.Lock()
+	delete(t.releasing, session)
+	t.signalTuners()
+	t.mutex.Unlock()
+}
+
+// stop an instance whose transcoder failed, its clients get the reason on their next request (lock must not be held)
+func (t *DynamicTranscodeManager) failInstance(name string, instance *DynamicTranscodeInstance, reason string) {
+	var session *TunerSession
+
+	t.mutex.Lock()
+	if t.activeInstances[name] == instance {
+		log.Printf("Instance %s stopped, %s\n", name, reason)
+
+		instance.preempted = reason
+		t.notices[name] = reason
+		session = t.stopInstance(name, instance)
+	}
+	t.mutex.Unlock()
+
+	if session != nil {
+		t.releaseSession(session)
+	}
+}
+
+// stop all instances fed by a tuner session whose tool failed (lock must not be held)
+func (t *DynamicTranscodeManager) failSession(session *TunerSession, reason string) {
+	var released []*TunerSession
+
+	t.mutex.Lock()
 	for name, instance := range t.activeInstances {
-		instance.Stop()
-		delete(t.activeInstances, name)
+		if instance.Session != session {
+			continue
+		}
+
+		log.Printf("Instance %s stopped, %s\n", name, reason)
+
+		instance.preempted = reason
+		t.notices[name] = reason
+
+		if s := t.stopInstance(name, instance); s != nil {
+			released = append(released, s)
+		}
+	}
+	t.mutex.Unlock()
+
+	for _, s := range released {
+		t.releaseSession(s)
 	}
 }
 
-// check if a specific tuner index is in use
+// check if a specific tuner index is in use (lock must be held)
 func (t *DynamicTranscodeManager) IsTunerUsed(n int) bool {
-	// scan all instances
-	for _, instance := range t.activeInstances {
+	// scan all tuner sessions
+	for _, session := range t.sessions {
 		// if one is matching return is use
-		if instance.InstanceIndex == n {
+		if session.TunerIndex == n {
+			return true
+		}
+	}
+
+	for session := range t.releasing {
+		if session.TunerIndex == n {
 			return true
 		}
 	}
@@ -128,6 +321,28 @@ func (t *DynamicTranscodeManager) IsTunerUsed(n int) bool {
 	return false
 }
 
+// check if a specific instance index (working directory) is in use (lock must be held)
+func (t *DynamicTranscodeManager) IsInstanceUsed(n int) bool {
+	for _, instance := range t.activeInstances {
+		if instance.InstanceIndex == n {
+			return true
+		}
+	}
+
+	return false
+}
+
+// get first free instance index (lock must be held)
+func (t *DynamicTranscodeManager) AllocateInstance() int {
+	i := 0
+	for t.IsInstanceUsed(i) {
+		i++
+	}
+
+	return i
+}
+
+// get a free tuner index, -1 if all are used (lock must be held)
 func (t *DynamicTranscodeManager) AllocateTuner() int {
 	if len(t.tunerList) > 0 {
 		for i := range t.tunerList {
@@ -145,125 +360,301 @@ func (t *DynamicTranscodeManager) AllocateTuner() int {
 	return -1
 }
 
-// serve request from dynamic content by clients, creates a transcode instance if none is active for a request
-func (t *DynamicTranscodeManager) ServeDynamicContent(w http.ResponseWriter, r *http.Request, path string) {
-	// split full path
-	splitPath := strings.SplitN(path, "/", 3)
+// create and register an instance for a program, tools are not started (lock must be held)
+// return the HTTP status on failure
+func (t *DynamicTranscodeManager) createInstance(req *tunerRequest, feed string, programPath string) (*DynamicTranscodeInstance, int) {
+	instancePath := req.Path
 
-	// build instance path
-	instancePath := strings.Join([]string{splitPath[0], splitPath[1]}, "/")
+	log.Printf("Instance for %s not found, creating new one\n", instancePath)
+	source, sourcefound := deviceconfig.Feeds[feed]
 
-	aliasname, aliasFound := deviceconfig.Aliases[instancePath]
+	if !sourcefound {
+		return nil, http.StatusNotFound
+	}
 
-	if aliasFound {
-		log.Printf("Replacing reference from %s to %s\n", instancePath, aliasname)
-		instancePath = aliasname
-		aliasSplitPath := strings.SplitN(aliasname, "/", 2)
-		splitPath[0] = aliasSplitPath[0]
-		splitPath[1] = aliasSplitPath[1]
+	// programs of a feed share the tuner session of the feed when enabled
+	sessionName := instancePath
+	program := ""
+	if t.shareTuners {
+		sessionName = feed
+		program = programPath
 	}
 
-	// try to lookup instance
-	activeInstance, found := t.activeInstances[instancePath]
+	session, sessionFound := t.sessions[sessionName]
 
-	if !found {
-		log.Printf("Instance for %s not found, creating new one\n", instancePath)
-		source, sourcefound := deviceconfig.Feeds[splitPath[0]]
+	if !sessionFound {
+		// requests waiting longer or with higher priority get free tuners first
+		tunerIndex := -1
+		if !t.hasQueuedBefore(req) {
+			tunerIndex = t.AllocateTuner()
+		}
 
-		if !sourcefound {
-			http.Error(w, "404 not found. Unknown channel", http.StatusNotFound)
-			return
+		if tunerIndex < 0 {
+			log.Printf("Cannot allocate tuner for %s request of %s\n", req.Priority, instancePath)
+			return nil, http.StatusTooManyRequests
 		}
 
-		Index := t.AllocateTuner()
-		sIndex := strconv.Itoa(Index)
+		session = NewTunerSession(sessionName, tunerIndex, t.configTuner)
+		t.sessions[sessionName] = session
 
-		if Index < 0 {
-			log.Printf("Cannot allocate tuner\n")
-			http.Error(w, "429 too many request", http.StatusTooManyRequests)
-			return
+		// programs of a tuner which is not restarted anymore are stopped
+		failedSession := session
+		session.Tuner.SetExitHandler(func(err error) {
+			t.failSession(failedSession, "tuner failed: "+err.Error())
+		})
+
+		// a shared tuner receives all programs of the feed
+		tunerProgram := programPath
+		if t.shareTuners {
+			tunerProgram = ""
 		}
 
-		// create new instance
-		activeInstance = new(DynamicTranscodeInstance)
+		tunerLog := NewToolLog("tuner", tunerIndex, t.configTuner.Command, feed, tunerProgram)
+		toolLogs.Register(tunerLog)
+		session.Tuner.SetLog(tunerLog)
+	} else {
+		log.Printf("Sharing tuner %d of %s with %s\n", session.TunerIndex, sessionName, instancePath)
+	}
 
-		// configure instance
-		activeInstance.InstanceIndex = Index
+	// without sharing, working directory keeps the tuner index
+	Index := session.TunerIndex
+	if t.shareTuners {
+		Index = t.AllocateInstance()
+	}
 
-		// cleanup existing content in directory
-		activeInstance.RemoveAllContent()
+	// create new instance
+	activeInstance := new(DynamicTranscodeInstance)
 
-		// check if work directory exists
-		_, error := os.Stat(sIndex)
+	// configure instance
+	activeInstance.InstanceIndex = Index
+	activeInstance.Dir = filepath.Join(t.workDir, strconv.Itoa(Index))
+	activeInstance.started = make(chan struct{})
+	activeInstance.Priority = req.Priority
+	activeInstance.Client = req.Client
+	activeInstance.Since = req.Since
 
-		// create transcode directory if it does not exists
-		if os.IsNotExist(error) {
-			err := os.MkdirAll(sIndex, 0660)
-			if err != nil {
-				log.Printf("cannot create working directory for instance %d\n%s", activeInstance.InstanceIndex, err)
-			}
+	// create transcode directory if it does not exist, the file waiter is created before the instance can be stopped
+	err := os.MkdirAll(activeInstance.Dir, 0660)
+	if err != nil {
+		log.Printf("cannot create working directory for instance %d\n%s", activeInstance.InstanceIndex, err)
+	}
+	activeInstance.files = NewFileWaiter(activeInstance.Dir)
+
+	// create parameters for tools
+	activeInstance.Args = make(ToolParameters)
+
+	// feed arguments are given as separate arguments
+	activeInstance.Args["source"] = source.Tokens()
+	activeInstance.Args.Set("program", programPath)
+	activeInstance.Args.Set("tunerindex", strconv.Itoa(session.TunerIndex))
+	activeInstance.Args.Set("instanceindex", strconv.Itoa(Index))
+
+	// get program from tuner session
+	activeInstance.Session = session
+	activeInstance.filter = session.AddProgram(program)
+
+	// set start timeout before adding to list, starting requires longer timeout
+	activeInstance.TimeOut = startTimeout
+	activeInstance.viewers = make(map[viewerKey]*ViewerSession)
+	// add to list of active instances
+	t.activeInstances[instancePath] = activeInstance
+	delete(t.notices, instancePath)
+
+	// first program of the session starts the tuner
+	if !sessionFound {
+		// a shared tuner receives the whole multiplex, programs are selected by sessions
+		tunerArgs := make(ToolParameters)
+		tunerArgs["source"] = source.Tokens()
+		tunerArgs.Set("tunerindex", activeInstance.Args.Get("tunerindex"))
+		if !t.shareTuners {
+			tunerArgs.Set("program", programPath)
 		}
 
-		// create parameters for tools
-		activeInstance.Args = make(map[string]string)
+		session.args = tunerArgs
+	}
+
+	return activeInstance, http.StatusOK
+}
+
+// start tools of a new instance (lock must not be held)
+func (t *DynamicTranscodeManager) startInstance(activeInstance *DynamicTranscodeInstance, feed string, instancePath string) {
+	defer close(activeInstance.started)
+
+	dir := activeInstance.Dir
 
-		activeInstance.Args["source"] = source
-		activeInstance.Args["program"] = splitPath[1]
-		activeInstance.Args["tunerindex"] = sIndex
+	// cleanup existing content in directory, the directory itself is kept for its file waiter
+	activeInstance.RemoveAllContent()
 
-		// create tool for receiving
-		localTunerConfig := t.configTuner
-		localTunerConfig.PortOffset = (uint16)(activeInstance.InstanceIndex)
-		activeInstance.Tuner = CreateCommandLineTool(localTunerConfig)
+	input := activeInstance.filter.GetOutputPipe()
 
+	if IsRemuxFeed(feed, instancePath) {
+		// package in process, no transcoder tool required
+		activeInstance.Packager = NewDashPackager()
+		activeInstance.Packager.Start(dir)
+		go RunTranscoder(activeInstance.Packager, input)
+	} else {
 		// create tool for transcoding
 		localTranscoderConfig := t.configTranscoder
 		localTranscoderConfig.PortOffset = (uint16)(activeInstance.InstanceIndex)
 		activeInstance.Transcoder = CreateCommandLineTool(localTranscoderConfig)
 
-		// set start timeout before adding to list, starting requires longer timeout
-		activeInstance.TimeOut = startTimeout
-		// add to list of active instances
-		t.activeInstances[instancePath] = activeInstance
+		// instance is stopped when transcoder is not restarted anymore
+		activeInstance.Transcoder.SetExitHandler(func(err error) {
+			t.failInstance(instancePath, activeInstance, "transcoder failed: "+err.Error())
+		})
+
+		transcoderLog := NewToolLog("transcoder", activeInstance.InstanceIndex, localTranscoderConfig.Command, feed, activeInstance.Args.Get("program"))
+		toolLogs.Register(transcoderLog)
+		activeInstance.Transcoder.SetLog(transcoderLog)
 
 		// link pipes
-		activeInstance.Transcoder.SetInputPipe(activeInstance.Tuner.GetOutputPipe())
+		activeInstance.Transcoder.SetInputPipe(input)
 
-		activeInstance.Transcoder.Start(activeInstance.Args)
-		activeInstance.Tuner.Start(activeInstance.Args)
+		err := activeInstance.Transcoder.Start(activeInstance.Args)
+		if err != nil {
+			log.Printf("cannot start transcoder for %s\n%s\n", instancePath, err)
+			t.failInstance(instancePath, activeInstance, "cannot start transcoder")
+			return
+		}
 	}
 
-	// path to file to serve
-	filePath := strings.Join([]string{strconv.Itoa(activeInstance.InstanceIndex), splitPath[2]}, "/")
+	session := activeInstance.Session
 
-	//log.Printf("accessing file %s\n", filePath)
+	err := session.StartOnce()
+	if err != nil {
+		log.Printf("cannot start tuner %d for %s\n%s\n", session.TunerIndex, session.Name, err)
+		t.failSession(session, "cannot start tuner")
+	}
+}
+
+// time to wait for a file, from timeout parameter of request (like ?timeout=2s)
+func requestFileTimeout(r *http.Request) time.Duration {
+	timeout, err := time.ParseDuration(r.URL.Query().Get("timeout"))
+
+	if err != nil || timeout <= 0 {
+		return fileTimeout
+	}
+
+	if timeout > fileMaxTimeout {
+		return fileMaxTimeout
+	}
+
+	return timeout
+}
+
+// serve request from dynamic content by clients, creates a transcode instance if none is active for a request
+func (t *DynamicTranscodeManager) ServeDynamicContent(w http.ResponseWriter, r *http.Request, path string) {
+	// split full path
+	splitPath := strings.SplitN(path, "/", 3)
 
-	// check if file exists, if file is not yet present wait a bit for the transcode process to start
-	fileNotExists := true
-	timeOut := fileTimeout
+	if len(splitPath) < 3 {
+		http.Error(w, "404 not found.", http.StatusNotFound)
+		return
+	}
+
+	// session id of the viewer is a directory of the path so that relative URLs in manifests keep it
+	session, file := splitViewerSession(splitPath[2])
+
+	if session == "" && isViewerManifest(file) {
+		redirectViewerSession(w, r, file)
+		return
+	}
+
+	// build instance path
+	instancePath := strings.Join([]string{splitPath[0], splitPath[1]}, "/")
+
+	aliasname, aliasFound := deviceconfig.Aliases[instancePath]
+
+	if aliasFound {
+		log.Printf("Replacing reference from %s to %s\n", instancePath, aliasname)
+		instancePath = aliasname
+		aliasSplitPath := strings.SplitN(aliasname, "/", 2)
+		splitPath[0] = aliasSplitPath[0]
+		splitPath[1] = aliasSplitPath[1]
+	}
 
-	for fileNotExists {
-		_, error := os.Stat(filePath)
+	req := newTunerRequest(r, instancePath)
+	deadline := req.Since.Add(req.Wait)
 
-		fileNotExists = os.IsNotExist(error)
+	// lookup and creation are done under lock so that only one request creates the instance
+	t.mutex.Lock()
 
-		// check if file exists
-		if fileNotExists {
-			// run time out
-			timeOut--
+	var activeInstance *DynamicTranscodeInstance
+	var found bool
+	status := http.StatusOK
 
-			if timeOut <= 0 {
-				log.Printf("Timed out, File %s does not exists\n", filePath)
-				http.Error(w, "404 not found.", http.StatusNotFound)
-				return
+	for {
+		activeInstance, found = t.activeInstances[instancePath]
+
+		if found {
+			// keep instance at the highest priority requested
+			if req.Priority > activeInstance.Priority {
+				activeInstance.Priority = req.Priority
 			}
-			// sleep a bit
-			time.Sleep(fileTick)
+			break
 		}
+
+		// tell clients of a preempted instance once, next request starts it again
+		if notice, preempted := t.notices[instancePath]; preempted {
+			delete(t.notices, instancePath)
+			t.mutex.Unlock()
+			http.Error(w, "503 "+notice, http.StatusServiceUnavailable)
+			return
+		}
+
+		activeInstance, status = t.createInstance(req, splitPath[0], splitPath[1])
+
+		// wait in queue if no tuner is free
+		if activeInstance != nil || status != http.StatusTooManyRequests || !t.waitForTuner(req, &deadline) {
+			break
+		}
+	}
+
+	t.dequeue(req)
+	t.mutex.Unlock()
+
+	if activeInstance == nil {
+		if status == http.StatusTooManyRequests {
+			http.Error(w, "429 too many request", http.StatusTooManyRequests)
+		} else {
+			http.Error(w, "404 not found. Unknown channel", http.StatusNotFound)
+		}
+		return
+	}
+
+	if !found {
+		t.startInstance(activeInstance, splitPath[0], instancePath)
+	} else {
+		// wait for the request which creates the instance
+		<-activeInstance.started
+	}
+
+	// path to file to serve
+	filePath := filepath.Join(activeInstance.Dir, file)
+
+	//log.Printf("accessing file %s\n", filePath)
+
+	// if file is not yet present wait for the transcode process to write it
+	if !activeInstance.files.Wait(file, requestFileTimeout(r)) {
+		t.mutex.Lock()
+		notice := activeInstance.preempted
+		t.mutex.Unlock()
+
+		if notice != "" {
+			http.Error(w, "503 "+notice, http.StatusServiceUnavailable)
+			return
+		}
+
+		log.Printf("Timed out, File %s does not exists\n", filePath)
+		http.Error(w, "404 not found.", http.StatusNotFound)
+		return
 	}
 
-	// reset timeout on this instance
-	activeInstance.TimeOut = tickTimeout
+	// keep viewer alive, start grace is over so instance stops as soon as last viewer is gone
+	t.mutex.Lock()
+	activeInstance.touchViewer(instancePath, newViewerKey(r, session))
+	activeInstance.TimeOut = 0
+	t.mutex.Unlock()
 
 	//log.Printf("Serving file %s\n", filePath)
 
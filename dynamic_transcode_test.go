@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// count lines written by stub tools, one per process start
+func countStarts(t *testing.T, file string) int {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0
+	}
+
+	return strings.Count(string(content), "\n")
+}
+
+// concurrent requests for a new channel must create a single instance on a single tuner
+func TestDynamicTranscodeConcurrentRequests(t *testing.T) {
+	workdir := t.TempDir()
+
+	savedConfig := deviceconfig
+	defer func() { deviceconfig = savedConfig }()
+
+	deviceconfig.Feeds = map[string]ToolArgs{"feed": NewToolArgs("stub")}
+	deviceconfig.Aliases = nil
+	deviceconfig.RemuxFeeds = nil
+	deviceconfig.TunerWait = 0
+
+	// $$ keeps shell variables from parameter substitution
+	tunerArgs, err := ParseToolArgs(`-c 'echo started >> "$$0"; exec sleep 30' ` + filepath.Join(workdir, "tuners"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// transcoder writes its manifest in the instance directory once the tuner runs, then reads its input until closed
+	transcoderArgs, err := ParseToolArgs(`-c 'echo started >> transcoders; until [ -e tuners ]; do sleep 0.01; done; echo manifest > "$$0/manifest.mpd"; exec cat > /dev/null' ${instanceindex}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manager := CreateDynamicTranscode(
+		CommandLineToolConfig{Command: "sh", Args: tunerArgs},
+		CommandLineToolConfig{Command: "sh", Args: transcoderArgs},
+		4, nil, false)
+	manager.SetWorkDir(workdir)
+
+	const requests = 16
+
+	var wg sync.WaitGroup
+	codes := make(chan int, requests)
+
+	// each request is a viewer with its own session
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			path := fmt.Sprintf("feed/1/session/viewer%d/manifest.mpd", i)
+			r := httptest.NewRequest(http.MethodGet, "/dynamic/transcode/"+path+"?timeout=5s", nil)
+			w := httptest.NewRecorder()
+			manager.ServeDynamicContent(w, r, path)
+			codes <- w.Code
+		}(i)
+	}
+
+	wg.Wait()
+	close(codes)
+
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("request got status %d, want %d", code, http.StatusOK)
+		}
+	}
+
+	manager.mutex.Lock()
+	instances := len(manager.activeInstances)
+	sessions := len(manager.sessions)
+	viewers := 0
+	for _, instance := range manager.activeInstances {
+		viewers += len(instance.viewers)
+	}
+	manager.mutex.Unlock()
+
+	if instances != 1 {
+		t.Errorf("got %d instances, want 1", instances)
+	}
+	if sessions != 1 {
+		t.Errorf("got %d tuner sessions, want 1", sessions)
+	}
+	if viewers != requests {
+		t.Errorf("got %d viewers, want %d", viewers, requests)
+	}
+
+	manager.StopAll()
+
+	if n := countStarts(t, filepath.Join(workdir, "tuners")); n != 1 {
+		t.Errorf("tuner tool started %d times, want 1", n)
+	}
+	if n := countStarts(t, filepath.Join(workdir, "transcoders")); n != 1 {
+		t.Errorf("transcoder tool started %d times, want 1", n)
+	}
+}
+
+// manifests requested without session are redirected to a session directory, segments are not
+func TestDynamicTranscodeSessionRedirect(t *testing.T) {
+	manager := CreateDynamicTranscode(CommandLineToolConfig{}, CommandLineToolConfig{}, 0, nil, false)
+
+	tests := []struct {
+		path     string
+		location string
+	}{
+		{"feed/1/out.mpd?session=abc&timeout=2s", "/dynamic/transcode/feed/1/session/abc/out.mpd?timeout=2s"},
+		{"feed/1/master.m3u8?session=abc", "/dynamic/transcode/feed/1/session/abc/master.m3u8"},
+		{"feed/1/out.mpd?session=../x", "/dynamic/transcode/feed/1/session/"},
+		{"feed/1/out.mpd", "/dynamic/transcode/feed/1/session/"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/dynamic/transcode/"+test.path, nil)
+		w := httptest.NewRecorder()
+		manager.ServeDynamicContent(w, r, r.URL.Path[len("/dynamic/transcode/"):])
+
+		location := w.Header().Get("Location")
+		if w.Code != http.StatusFound || !strings.HasPrefix(location, test.location) {
+			t.Errorf("%s: got status %d location %q, want redirect to %q", test.path, w.Code, location, test.location)
+		}
+	}
+
+	if session, file := splitViewerSession("session/abc/chunk-1.m4s"); session != "abc" || file != "chunk-1.m4s" {
+		t.Errorf("splitViewerSession gave session %q file %q", session, file)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"sync"
+)
+
+// identify one EIT section to detect unchanged sections
+type eitSectionKey struct {
+	TableID       int
+	Service       DvbServiceKey
+	SectionNumber int
+}
+
+// collect EIT p/f and schedule events of a stream into an EPG store
+type DvbEITCollector struct {
+	mutex  sync.Mutex
+	demux  *MpegDemux
+	store  *EpgStore
+	parser *MpegPIDPSIParser
+	// version of each section already stored
+	versions map[eitSectionKey]int
+}
+
+// create a collector and register it on the EIT PID of a demux
+func NewDvbEITCollector(demux *MpegDemux, store *EpgStore) *DvbEITCollector {
+	c := new(DvbEITCollector)
+	c.demux = demux
+	c.store = store
+	c.versions = make(map[eitSectionKey]int)
+	c.parser = NewMpegPIDPSIParser(MaxSISectionSize, c.handleEIT)
+	c.demux.AddParser(PIDEIT, c.parser)
+
+	return c
+}
+
+// forget known section versions (to call after a new tune)
+func (c *DvbEITCollector) Reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.versions = make(map[eitSectionKey]int)
+}
+
+// unregister from the demux
+func (c *DvbEITCollector) Detach() {
+	c.demux.RemoveParser(PIDEIT, c.parser)
+}
+
+func (c *DvbEITCollector) handleEIT(section []byte) {
+	eit, err := ParseEIT(section)
+
+	if err != nil || !eit.Section.CurrentNext {
+		return
+	}
+
+	service := DvbServiceKey{eit.OriginalNetworkID, eit.TransportStreamID, eit.ServiceID}
+	key := eitSectionKey{eit.TableID, service, eit.Section.SectionNumber}
+
+	// most sections are repeated without change
+	c.mutex.Lock()
+	version, found := c.versions[key]
+	c.versions[key] = eit.Section.Version
+	c.mutex.Unlock()
+
+	if found && version == eit.Section.Version {
+		return
+	}
+
+	if eit.IsPresentFollowing() {
+		// section 0 is present event, section 1 following event, they can be empty
+		var event *EpgEvent
+		if len(eit.Events) > 0 {
+			event = &eit.Events[0]
+		}
+		c.store.SetPresentFollowing(service, eit.Section.SectionNumber, event)
+		return
+	}
+
+	for _, event := range eit.Events {
+		c.store.AddEvent(service, event)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// interval between removal of past events
+const epgExpiryTick time.Duration = time.Minute
+
+// events of one service
+type epgServiceEvents struct {
+	// events by event id
+	events map[int]*EpgEvent
+	// present and following events from EIT p/f
+	presentfollowing [2]*EpgEvent
+}
+
+// in memory store of events for all services
+type EpgStore struct {
+	mutex    sync.RWMutex
+	services map[DvbServiceKey]*epgServiceEvents
+
+	// ticker to remove past events
+	ticker *time.Ticker
+	stop   chan struct{}
+}
+
+func NewEpgStore() *EpgStore {
+	s := new(EpgStore)
+	s.services = make(map[DvbServiceKey]*epgServiceEvents)
+
+	return s
+}
+
+// get events of a service, create entry if required (lock must be held)
+func (s *EpgStore) service(key DvbServiceKey) *epgServiceEvents {
+	service, found := s.services[key]
+
+	if !found {
+		service = new(epgServiceEvents)
+		service.events = make(map[int]*EpgEvent)
+		s.services[key] = service
+	}
+
+	return service
+}
+
+// add or replace a scheduled event
+func (s *EpgStore) AddEvent(key DvbServiceKey, event EpgEvent) {
+	if event.Start.IsZero() {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	service := s.service(key)
+
+	// a rescheduled programme replaces events it overlaps
+	for id, existing := range service.events {
+		if id != event.EventID && existing.Start.Before(event.End()) && event.Start.Before(existing.End()) {
+			delete(service.events, id)
+		}
+	}
+
+	service.events[event.EventID] = &event
+}
+
+// set present (index 0) or following (index 1) event of a service
+func (s *EpgStore) SetPresentFollowing(key DvbServiceKey, index int, event *EpgEvent) {
+	if index < 0 || index > 1 {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	service := s.service(key)
+	service.presentfollowing[index] = event
+
+	// p/f events are also part of the schedule
+	if event != nil && !event.Start.IsZero() {
+		scheduled := *event
+		service.events[event.EventID] = &scheduled
+	}
+}
+
+// get services having events
+func (s *EpgStore) GetServiceKeys() []DvbServiceKey {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	keys := make([]DvbServiceKey, 0, len(s.services))
+
+	for key := range s.services {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// get events of a service overlapping [from, to) sorted by start time, zero times are not limiting
+func (s *EpgStore) GetEvents(key DvbServiceKey, from time.Time, to time.Time) []EpgEvent {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	events := []EpgEvent{}
+	service, found := s.services[key]
+
+	if !found {
+		return events
+	}
+
+	for _, event := range service.events {
+		if !from.IsZero() && !event.End().After(from) {
+			continue
+		}
+		if !to.IsZero() && !event.Start.Before(to) {
+			continue
+		}
+		events = append(events, *event)
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i].Start.Before(events[j].Start) })
+
+	return events
+}
+
+// get one event by id
+func (s *EpgStore) GetEvent(key DvbServiceKey, eventid int) (EpgEvent, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	service, found := s.services[key]
+
+	if !found {
+		return EpgEvent{}, false
+	}
+
+	event, found := service.events[eventid]
+
+	if !found {
+		return EpgEvent{}, false
+	}
+
+	return *event, true
+}
+
+// get present and following events at a given time, use EIT p/f when available
+func (s *EpgStore) GetNowNext(key DvbServiceKey, now time.Time) []EpgEvent {
+	s.mutex.RLock()
+	service, found := s.services[key]
+	var pf [2]*EpgEvent
+	if found {
+		pf = service.presentfollowing
+	}
+	s.mutex.RUnlock()
+
+	result := []EpgEvent{}
+
+	if !found {
+		return result
+	}
+
+	if pf[0] != nil && !pf[0].End().Before(now) {
+		result = append(result, *pf[0])
+		if pf[1] != nil {
+			result = append(result, *pf[1])
+		}
+		return result
+	}
+
+	// build from schedule: current event and the one after it
+	for _, event := range s.GetEvents(key, now, time.Time{}) {
+		result = append(result, event)
+		if len(result) == 2 {
+			break
+		}
+	}
+
+	return result
+}
+
+// remove events ended before a given time
+func (s *EpgStore) Expire(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for key, service := range s.services {
+		for id, event := range service.events {
+			if event.End().Before(now) {
+				delete(service.events, id)
+			}
+		}
+
+		if len(service.events) == 0 && service.presentfollowing[0] == nil && service.presentfollowing[1] == nil {
+			delete(s.services, key)
+		}
+	}
+}
+
+// start background removal of past events
+func (s *EpgStore) Start() {
+	s.ticker = time.NewTicker(epgExpiryTick)
+	s.stop = make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case now := <-s.ticker.C:
+				s.Expire(now)
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// stop background removal of past events
+func (s *EpgStore) Stop() {
+	if s.ticker != nil {
+		s.ticker.Stop()
+		close(s.stop)
+		s.ticker = nil
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// wake up requests waiting for files written in a directory by transcoders
+type FileWaiter struct {
+	mutex sync.Mutex
+	dir   string
+	// closed and replaced each time the directory changes
+	changed chan struct{}
+	waiters int
+	// stop watching
+	stop chan struct{}
+}
+
+// create a waiter for files of a directory, directory must exist
+func NewFileWaiter(dir string) *FileWaiter {
+	fw := new(FileWaiter)
+	fw.dir = dir
+	fw.changed = make(chan struct{})
+	fw.stop = make(chan struct{})
+
+	// use file system notification when available, poll otherwise
+	err := watchDirectory(dir, fw.Notify, fw.stop)
+
+	if err != nil {
+		log.Printf("cannot watch directory %s, polling it\n%s\n", dir, err)
+		go fw.poll()
+	}
+
+	return fw
+}
+
+// wake up waiting requests so that they check their file again
+func (fw *FileWaiter) Notify() {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+
+	if fw.waiters == 0 {
+		return
+	}
+
+	close(fw.changed)
+	fw.changed = make(chan struct{})
+}
+
+// notify periodically while requests are waiting
+func (fw *FileWaiter) poll() {
+	ticker := time.NewTicker(fileTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			fw.Notify()
+		case <-fw.stop:
+			return
+		}
+	}
+}
+
+// wait for a file of the directory to exist, false on timeout
+func (fw *FileWaiter) Wait(name string, timeout time.Duration) bool {
+	path := filepath.Join(fw.dir, name)
+
+	fw.mutex.Lock()
+	fw.waiters++
+	fw.mutex.Unlock()
+
+	defer func() {
+		fw.mutex.Lock()
+		fw.waiters--
+		fw.mutex.Unlock()
+	}()
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		// get channel before checking file so that no change is missed
+		fw.mutex.Lock()
+		changed := fw.changed
+		fw.mutex.Unlock()
+
+		_, err := os.Stat(path)
+		if !os.IsNotExist(err) {
+			return true
+		}
+
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return false
+		case <-fw.stop:
+			return false
+		}
+	}
+}
+
+// stop watching, waiting requests return
+func (fw *FileWaiter) Close() {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+
+	select {
+	case <-fw.stop:
+	default:
+		close(fw.stop)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// call notify when a file is created, written or renamed in a directory, until stop is closed
+func watchDirectory(dir string, notify func(), stop chan struct{}) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+
+	_, err = syscall.InotifyAddWatch(fd, dir, syscall.IN_CREATE|syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO)
+	if err != nil {
+		syscall.Close(fd)
+		return err
+	}
+
+	// non blocking descriptor is handled by runtime poller, closing it ends pending read
+	file := os.NewFile(uintptr(fd), "inotify:"+dir)
+
+	go func() {
+		<-stop
+		file.Close()
+	}()
+
+	go func() {
+		buffer := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+
+		for {
+			_, err := file.Read(buffer)
+			if err != nil {
+				return
+			}
+
+			// events (even queue overflow) are only used as a signal, names are checked by waiters
+			notify()
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+// call notify when a file is created, written or renamed in a directory, until stop is closed
+func watchDirectory(dir string, notify func(), stop chan struct{}) error {
+	return errors.New("file system notification not supported")
+}
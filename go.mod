@@ -3,7 +3,7 @@ module server
 go 1.16
 
 require (
-	github.com/Comcast/gots v0.0.0-20220608213207-4c4c4eb78199 // indirect
-	github.com/koron/go-ssdp v0.0.3 // indirect
-	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b // indirect
+	github.com/Comcast/gots v0.0.0-20220608213207-4c4c4eb78199
+	github.com/koron/go-ssdp v0.0.3
+	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 )
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// NAL unit types of H.264 used to build samples
+const (
+	H264NALSlice = 1
+	H264NALIDR   = 5
+	H264NALSEI   = 6
+	H264NALSPS   = 7
+	H264NALPPS   = 8
+	H264NALAUD   = 9
+)
+
+var ErrH264BadSPS = errors.New("invalid H.264 SPS")
+
+// values of a sequence parameter set needed to describe the stream
+type H264SPS struct {
+	Profile              int
+	Constraints          int
+	Level                int
+	ChromaFormat         int
+	BitDepthLumaMinus8   int
+	BitDepthChromaMinus8 int
+	Width                int
+	Height               int
+}
+
+// split an Annex B byte stream in NAL units (without start codes)
+func SplitAnnexB(data []byte) [][]byte {
+	var nals [][]byte
+
+	start := -1
+	zeros := 0
+
+	for i := 0; i < len(data); i++ {
+		if data[i] == 0 {
+			zeros++
+			continue
+		}
+
+		if data[i] == 1 && zeros >= 2 {
+			if start >= 0 {
+				nals = append(nals, data[start:i-zeros])
+			}
+			start = i + 1
+		}
+
+		zeros = 0
+	}
+
+	if start >= 0 && start < len(data) {
+		// trailing zero bytes are not part of the NAL
+		end := len(data)
+		for end > start && data[end-1] == 0 {
+			end--
+		}
+		nals = append(nals, data[start:end])
+	}
+
+	return nals
+}
+
+// remove emulation prevention bytes (00 00 03)
+func h264RBSP(nal []byte) []byte {
+	rbsp := make([]byte, 0, len(nal))
+	zeros := 0
+
+	for _, b := range nal {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+
+		rbsp = append(rbsp, b)
+	}
+
+	return rbsp
+}
+
+// read bits and Exp-Golomb codes from a RBSP
+type h264BitReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *h264BitReader) bit() int {
+	if r.pos >= len(r.data)*8 {
+		r.err = ErrH264BadSPS
+		return 0
+	}
+
+	b := int(r.data[r.pos/8]>>(7-uint(r.pos%8))) & 1
+	r.pos++
+
+	return b
+}
+
+func (r *h264BitReader) bits(n int) int {
+	value := 0
+
+	for i := 0; i < n; i++ {
+		value = value<<1 | r.bit()
+	}
+
+	return value
+}
+
+func (r *h264BitReader) ue() int {
+	zeros := 0
+
+	for r.bit() == 0 && r.err == nil {
+		zeros++
+		if zeros > 31 {
+			r.err = ErrH264BadSPS
+			return 0
+		}
+	}
+
+	return (1 << uint(zeros)) - 1 + r.bits(zeros)
+}
+
+func (r *h264BitReader) se() int {
+	value := r.ue()
+
+	if value&1 != 0 {
+		return (value + 1) / 2
+	}
+
+	return -value / 2
+}
+
+// skip a scaling list of the SPS
+func (r *h264BitReader) skipScalingList(size int) {
+	last, next := 8, 8
+
+	for j := 0; j < size; j++ {
+		if next != 0 {
+			next = (last + r.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+// decode a SPS NAL unit (with NAL header)
+func ParseH264SPS(nal []byte) (*H264SPS, error) {
+	if len(nal) < 4 || nal[0]&0x1F != H264NALSPS {
+		return nil, ErrH264BadSPS
+	}
+
+	sps := new(H264SPS)
+	r := &h264BitReader{data: h264RBSP(nal[1:])}
+
+	sps.Profile = r.bits(8)
+	sps.Constraints = r.bits(8)
+	sps.Level = r.bits(8)
+	r.ue() // seq_parameter_set_id
+
+	sps.ChromaFormat = 1
+	separatecolourplane := 0
+
+	switch sps.Profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		sps.ChromaFormat = r.ue()
+		if sps.ChromaFormat == 3 {
+			separatecolourplane = r.bit()
+		}
+		sps.BitDepthLumaMinus8 = r.ue()
+		sps.BitDepthChromaMinus8 = r.ue()
+		r.bit() // qpprime_y_zero_transform_bypass_flag
+
+		if r.bit() != 0 {
+			lists := 8
+			if sps.ChromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.bit() != 0 {
+					if i < 6 {
+						r.skipScalingList(16)
+					} else {
+						r.skipScalingList(64)
+					}
+				}
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+
+	switch r.ue() {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bit()
+		r.se()
+		r.se()
+		cycle := r.ue()
+		for i := 0; i < cycle && r.err == nil; i++ {
+			r.se()
+		}
+	}
+
+	r.ue()  // max_num_ref_frames
+	r.bit() // gaps_in_frame_num_value_allowed_flag
+
+	widthmbs := r.ue() + 1
+	heightmapunits := r.ue() + 1
+	framembsonly := r.bit()
+
+	if framembsonly == 0 {
+		r.bit() // mb_adaptive_frame_field_flag
+	}
+	r.bit() // direct_8x8_inference_flag
+
+	sps.Width = widthmbs * 16
+	sps.Height = (2 - framembsonly) * heightmapunits * 16
+
+	if r.bit() != 0 {
+		left, right, top, bottom := r.ue(), r.ue(), r.ue(), r.ue()
+
+		// crop units depend on chroma sub sampling
+		cropx, cropy := 1, 2-framembsonly
+		if sps.ChromaFormat != 0 && separatecolourplane == 0 {
+			if sps.ChromaFormat == 1 || sps.ChromaFormat == 2 {
+				cropx = 2
+			}
+			if sps.ChromaFormat == 1 {
+				cropy *= 2
+			}
+		}
+
+		sps.Width -= cropx * (left + right)
+		sps.Height -= cropy * (top + bottom)
+	}
+
+	if r.err != nil || sps.Width <= 0 || sps.Height <= 0 {
+		return nil, ErrH264BadSPS
+	}
+
+	return sps, nil
+}
+
+// check if a slice NAL unit starts an intra coded picture (used for streams without IDR)
+func H264IsIntraSlice(nal []byte) bool {
+	if len(nal) < 2 || nal[0]&0x1F != H264NALSlice {
+		return false
+	}
+
+	r := &h264BitReader{data: h264RBSP(nal[1:])}
+
+	firstmb := r.ue()
+	slicetype := r.ue()
+
+	// slice types 2 and 7 are I slices, 4 and 9 SI slices
+	return r.err == nil && firstmb == 0 && (slicetype%5 == 2 || slicetype%5 == 4)
+}
+
+// RFC 6381 codec string
+func (sps *H264SPS) Codec() string {
+	return fmt.Sprintf("avc1.%02X%02X%02X", sps.Profile, sps.Constraints, sps.Level)
+}
+
+// build an AVC decoder configuration record from one SPS and one PPS
+func H264DecoderConfiguration(sps *H264SPS, spsnal []byte, ppsnal []byte) []byte {
+	record := []byte{1, byte(sps.Profile), byte(sps.Constraints), byte(sps.Level), 0xFF, 0xE1}
+
+	record = append(record, byte(len(spsnal)>>8), byte(len(spsnal)))
+	record = append(record, spsnal...)
+	record = append(record, 1, byte(len(ppsnal)>>8), byte(len(ppsnal)))
+	record = append(record, ppsnal...)
+
+	// high profiles carry chroma format and bit depth
+	switch sps.Profile {
+	case 100, 110, 122, 144:
+		record = append(record, 0xFC|byte(sps.ChromaFormat), 0xF8|byte(sps.BitDepthLumaMinus8), 0xF8|byte(sps.BitDepthChromaMinus8), 0)
+	}
+
+	return record
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseH264SPS(t *testing.T) {
+	tests := []struct {
+		name  string
+		nal   []byte
+		want  H264SPS
+		codec string
+	}{
+		{"baseline 720p", []byte{0x67, 0x42, 0xC0, 0x1F, 0xEC, 0xA0, 0x28, 0x02, 0xDC, 0x80},
+			H264SPS{Profile: 66, Constraints: 0xC0, Level: 31, ChromaFormat: 1, Width: 1280, Height: 720}, "avc1.42C01F"},
+		{"high 1080p cropped", []byte{0x67, 0x64, 0x00, 0x28, 0xAC, 0xD9, 0x40, 0x78, 0x02, 0x27, 0xE5, 0x40},
+			H264SPS{Profile: 100, Constraints: 0, Level: 40, ChromaFormat: 1, Width: 1920, Height: 1080}, "avc1.640028"},
+		{"main 1080i fields", []byte{0x67, 0x4D, 0x40, 0x28, 0xD9, 0x40, 0x78, 0x04, 0x4F, 0xDA},
+			H264SPS{Profile: 77, Constraints: 0x40, Level: 40, ChromaFormat: 1, Width: 1920, Height: 1080}, "avc1.4D4028"},
+		{"main 576p", []byte{0x67, 0x4D, 0x00, 0x1E, 0xEC, 0xA0, 0x5A, 0x09, 0x32},
+			H264SPS{Profile: 77, Constraints: 0, Level: 30, ChromaFormat: 1, Width: 720, Height: 576}, "avc1.4D001E"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sps, err := ParseH264SPS(test.nal)
+			if err != nil {
+				t.Fatalf("ParseH264SPS error = %v", err)
+			}
+
+			if !reflect.DeepEqual(*sps, test.want) {
+				t.Errorf("ParseH264SPS = %+v, want %+v", *sps, test.want)
+			}
+
+			if codec := sps.Codec(); codec != test.codec {
+				t.Errorf("Codec() = %s, want %s", codec, test.codec)
+			}
+		})
+	}
+}
+
+func TestParseH264SPSErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		nal  []byte
+	}{
+		{"not a SPS", []byte{0x68, 0x42, 0xC0, 0x1F, 0xEC, 0xA0, 0x28, 0x02, 0xDC, 0x80}},
+		{"too short", []byte{0x67, 0x42, 0xC0}},
+		{"truncated", []byte{0x67, 0x42, 0xC0, 0x1F, 0xEC}},
+	}
+
+	for _, test := range tests {
+		if _, err := ParseH264SPS(test.nal); err == nil {
+			t.Errorf("%s: ParseH264SPS gave no error", test.name)
+		}
+	}
+}
+
+func TestSplitAnnexB(t *testing.T) {
+	data := []byte{0, 0, 0, 1, 0x09, 0xF0, 0, 0, 1, 0x67, 0x42, 0, 0, 1, 0x65, 0x88, 0x84}
+	want := [][]byte{{0x09, 0xF0}, {0x67, 0x42}, {0x65, 0x88, 0x84}}
+
+	if got := SplitAnnexB(data); !reflect.DeepEqual(got, want) {
+		t.Errorf("SplitAnnexB = % X, want % X", got, want)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"mime"
+	"path/filepath"
+	"strings"
+)
+
+// name of the multivariant playlist, same as the one written by ffmpeg dash muxer with hls_playlist
+const HLSMasterPlaylistName = "master.m3u8"
+
+const HLSContentType = "application/vnd.apple.mpegurl"
+
+func init() {
+	// types not always known by the system, used when serving transcoded content
+	mime.AddExtensionType(".m3u8", HLSContentType)
+	mime.AddExtensionType(".mpd", "application/dash+xml")
+	mime.AddExtensionType(".m4s", "video/iso.segment")
+}
+
+func (track *dashTrack) playlistName() string {
+	return track.name + ".m3u8"
+}
+
+// build media playlist of a track using fMP4 segments of DASH
+func (track *dashTrack) mediaPlaylist() string {
+	var b strings.Builder
+
+	targetduration := 0
+	for _, segment := range track.segments {
+		seconds := int(math.Ceil(float64(segment.duration) / float64(track.timescale)))
+		if seconds > targetduration {
+			targetduration = seconds
+		}
+	}
+
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:7\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", targetduration)
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", int(track.sequence)-len(track.segments))
+	b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"%s\"\n", track.initName())
+
+	for _, segment := range track.segments {
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n", float64(segment.duration)/float64(track.timescale))
+		fmt.Fprintf(&b, "%s\n", track.segmentName(segment.time))
+	}
+
+	return b.String()
+}
+
+// build multivariant playlist referencing video and audio playlists
+func (p *DashPackager) masterPlaylist() string {
+	var b strings.Builder
+
+	codecs := p.video.codec
+	bandwidth := p.video.bandwidth()
+
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:7\n")
+	b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+
+	audio := ""
+
+	if len(p.audio.segments) > 0 {
+		language := p.audio.language
+		if language == "" {
+			language = "und"
+		}
+
+		fmt.Fprintf(&b, "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",NAME=\"%s\",LANGUAGE=\"%s\",DEFAULT=YES,AUTOSELECT=YES,CHANNELS=\"%d\",URI=\"%s\"\n",
+			language, language, p.audio.channels, p.audio.playlistName())
+
+		codecs += "," + p.audio.codec
+		bandwidth += p.audio.bandwidth()
+		audio = ",AUDIO=\"audio\""
+	}
+
+	fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=\"%s\",RESOLUTION=%dx%d%s\n", bandwidth, codecs, p.video.width, p.video.height, audio)
+	fmt.Fprintf(&b, "%s\n", p.video.playlistName())
+
+	return b.String()
+}
+
+// write HLS playlists describing available segments
+func (p *DashPackager) writePlaylists() {
+	if len(p.video.segments) == 0 {
+		return
+	}
+
+	err := writeFileAtomic(filepath.Join(p.outputdir, p.video.playlistName()), []byte(p.video.mediaPlaylist()))
+
+	if err == nil && len(p.audio.segments) > 0 {
+		err = writeFileAtomic(filepath.Join(p.outputdir, p.audio.playlistName()), []byte(p.audio.mediaPlaylist()))
+	}
+
+	if err == nil {
+		err = writeFileAtomic(filepath.Join(p.outputdir, HLSMasterPlaylistName), []byte(p.masterPlaylist()))
+	}
+
+	if err != nil {
+		log.Printf("DASH packager cannot write HLS playlists: %s\n", err)
+	}
+}
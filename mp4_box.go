@@ -0,0 +1,286 @@
+package main
+
+// sample flags of fragmented MP4 (ISO/IEC 14496-12 8.8.3.1)
+const (
+	mp4SampleFlagsSync    = 0x02000000
+	mp4SampleFlagsNonSync = 0x01010000
+)
+
+// one sample of a fragment
+type MP4Sample struct {
+	// decode time in track timescale
+	DecodeTime int64
+	Duration   uint32
+	// presentation time minus decode time
+	CompositionOffset int32
+	Sync              bool
+	Data              []byte
+}
+
+// description of the single track of an init segment
+type MP4Track struct {
+	// "vide" or "soun"
+	Handler   string
+	Timescale int
+	Language  string
+	// sample entry box (avc1 or mp4a)
+	SampleEntry []byte
+	Width       int
+	Height      int
+}
+
+func be16(b []byte, v int) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func be32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func be64(b []byte, v uint64) []byte {
+	return be32(be32(b, uint32(v>>32)), uint32(v))
+}
+
+// build a box from its type and content
+func mp4Box(boxtype string, content ...[]byte) []byte {
+	size := 8
+	for _, c := range content {
+		size += len(c)
+	}
+
+	box := make([]byte, 0, size)
+	box = be32(box, uint32(size))
+	box = append(box, boxtype...)
+
+	for _, c := range content {
+		box = append(box, c...)
+	}
+
+	return box
+}
+
+// build a full box (with version and flags)
+func mp4FullBox(boxtype string, version int, flags uint32, content ...[]byte) []byte {
+	header := be32(nil, uint32(version)<<24|flags&0xFFFFFF)
+
+	return mp4Box(boxtype, append([][]byte{header}, content...)...)
+}
+
+// unity matrix of movie and track headers
+func mp4Matrix() []byte {
+	var b []byte
+
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		b = be32(b, v)
+	}
+
+	return b
+}
+
+// ISO 639-2 language packed in 15 bits, "und" if not valid
+func mp4Language(language string) int {
+	if len(language) != 3 {
+		language = "und"
+	}
+
+	value := 0
+	for i := 0; i < 3; i++ {
+		c := language[i]
+		if c < 'a' || c > 'z' {
+			return mp4Language("und")
+		}
+		value = value<<5 | int(c-0x60)
+	}
+
+	return value
+}
+
+// build avc1 sample entry
+func MP4AVCSampleEntry(width int, height int, config []byte) []byte {
+	b := make([]byte, 6)
+	b = be16(b, 1) // data reference index
+	b = append(b, make([]byte, 16)...)
+	b = be16(b, width)
+	b = be16(b, height)
+	b = be32(b, 0x00480000)
+	b = be32(b, 0x00480000)
+	b = be32(b, 0)
+	b = be16(b, 1) // frame count
+	b = append(b, make([]byte, 32)...)
+	b = be16(b, 0x0018)
+	b = be16(b, 0xFFFF)
+
+	return mp4Box("avc1", b, mp4Box("avcC", config))
+}
+
+// MPEG-4 descriptor with one byte length
+func mp4Descriptor(tag byte, content ...[]byte) []byte {
+	size := 0
+	for _, c := range content {
+		size += len(c)
+	}
+
+	d := []byte{tag, byte(size)}
+	for _, c := range content {
+		d = append(d, c...)
+	}
+
+	return d
+}
+
+// build mp4a sample entry
+func MP4AACSampleEntry(config AACConfig) []byte {
+	b := make([]byte, 6)
+	b = be16(b, 1) // data reference index
+	b = append(b, make([]byte, 8)...)
+	b = be16(b, config.Channels)
+	b = be16(b, 16)
+	b = be32(b, 0)
+	b = be32(b, uint32(config.SampleRate)<<16)
+
+	decoderconfig := []byte{0x40, 0x15, 0, 0, 0}
+	decoderconfig = be32(decoderconfig, 0)
+	decoderconfig = be32(decoderconfig, 0)
+
+	esdescriptor := mp4Descriptor(0x03, []byte{0, 1, 0},
+		mp4Descriptor(0x04, decoderconfig, mp4Descriptor(0x05, config.AudioSpecificConfig())),
+		mp4Descriptor(0x06, []byte{0x02}))
+
+	return mp4Box("mp4a", b, mp4FullBox("esds", 0, 0, esdescriptor))
+}
+
+// build an init segment for one track
+func MP4InitSegment(track MP4Track) []byte {
+	ftyp := mp4Box("ftyp", []byte("iso6"), be32(nil, 0), []byte("iso6isomdashmp41"))
+
+	mvhd := be32(nil, 0)
+	mvhd = be32(mvhd, 0)
+	mvhd = be32(mvhd, 1000)
+	mvhd = be32(mvhd, 0)
+	mvhd = be32(mvhd, 0x00010000)
+	mvhd = be16(mvhd, 0x0100)
+	mvhd = append(mvhd, make([]byte, 10)...)
+	mvhd = append(mvhd, mp4Matrix()...)
+	mvhd = append(mvhd, make([]byte, 24)...)
+	mvhd = be32(mvhd, 2) // next track id
+
+	volume := 0
+	if track.Handler == "soun" {
+		volume = 0x0100
+	}
+
+	tkhd := be32(nil, 0)
+	tkhd = be32(tkhd, 0)
+	tkhd = be32(tkhd, 1) // track id
+	tkhd = be32(tkhd, 0)
+	tkhd = be32(tkhd, 0)
+	tkhd = append(tkhd, make([]byte, 8)...)
+	tkhd = be16(tkhd, 0)
+	tkhd = be16(tkhd, 0)
+	tkhd = be16(tkhd, volume)
+	tkhd = be16(tkhd, 0)
+	tkhd = append(tkhd, mp4Matrix()...)
+	tkhd = be32(tkhd, uint32(track.Width)<<16)
+	tkhd = be32(tkhd, uint32(track.Height)<<16)
+
+	mdhd := be32(nil, 0)
+	mdhd = be32(mdhd, 0)
+	mdhd = be32(mdhd, uint32(track.Timescale))
+	mdhd = be32(mdhd, 0)
+	mdhd = be16(mdhd, mp4Language(track.Language))
+	mdhd = be16(mdhd, 0)
+
+	name := "VideoHandler"
+	mediaheader := mp4FullBox("vmhd", 0, 1, make([]byte, 8))
+	if track.Handler == "soun" {
+		name = "SoundHandler"
+		mediaheader = mp4FullBox("smhd", 0, 0, make([]byte, 4))
+	}
+
+	hdlr := be32(nil, 0)
+	hdlr = append(hdlr, track.Handler...)
+	hdlr = append(hdlr, make([]byte, 12)...)
+	hdlr = append(hdlr, name...)
+	hdlr = append(hdlr, 0)
+
+	dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, be32(nil, 1), mp4FullBox("url ", 0, 1)))
+
+	stbl := mp4Box("stbl",
+		mp4FullBox("stsd", 0, 0, be32(nil, 1), track.SampleEntry),
+		mp4FullBox("stts", 0, 0, be32(nil, 0)),
+		mp4FullBox("stsc", 0, 0, be32(nil, 0)),
+		mp4FullBox("stsz", 0, 0, be32(nil, 0), be32(nil, 0)),
+		mp4FullBox("stco", 0, 0, be32(nil, 0)))
+
+	trak := mp4Box("trak",
+		mp4FullBox("tkhd", 0, 3, tkhd),
+		mp4Box("mdia",
+			mp4FullBox("mdhd", 0, 0, mdhd),
+			mp4FullBox("hdlr", 0, 0, hdlr),
+			mp4Box("minf", mediaheader, dinf, stbl)))
+
+	trex := be32(nil, 1)
+	trex = be32(trex, 1)
+	trex = be32(trex, 0)
+	trex = be32(trex, 0)
+	trex = be32(trex, 0)
+
+	moov := mp4Box("moov", mp4FullBox("mvhd", 0, 0, mvhd), trak, mp4Box("mvex", mp4FullBox("trex", 0, 0, trex)))
+
+	return append(ftyp, moov...)
+}
+
+// build moof box, data offset is relative to moof start
+func mp4MovieFragment(sequence uint32, samples []MP4Sample, dataoffset int) []byte {
+	// data offset, duration, size, flags and composition offset present
+	trunflags := uint32(0x000001 | 0x000100 | 0x000200 | 0x000400 | 0x000800)
+
+	trun := be32(nil, uint32(len(samples)))
+	trun = be32(trun, uint32(dataoffset))
+
+	for _, sample := range samples {
+		flags := uint32(mp4SampleFlagsNonSync)
+		if sample.Sync {
+			flags = mp4SampleFlagsSync
+		}
+
+		trun = be32(trun, sample.Duration)
+		trun = be32(trun, uint32(len(sample.Data)))
+		trun = be32(trun, flags)
+		trun = be32(trun, uint32(sample.CompositionOffset))
+	}
+
+	return mp4Box("moof",
+		mp4FullBox("mfhd", 0, 0, be32(nil, sequence)),
+		mp4Box("traf",
+			// default-base-is-moof
+			mp4FullBox("tfhd", 0, 0x020000, be32(nil, 1)),
+			mp4FullBox("tfdt", 1, 0, be64(nil, uint64(samples[0].DecodeTime))),
+			mp4FullBox("trun", 1, trunflags, trun)))
+}
+
+// build a media segment holding samples, durations must be set
+func MP4MediaSegment(sequence uint32, samples []MP4Sample) []byte {
+	size := 0
+	for _, sample := range samples {
+		size += len(sample.Data)
+	}
+
+	// moof size does not depend on data offset value
+	moof := mp4MovieFragment(sequence, samples, 0)
+	moof = mp4MovieFragment(sequence, samples, len(moof)+8)
+
+	styp := mp4Box("styp", []byte("msdh"), be32(nil, 0), []byte("msdh"))
+
+	segment := make([]byte, 0, len(styp)+len(moof)+8+size)
+	segment = append(segment, styp...)
+	segment = append(segment, moof...)
+	segment = be32(segment, uint32(8+size))
+	segment = append(segment, "mdat"...)
+
+	for _, sample := range samples {
+		segment = append(segment, sample.Data...)
+	}
+
+	return segment
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// boxes holding only other boxes
+var mp4Containers = map[string]bool{"moov": true, "trak": true, "mdia": true, "minf": true, "dinf": true, "stbl": true, "mvex": true, "moof": true, "traf": true}
+
+// outline of a box tree like "moov[mvhd trak[...]]", sizes must add up exactly
+func mp4Outline(t *testing.T, data []byte) string {
+	var names []string
+
+	for len(data) > 0 {
+		if len(data) < 8 {
+			t.Fatalf("%d bytes left, too short for a box header", len(data))
+		}
+
+		size := int(binary.BigEndian.Uint32(data))
+		name := string(data[4:8])
+
+		if size < 8 || size > len(data) {
+			t.Fatalf("box %s has size %d, %d bytes left", name, size, len(data))
+		}
+
+		if mp4Containers[name] {
+			name += "[" + mp4Outline(t, data[8:size]) + "]"
+		}
+
+		names = append(names, name)
+		data = data[size:]
+	}
+
+	return strings.Join(names, " ")
+}
+
+// find content of a box by path of types
+func mp4Find(data []byte, path ...string) []byte {
+	for len(data) >= 8 {
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			return nil
+		}
+
+		if string(data[4:8]) == path[0] {
+			if len(path) == 1 {
+				return data[8:size]
+			}
+			return mp4Find(data[8:size], path[1:]...)
+		}
+
+		data = data[size:]
+	}
+
+	return nil
+}
+
+func TestMP4InitSegment(t *testing.T) {
+	tests := []struct {
+		name    string
+		track   MP4Track
+		outline string
+	}{
+		{"video", MP4Track{Handler: "vide", Timescale: 90000, Width: 1280, Height: 720, SampleEntry: MP4AVCSampleEntry(1280, 720, []byte{1, 0x42, 0xC0, 0x1F})},
+			"ftyp moov[mvhd trak[tkhd mdia[mdhd hdlr minf[vmhd dinf[dref] stbl[stsd stts stsc stsz stco]]]] mvex[trex]]"},
+		{"audio", MP4Track{Handler: "soun", Timescale: 48000, Language: "ita", SampleEntry: MP4AACSampleEntry(AACConfig{ObjectType: 2, SampleRateIndex: 3, SampleRate: 48000, Channels: 2})},
+			"ftyp moov[mvhd trak[tkhd mdia[mdhd hdlr minf[smhd dinf[dref] stbl[stsd stts stsc stsz stco]]]] mvex[trex]]"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			init := MP4InitSegment(test.track)
+
+			if outline := mp4Outline(t, init); outline != test.outline {
+				t.Errorf("outline = %s\nwant %s", outline, test.outline)
+			}
+
+			// timescale follows version, flags and creation and modification times
+			mdhd := mp4Find(init, "moov", "trak", "mdia", "mdhd")
+			if len(mdhd) < 16 || binary.BigEndian.Uint32(mdhd[12:]) != uint32(test.track.Timescale) {
+				t.Errorf("mdhd does not give timescale %d", test.track.Timescale)
+			}
+		})
+	}
+}
+
+func TestMP4MediaSegment(t *testing.T) {
+	samples := []MP4Sample{
+		{DecodeTime: 180000, Duration: 3600, CompositionOffset: 7200, Sync: true, Data: []byte{1, 2, 3}},
+		{DecodeTime: 183600, Duration: 3600, Data: []byte{4, 5}},
+	}
+
+	segment := MP4MediaSegment(7, samples)
+
+	if outline := mp4Outline(t, segment); outline != "styp moof[mfhd traf[tfhd tfdt trun]] mdat" {
+		t.Fatalf("outline = %s", outline)
+	}
+
+	if mfhd := mp4Find(segment, "moof", "mfhd"); binary.BigEndian.Uint32(mfhd[4:]) != 7 {
+		t.Errorf("sequence = %d, want 7", binary.BigEndian.Uint32(mfhd[4:]))
+	}
+
+	if tfdt := mp4Find(segment, "moof", "traf", "tfdt"); binary.BigEndian.Uint64(tfdt[4:]) != 180000 {
+		t.Errorf("base media decode time = %d, want 180000", binary.BigEndian.Uint64(tfdt[4:]))
+	}
+
+	// data offset of trun is relative to moof and points to mdat payload
+	trun := mp4Find(segment, "moof", "traf", "trun")
+	if count := binary.BigEndian.Uint32(trun[4:]); count != 2 {
+		t.Errorf("sample count = %d, want 2", count)
+	}
+
+	moofstart := len(mp4Box("styp", []byte("msdh"), be32(nil, 0), []byte("msdh")))
+	offset := int(binary.BigEndian.Uint32(trun[8:]))
+
+	if got := segment[moofstart+offset:]; string(got) != string([]byte{1, 2, 3, 4, 5}) {
+		t.Errorf("data offset %d gives % X, want samples data", offset, got)
+	}
+
+	// first sample: duration, size, sync flags and composition offset
+	first := trun[12:28]
+	if binary.BigEndian.Uint32(first) != 3600 || binary.BigEndian.Uint32(first[4:]) != 3 ||
+		binary.BigEndian.Uint32(first[8:]) != mp4SampleFlagsSync || binary.BigEndian.Uint32(first[12:]) != 7200 {
+		t.Errorf("first sample entry = % X", first)
+	}
+}
@@ -1,20 +1,140 @@
 package main
 
 import (
+	"sync"
+
 	"github.com/Comcast/gots/packet"
 )
 
+// number of PIDs in a transport stream
+const MpegPIDCount = 8192
+
 // interface to parse a packet
 type MpegPIDParser interface {
 	ParsePacket(pkt packet.Packet)
 }
 
-// parsing 
+// parsing of PSI/SI sections carried on a PID
 type MpegPIDPSIParser struct {
+	reconstructor *MpegSectionReconstructor
 }
 
+// create a PSI parser calling handler for each complete section
+func NewMpegPIDPSIParser(maxsectionsize int, handler MpegSectionHandler) *MpegPIDPSIParser {
+	p := new(MpegPIDPSIParser)
+	p.reconstructor = NewMpegSectionReconstructor(maxsectionsize, handler)
 
+	return p
+}
 
+func (p *MpegPIDPSIParser) ParsePacket(pkt packet.Packet) {
+	p.reconstructor.ParsePacket(&pkt)
+}
 
+// get the section reconstructor (for statistics)
+func (p *MpegPIDPSIParser) GetReconstructor() *MpegSectionReconstructor {
+	return p.reconstructor
+}
+
+// route packets to the parsers registered for their PID
 type MpegDemux struct {
-}
\ No newline at end of file
+	// protect parsers and counters, parsers can change while stream is running
+	mutex sync.Mutex
+	// parsers for each PID, slices are replaced (never modified) so they can be used outside lock
+	parsers map[int][]MpegPIDParser
+	// number of packets received for each PID
+	counters [MpegPIDCount]uint64
+}
+
+func NewMpegDemux() *MpegDemux {
+	d := new(MpegDemux)
+	d.parsers = make(map[int][]MpegPIDParser)
+
+	return d
+}
+
+// register a parser for a PID (several parsers can share a PID)
+func (d *MpegDemux) AddParser(pid int, parser MpegPIDParser) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	current := d.parsers[pid]
+	updated := make([]MpegPIDParser, len(current), len(current)+1)
+	copy(updated, current)
+	d.parsers[pid] = append(updated, parser)
+}
+
+// unregister a parser from a PID
+func (d *MpegDemux) RemoveParser(pid int, parser MpegPIDParser) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	current := d.parsers[pid]
+	updated := make([]MpegPIDParser, 0, len(current))
+
+	for _, p := range current {
+		if p != parser {
+			updated = append(updated, p)
+		}
+	}
+
+	if len(updated) == 0 {
+		delete(d.parsers, pid)
+	} else {
+		d.parsers[pid] = updated
+	}
+}
+
+// unregister all parsers from a PID
+func (d *MpegDemux) RemovePID(pid int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	delete(d.parsers, pid)
+}
+
+// send one packet to parsers of its PID
+func (d *MpegDemux) ProcessPacket(pkt packet.Packet) {
+	pid := pkt.PID()
+
+	d.mutex.Lock()
+	d.counters[pid]++
+	parsers := d.parsers[pid]
+	d.mutex.Unlock()
+
+	// call parsers without lock so that they can add or remove parsers
+	for _, p := range parsers {
+		p.ParsePacket(pkt)
+	}
+}
+
+// process all packets of a channel until it is closed
+func (d *MpegDemux) Run(c MpegTSChannel) {
+	for pkt := range c {
+		d.ProcessPacket(pkt)
+	}
+}
+
+// get number of received packets for each PID present in the stream
+func (d *MpegDemux) GetPacketCounts() map[int]uint64 {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	counts := make(map[int]uint64)
+
+	for pid, count := range d.counters {
+		if count != 0 {
+			counts[pid] = count
+		}
+	}
+
+	return counts
+}
+
+// clear packet counters (for instance after a new tune)
+func (d *MpegDemux) ResetCounters() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.counters = [MpegPIDCount]uint64{}
+}
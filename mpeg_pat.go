@@ -0,0 +1,48 @@
+package main
+
+// one entry of the program association table
+type MpegPATEntry struct {
+	ProgramNumber int
+	PID           int
+}
+
+// content of one PAT section
+type MpegPAT struct {
+	TransportStreamID int
+	Version           int
+	// PID of the NIT if announced (program number 0), 0 otherwise
+	NetworkPID int
+	Programs   []MpegPATEntry
+	Section    *MpegLongSection
+}
+
+// decode a PAT section
+func ParsePAT(section []byte) (*MpegPAT, error) {
+	s, err := ParseMpegLongSection(section)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if s.TableID != TableIDPAT {
+		return nil, ErrWrongTableID
+	}
+
+	pat := new(MpegPAT)
+	pat.TransportStreamID = s.TableIDExtension
+	pat.Version = s.Version
+	pat.Section = s
+
+	for data := s.Payload; len(data) >= 4; data = data[4:] {
+		number := int(data[0])<<8 | int(data[1])
+		pid := int(data[2]&0x1F)<<8 | int(data[3])
+
+		if number == 0 {
+			pat.NetworkPID = pid
+		} else {
+			pat.Programs = append(pat.Programs, MpegPATEntry{ProgramNumber: number, PID: pid})
+		}
+	}
+
+	return pat, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/Comcast/gots/packet"
+)
+
+// value of PTS and DTS when not present in PES header
+const MpegNoTimestamp int64 = -1
+
+// PTS and DTS are 33 bits counters at 90kHz
+const (
+	MpegTimestampClock = 90000
+	mpegTimestampWrap  = int64(1) << 33
+)
+
+var ErrPESNoStartCode = errors.New("PES start code not found")
+var ErrPESTooShort = errors.New("PES too short")
+
+// a complete PES packet
+type MpegPES struct {
+	StreamID int
+	PTS      int64
+	DTS      int64
+	// discontinuity indicator was set in a packet of the PES, timestamps restart from a new clock
+	Discontinuity bool
+	// payload after PES header
+	Data []byte
+}
+
+// decode a 33 bits timestamp
+func decodeMpegTimestamp(data []byte) int64 {
+	return int64(data[0]>>1&0x07)<<30 | int64(data[1])<<22 | int64(data[2]>>1)<<15 | int64(data[3])<<7 | int64(data[4]>>1)
+}
+
+// decode a PES packet, DTS is set to PTS if absent
+func ParsePES(data []byte) (*MpegPES, error) {
+	if len(data) < 6 {
+		return nil, ErrPESTooShort
+	}
+
+	if data[0] != 0 || data[1] != 0 || data[2] != 1 {
+		return nil, ErrPESNoStartCode
+	}
+
+	pes := new(MpegPES)
+	pes.StreamID = int(data[3])
+	pes.PTS = MpegNoTimestamp
+	pes.DTS = MpegNoTimestamp
+
+	// known length lets us remove trailing stuffing of the last packet
+	length := int(data[4])<<8 | int(data[5])
+	if length != 0 && 6+length < len(data) {
+		data = data[:6+length]
+	}
+
+	// streams without the optional header (padding, private stream 2, ...)
+	switch pes.StreamID {
+	case 0xBC, 0xBE, 0xBF, 0xF0, 0xF1, 0xF2, 0xF8, 0xFF:
+		pes.Data = data[6:]
+		return pes, nil
+	}
+
+	if len(data) < 9 {
+		return nil, ErrPESTooShort
+	}
+
+	headerlength := int(data[8])
+
+	if 9+headerlength > len(data) {
+		return nil, ErrPESTooShort
+	}
+
+	switch data[7] >> 6 {
+	case 2:
+		if headerlength >= 5 {
+			pes.PTS = decodeMpegTimestamp(data[9:14])
+			pes.DTS = pes.PTS
+		}
+	case 3:
+		if headerlength >= 10 {
+			pes.PTS = decodeMpegTimestamp(data[9:14])
+			pes.DTS = decodeMpegTimestamp(data[14:19])
+		}
+	}
+
+	pes.Data = data[9+headerlength:]
+
+	return pes, nil
+}
+
+// process complete PES packets
+type MpegPESHandler func(pes *MpegPES)
+
+// rebuild PES packets of one PID
+type MpegPIDPESParser struct {
+	handler MpegPESHandler
+	buffer  []byte
+	// total size of current PES, 0 if unbounded (video)
+	expected int
+	lastcc   int
+	// discontinuity indicator seen in current PES
+	discontinuity bool
+
+	// stats
+	PESCount        uint64
+	Discontinuities uint64
+}
+
+func NewMpegPIDPESParser(handler MpegPESHandler) *MpegPIDPESParser {
+	p := new(MpegPIDPESParser)
+	p.handler = handler
+	p.lastcc = -1
+
+	return p
+}
+
+// drop current PES
+func (p *MpegPIDPESParser) Reset() {
+	p.buffer = nil
+	p.expected = 0
+	p.discontinuity = false
+}
+
+// send current PES to handler if valid
+func (p *MpegPIDPESParser) deliver() {
+	data := p.buffer
+	discontinuity := p.discontinuity
+	p.Reset()
+
+	if data == nil {
+		return
+	}
+
+	pes, err := ParsePES(data)
+
+	if err != nil {
+		return
+	}
+
+	pes.Discontinuity = discontinuity
+
+	p.PESCount++
+	p.handler(pes)
+}
+
+func (p *MpegPIDPESParser) ParsePacket(pkt packet.Packet) {
+	if pkt.TransportErrorIndicator() {
+		p.Reset()
+		return
+	}
+
+	if !pkt.HasPayload() {
+		return
+	}
+
+	cc := pkt.ContinuityCounter()
+	discontinuity := hasDiscontinuityIndicator(pkt)
+
+	if p.lastcc >= 0 && !discontinuity {
+		if cc == p.lastcc {
+			return
+		}
+
+		if cc != (p.lastcc+1)&0x0F {
+			p.Discontinuities++
+			p.Reset()
+		}
+	}
+	p.lastcc = cc
+
+	payload, err := pkt.Payload()
+
+	if err != nil {
+		return
+	}
+
+	if pkt.PayloadUnitStartIndicator() {
+		// start of a new PES ends an unbounded one
+		p.deliver()
+		p.buffer = make([]byte, 0, 4096)
+	} else if p.buffer == nil {
+		// wait for start of a PES
+		return
+	}
+
+	p.discontinuity = p.discontinuity || discontinuity
+
+	p.buffer = append(p.buffer, payload...)
+
+	if p.expected == 0 && len(p.buffer) >= 6 {
+		if length := int(p.buffer[4])<<8 | int(p.buffer[5]); length != 0 {
+			p.expected = 6 + length
+		}
+	}
+
+	// bounded PES can be delivered without waiting for next one
+	if p.expected != 0 && len(p.buffer) >= p.expected {
+		p.deliver()
+	}
+}
+
+// check discontinuity_indicator of the adaptation field, continuity counter and time base may restart
+func hasDiscontinuityIndicator(pkt packet.Packet) bool {
+	return pkt[3]&0x20 != 0 && pkt[4] > 0 && pkt[5]&0x80 != 0
+}
+
+// make PTS/DTS monotonic by removing 33 bits wrap around
+type MpegTimestampUnwrapper struct {
+	last   int64
+	offset int64
+	valid  bool
+}
+
+func (u *MpegTimestampUnwrapper) Unwrap(ts int64) int64 {
+	if u.valid {
+		diff := ts - u.last
+
+		if diff < -mpegTimestampWrap/2 {
+			u.offset += mpegTimestampWrap
+		} else if diff > mpegTimestampWrap/2 {
+			u.offset -= mpegTimestampWrap
+		}
+	}
+
+	u.last = ts
+	u.valid = true
+
+	return ts + u.offset
+}
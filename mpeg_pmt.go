@@ -0,0 +1,157 @@
+package main
+
+import (
+	"strings"
+)
+
+// stream types from ISO/IEC 13818-1 used to classify elementary streams
+const (
+	StreamTypeMPEG1Video = 0x01
+	StreamTypeMPEG2Video = 0x02
+	StreamTypeMPEG1Audio = 0x03
+	StreamTypeMPEG2Audio = 0x04
+	StreamTypePrivate    = 0x06
+	StreamTypeADTSAAC    = 0x0F
+	StreamTypeMPEG4Video = 0x10
+	StreamTypeLATMAAC    = 0x11
+	StreamTypeH264       = 0x1B
+	StreamTypeHEVC       = 0x24
+	StreamTypeAC3        = 0x81
+	StreamTypeEAC3       = 0x87
+)
+
+// descriptor tags used in PMT
+const (
+	DescriptorISO639Language = 0x0A
+	DescriptorTeletext       = 0x56
+	DescriptorSubtitling     = 0x59
+	DescriptorAC3            = 0x6A
+	DescriptorEAC3           = 0x7A
+	DescriptorAAC            = 0x7C
+)
+
+// an elementary stream of a program
+type MpegElementaryStream struct {
+	StreamType  int
+	PID         int
+	Languages   []string
+	Descriptors []MpegDescriptor
+}
+
+// content of a PMT section
+type MpegPMT struct {
+	ProgramNumber int
+	Version       int
+	PCRPID        int
+	Descriptors   []MpegDescriptor
+	Streams       []MpegElementaryStream
+}
+
+// decode a PMT section
+func ParsePMT(section []byte) (*MpegPMT, error) {
+	s, err := ParseMpegLongSection(section)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if s.TableID != TableIDPMT {
+		return nil, ErrWrongTableID
+	}
+
+	if len(s.Payload) < 2 {
+		return nil, ErrSectionTooShort
+	}
+
+	pmt := new(MpegPMT)
+	pmt.ProgramNumber = s.TableIDExtension
+	pmt.Version = s.Version
+	pmt.PCRPID = int(s.Payload[0]&0x1F)<<8 | int(s.Payload[1])
+
+	programinfo, data, err := splitMpegLoop(s.Payload[2:])
+
+	if err != nil {
+		return nil, err
+	}
+
+	pmt.Descriptors = ParseMpegDescriptors(programinfo)
+
+	// elementary stream loop
+	for len(data) >= 5 {
+		var es MpegElementaryStream
+		var esinfo []byte
+
+		es.StreamType = int(data[0])
+		es.PID = int(data[1]&0x1F)<<8 | int(data[2])
+
+		esinfo, data, err = splitMpegLoop(data[3:])
+
+		if err != nil {
+			return nil, err
+		}
+
+		es.Descriptors = ParseMpegDescriptors(esinfo)
+		es.Languages = mpegDescriptorLanguages(es.Descriptors)
+
+		pmt.Streams = append(pmt.Streams, es)
+	}
+
+	return pmt, nil
+}
+
+// extract languages from ISO 639, teletext and subtitling descriptors
+func mpegDescriptorLanguages(descriptors []MpegDescriptor) []string {
+	languages := []string{}
+
+	for _, d := range descriptors {
+		// size of one entry in the descriptor loop
+		entrysize := 0
+
+		switch d.Tag {
+		case DescriptorISO639Language:
+			entrysize = 4
+		case DescriptorTeletext:
+			entrysize = 5
+		case DescriptorSubtitling:
+			entrysize = 8
+		default:
+			continue
+		}
+
+		for data := d.Data; len(data) >= entrysize; data = data[entrysize:] {
+			languages = append(languages, strings.ToLower(string(data[0:3])))
+		}
+	}
+
+	return languages
+}
+
+// check if a descriptor is present on the stream
+func (es *MpegElementaryStream) HasDescriptor(tag int) bool {
+	for _, d := range es.Descriptors {
+		if d.Tag == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// kind of content carried by the stream: video, audio, subtitle or data
+func (es *MpegElementaryStream) Kind() string {
+	switch es.StreamType {
+	case StreamTypeMPEG1Video, StreamTypeMPEG2Video, StreamTypeMPEG4Video, StreamTypeH264, StreamTypeHEVC:
+		return "video"
+	case StreamTypeMPEG1Audio, StreamTypeMPEG2Audio, StreamTypeADTSAAC, StreamTypeLATMAAC, StreamTypeAC3, StreamTypeEAC3:
+		return "audio"
+	case StreamTypePrivate:
+		if es.HasDescriptor(DescriptorAC3) || es.HasDescriptor(DescriptorEAC3) || es.HasDescriptor(DescriptorAAC) {
+			return "audio"
+		}
+		if es.HasDescriptor(DescriptorSubtitling) || es.HasDescriptor(DescriptorTeletext) {
+			return "subtitle"
+		}
+	}
+
+	return "data"
+}
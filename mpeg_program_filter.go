@@ -0,0 +1,166 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Comcast/gots/packet"
+)
+
+// PID of null packets, never part of a program
+const PIDNull = 0x1FFF
+
+// select packets of one program of a multiplex and rebuild a single program transport stream
+type MpegProgramFilter struct {
+	// program number or service name, empty to forward the whole multiplex
+	selector string
+	programs *MpegProgramTracker
+	services *DvbServiceTracker
+
+	// selected program, 0 until PAT, PMT (and SDT for names) are received
+	program int
+	pmtpid  int
+	pids    [MpegPIDCount]bool
+
+	// generated PAT
+	patversion int
+	patcc      int
+
+	output MpegTSChannel
+	// packets dropped because the output was full (updated atomically)
+	dropped uint64
+}
+
+// create a filter using tables collected by trackers of the multiplex
+func NewMpegProgramFilter(selector string, programs *MpegProgramTracker, services *DvbServiceTracker) *MpegProgramFilter {
+	f := new(MpegProgramFilter)
+	f.selector = selector
+	f.programs = programs
+	f.services = services
+	f.output = make(MpegTSChannel, 128)
+
+	return f
+}
+
+// get channel receiving filtered packets, closed when filter is removed from its session
+func (f *MpegProgramFilter) GetOutputPipe() MpegTSChannel {
+	return f.output
+}
+
+// number of packets dropped because the consumer of the output was too slow
+func (f *MpegProgramFilter) Dropped() uint64 {
+	return atomic.LoadUint64(&f.dropped)
+}
+
+// send a packet without blocking the multiplex, a full output drops the packet
+func (f *MpegProgramFilter) send(pkt packet.Packet) {
+	select {
+	case f.output <- pkt:
+	default:
+		atomic.AddUint64(&f.dropped, 1)
+	}
+}
+
+// service names are compared without case and blanks (as tsp zap does)
+func normalizeServiceName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), ""))
+}
+
+// find the selected program in current tables
+func (f *MpegProgramFilter) resolve() (MpegProgram, bool) {
+	if number, err := strconv.Atoi(f.selector); err == nil {
+		return f.programs.GetProgram(number)
+	}
+
+	name := normalizeServiceName(f.selector)
+
+	for _, program := range f.programs.GetPrograms() {
+		service, found := f.services.GetActualService(program.ProgramNumber)
+
+		if found && normalizeServiceName(service.Name) == name {
+			return program, true
+		}
+	}
+
+	return MpegProgram{}, false
+}
+
+// update selected PIDs from current tables
+func (f *MpegProgramFilter) update() {
+	f.pids = [MpegPIDCount]bool{}
+
+	program, found := f.resolve()
+
+	if !found || program.Version < 0 {
+		f.program = 0
+		return
+	}
+
+	// a different program or PMT PID is a new PAT version
+	if program.ProgramNumber != f.program || program.PMTPID != f.pmtpid {
+		f.patversion = (f.patversion + 1) & 0x1F
+		f.program = program.ProgramNumber
+		f.pmtpid = program.PMTPID
+	}
+
+	f.pids[program.PMTPID] = true
+
+	if program.PCRPID != PIDNull {
+		f.pids[program.PCRPID] = true
+	}
+
+	for _, es := range program.Streams {
+		f.pids[es.PID] = true
+	}
+}
+
+// build a PAT packet listing only the selected program
+func (f *MpegProgramFilter) makePAT() packet.Packet {
+	tsid := f.programs.GetTransportStreamID()
+
+	section := []byte{TableIDPAT, 0xB0, 13, byte(tsid >> 8), byte(tsid), 0xC1 | byte(f.patversion<<1), 0, 0,
+		byte(f.program >> 8), byte(f.program), 0xE0 | byte(f.pmtpid>>8), byte(f.pmtpid)}
+
+	crc := MpegCRC32(section)
+	section = append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+
+	var pkt packet.Packet
+	pkt[0] = 0x47
+	pkt[1] = 0x40 // payload unit start, PID 0
+	pkt[3] = 0x10 | byte(f.patcc)
+	f.patcc = (f.patcc + 1) & 0x0F
+
+	// pointer field then section
+	n := copy(pkt[5:], section)
+	for i := 5 + n; i < packet.PacketSize; i++ {
+		pkt[i] = 0xFF
+	}
+
+	return pkt
+}
+
+// filter one packet of the multiplex, tables must have been updated with this packet before
+// never blocks so that a stalled consumer does not stop the other programs of the multiplex
+func (f *MpegProgramFilter) ProcessPacket(pkt packet.Packet) {
+	if f.selector == "" {
+		f.send(pkt)
+		return
+	}
+
+	pid := pkt.PID()
+
+	// original PAT is replaced, selection is refreshed at each PAT
+	if pid == PIDPAT {
+		f.update()
+
+		if f.program != 0 {
+			f.send(f.makePAT())
+		}
+		return
+	}
+
+	if f.pids[pid] {
+		f.send(pkt)
+	}
+}
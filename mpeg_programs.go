@@ -0,0 +1,246 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// a program of the transport stream as described by PAT and PMT
+type MpegProgram struct {
+	ProgramNumber int
+	PMTPID        int
+	PCRPID        int
+	// version of PMT, -1 until PMT is received
+	Version int
+	Streams []MpegElementaryStream
+}
+
+// follow PAT and PMT of a stream to keep an up to date list of programs
+type MpegProgramTracker struct {
+	mutex sync.Mutex
+	demux *MpegDemux
+
+	// PAT collection
+	patparser   *MpegPIDPSIParser
+	patsections *MpegSectionSet
+	patpending  map[int]int
+	tsid        int
+
+	// current programs by program number
+	programs map[int]*MpegProgram
+	// PMT parsers by PID (several programs may share a PMT PID)
+	pmtparsers map[int]*MpegPIDPSIParser
+
+	// closed when PAT and all PMTs are received
+	complete     chan struct{}
+	completeflag bool
+}
+
+// create a tracker and register its parsers on a demux
+func NewMpegProgramTracker(demux *MpegDemux) *MpegProgramTracker {
+	pt := new(MpegProgramTracker)
+	pt.demux = demux
+	pt.Reset()
+
+	return pt
+}
+
+// forget everything and restart PAT acquisition (to call after a new tune)
+func (pt *MpegProgramTracker) Reset() {
+	pt.Detach()
+
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+
+	pt.patsections = NewMpegSectionSet()
+	pt.patpending = make(map[int]int)
+	pt.tsid = -1
+	pt.programs = make(map[int]*MpegProgram)
+	pt.pmtparsers = make(map[int]*MpegPIDPSIParser)
+	pt.complete = make(chan struct{})
+	pt.completeflag = false
+
+	pt.patparser = NewMpegPIDPSIParser(MaxPSISectionSize, pt.handlePAT)
+	pt.demux.AddParser(PIDPAT, pt.patparser)
+}
+
+// unregister all parsers from the demux
+func (pt *MpegProgramTracker) Detach() {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+
+	if pt.patparser != nil {
+		pt.demux.RemoveParser(PIDPAT, pt.patparser)
+		pt.patparser = nil
+	}
+
+	for pid, parser := range pt.pmtparsers {
+		pt.demux.RemoveParser(pid, parser)
+	}
+	pt.pmtparsers = make(map[int]*MpegPIDPSIParser)
+}
+
+func (pt *MpegProgramTracker) handlePAT(section []byte) {
+	pat, err := ParsePAT(section)
+
+	if err != nil || !pat.Section.CurrentNext {
+		return
+	}
+
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+
+	// new version restart collection of sections
+	if pat.Version != pt.patsections.Version() {
+		pt.patpending = make(map[int]int)
+	}
+
+	if !pt.patsections.Add(pat.Section) {
+		return
+	}
+
+	for _, entry := range pat.Programs {
+		pt.patpending[entry.ProgramNumber] = entry.PID
+	}
+
+	if pt.patsections.Complete() {
+		pt.tsid = pat.TransportStreamID
+		pt.applyPAT(pt.patpending)
+	}
+}
+
+// update programs and PMT parsers from a complete PAT (lock must be held)
+func (pt *MpegProgramTracker) applyPAT(entries map[int]int) {
+	// remove programs which are gone or moved
+	for number, program := range pt.programs {
+		pid, found := entries[number]
+
+		if !found || pid != program.PMTPID {
+			delete(pt.programs, number)
+		}
+	}
+
+	// add new programs
+	for number, pid := range entries {
+		if _, found := pt.programs[number]; !found {
+			pt.programs[number] = &MpegProgram{ProgramNumber: number, PMTPID: pid, Version: -1}
+		}
+	}
+
+	// list PIDs still in use
+	pids := make(map[int]bool)
+	for _, pid := range entries {
+		pids[pid] = true
+	}
+
+	// stop parsing unused PMT PIDs
+	for pid, parser := range pt.pmtparsers {
+		if !pids[pid] {
+			pt.demux.RemoveParser(pid, parser)
+			delete(pt.pmtparsers, pid)
+		}
+	}
+
+	// start parsing new PMT PIDs
+	for pid := range pids {
+		if _, found := pt.pmtparsers[pid]; !found {
+			parser := NewMpegPIDPSIParser(MaxPSISectionSize, pt.handlePMT)
+			pt.pmtparsers[pid] = parser
+			pt.demux.AddParser(pid, parser)
+		}
+	}
+
+	pt.updateComplete()
+}
+
+func (pt *MpegProgramTracker) handlePMT(section []byte) {
+	pmt, err := ParsePMT(section)
+
+	if err != nil {
+		return
+	}
+
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+
+	program, found := pt.programs[pmt.ProgramNumber]
+
+	if !found || program.Version == pmt.Version {
+		return
+	}
+
+	program.Version = pmt.Version
+	program.PCRPID = pmt.PCRPID
+	program.Streams = pmt.Streams
+
+	pt.updateComplete()
+}
+
+// signal waiting clients when all tables are received (lock must be held)
+func (pt *MpegProgramTracker) updateComplete() {
+	if pt.completeflag || !pt.patsections.Complete() {
+		return
+	}
+
+	for _, program := range pt.programs {
+		if program.Version < 0 {
+			return
+		}
+	}
+
+	pt.completeflag = true
+	close(pt.complete)
+}
+
+// wait for PAT and all PMTs, return false on timeout
+func (pt *MpegProgramTracker) WaitComplete(timeout time.Duration) bool {
+	pt.mutex.Lock()
+	complete := pt.complete
+	pt.mutex.Unlock()
+
+	select {
+	case <-complete:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// transport stream id from PAT, -1 if PAT is not yet received
+func (pt *MpegProgramTracker) GetTransportStreamID() int {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+
+	return pt.tsid
+}
+
+// get a copy of known programs sorted by program number
+func (pt *MpegProgramTracker) GetPrograms() []MpegProgram {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+
+	programs := make([]MpegProgram, 0, len(pt.programs))
+
+	for _, program := range pt.programs {
+		programs = append(programs, *program)
+	}
+
+	sort.Slice(programs, func(i, j int) bool { return programs[i].ProgramNumber < programs[j].ProgramNumber })
+
+	return programs
+}
+
+// get one program by program number
+func (pt *MpegProgramTracker) GetProgram(number int) (MpegProgram, bool) {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+
+	program, found := pt.programs[number]
+
+	if !found {
+		return MpegProgram{}, false
+	}
+
+	return *program, true
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+)
+
+// table ids of PSI/SI sections
+const (
+	TableIDPAT              = 0x00
+	TableIDPMT              = 0x02
+	TableIDNITActual        = 0x40
+	TableIDNITOther         = 0x41
+	TableIDSDTActual        = 0x42
+	TableIDSDTOther         = 0x46
+	TableIDEITPFActual      = 0x4E
+	TableIDEITPFOther       = 0x4F
+	TableIDEITScheduleFirst = 0x50
+	TableIDEITScheduleLast  = 0x6F
+)
+
+// well known PIDs
+const (
+	PIDPAT = 0x0000
+	PIDNIT = 0x0010
+	PIDSDT = 0x0011
+	PIDEIT = 0x0012
+)
+
+// maximum section size for PSI (PAT, PMT) and for DVB SI tables
+const (
+	MaxPSISectionSize = 1024
+	MaxSISectionSize  = 4096
+)
+
+var ErrSectionTooShort = errors.New("section too short")
+var ErrSectionNotLong = errors.New("section has no long header")
+var ErrWrongTableID = errors.New("unexpected table id")
+
+// size of long section header (after section_length) and of the CRC
+const mpegLongHeaderSize = 5
+const mpegCRCSize = 4
+
+// decoded header of a section using the long syntax
+type MpegLongSection struct {
+	TableID           int
+	TableIDExtension  int
+	Version           int
+	CurrentNext       bool
+	SectionNumber     int
+	LastSectionNumber int
+	// data after header and before CRC
+	Payload []byte
+}
+
+// decode a complete section with long syntax (as delivered by MpegSectionReconstructor)
+func ParseMpegLongSection(section []byte) (*MpegLongSection, error) {
+	if len(section) < mpegSectionHeaderSize+mpegLongHeaderSize+mpegCRCSize {
+		return nil, ErrSectionTooShort
+	}
+
+	if section[1]&0x80 == 0 {
+		return nil, ErrSectionNotLong
+	}
+
+	s := new(MpegLongSection)
+	s.TableID = int(section[0])
+	s.TableIDExtension = int(section[3])<<8 | int(section[4])
+	s.Version = int(section[5]>>1) & 0x1F
+	s.CurrentNext = section[5]&0x01 != 0
+	s.SectionNumber = int(section[6])
+	s.LastSectionNumber = int(section[7])
+	s.Payload = section[mpegSectionHeaderSize+mpegLongHeaderSize : len(section)-mpegCRCSize]
+
+	return s, nil
+}
+
+// a raw descriptor
+type MpegDescriptor struct {
+	Tag  int
+	Data []byte
+}
+
+// split a descriptor loop into descriptors, truncated descriptors are ignored
+func ParseMpegDescriptors(data []byte) []MpegDescriptor {
+	descriptors := []MpegDescriptor{}
+
+	for len(data) >= 2 {
+		length := int(data[1])
+
+		if 2+length > len(data) {
+			break
+		}
+
+		descriptors = append(descriptors, MpegDescriptor{Tag: int(data[0]), Data: data[2 : 2+length]})
+		data = data[2+length:]
+	}
+
+	return descriptors
+}
+
+// read a 12 bits length field and return the data it covers and the remaining data
+func splitMpegLoop(data []byte) ([]byte, []byte, error) {
+	if len(data) < 2 {
+		return nil, nil, ErrSectionTooShort
+	}
+
+	length := int(data[0]&0x0F)<<8 | int(data[1])
+
+	if 2+length > len(data) {
+		return nil, nil, ErrSectionTooShort
+	}
+
+	return data[2 : 2+length], data[2+length:], nil
+}
+
+// track received sections of a table to know when all sections of a version are there
+type MpegSectionSet struct {
+	version  int
+	last     int
+	received map[int]bool
+}
+
+func NewMpegSectionSet() *MpegSectionSet {
+	set := new(MpegSectionSet)
+	set.version = -1
+
+	return set
+}
+
+// record a section, return true if this section was not already received
+func (set *MpegSectionSet) Add(s *MpegLongSection) bool {
+	if s.Version != set.version || s.LastSectionNumber != set.last {
+		set.version = s.Version
+		set.last = s.LastSectionNumber
+		set.received = make(map[int]bool)
+	}
+
+	if set.received[s.SectionNumber] {
+		return false
+	}
+
+	set.received[s.SectionNumber] = true
+	return true
+}
+
+// true when all sections of current version are received
+func (set *MpegSectionSet) Complete() bool {
+	return set.version >= 0 && len(set.received) == set.last+1
+}
+
+// version of the table being collected
+func (set *MpegSectionSet) Version() int {
+	return set.version
+}
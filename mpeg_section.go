@@ -4,41 +4,230 @@ import (
 	"github.com/Comcast/gots/packet"
 )
 
+// size of the section header up to and including section_length
+const mpegSectionHeaderSize = 3
+
+// value of stuffing bytes after the last section of a packet
+const mpegStuffingByte = 0xFF
+
+// callback receiving complete sections (the slice belongs to the callback)
+type MpegSectionHandler func(section []byte)
+
 // this object can rebuild MPEG section from MPEG packets
 type MpegSectionReconstructor struct {
 	currentsize int
-	data []byte
+	data        []byte
+	// last complete section
+	lastsection []byte
+	// last continuity counter seen (-1 when unknown)
+	lastcc int
+	// function to call for each complete section
+	handler MpegSectionHandler
+
+	// statistics
+	SectionCount      int
+	CRCErrors         int
+	Discontinuities   int
+	OversizedSections int
+	TransportErrors   int
+}
+
+// table of the MPEG-2 CRC32 (polynomial 0x04C11DB7, not reflected)
+var mpegCRCTable = func() [256]uint32 {
+	var table [256]uint32
+
+	for i := range table {
+		crc := uint32(i) << 24
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x80000000 != 0 {
+				crc = (crc << 1) ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+
+	return table
+}()
+
+// compute MPEG-2 CRC32 of data, result is 0 when run on a section including its CRC
+func MpegCRC32(data []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+
+	for _, b := range data {
+		crc = (crc << 8) ^ mpegCRCTable[byte(crc>>24)^b]
+	}
+
+	return crc
 }
 
 // create new section rebuilder (max size is usually 4096 or 1024 for public syntax SI)
-func NewMpegSectionReconstructor(maxsectionsize int) *MpegSectionReconstructor{
+func NewMpegSectionReconstructor(maxsectionsize int, handler MpegSectionHandler) *MpegSectionReconstructor {
 	msr := new(MpegSectionReconstructor)
 
 	msr.currentsize = 0
 	msr.data = make([]byte, maxsectionsize)
+	msr.lastcc = -1
+	msr.handler = handler
 	return msr
 }
 
-func (msr *MpegSectionReconstructor) ParsePacket(pkt *packet.Packet) {
-	if (msr.currentsize != 0) {
+// drop any partial section
+func (msr *MpegSectionReconstructor) Reset() {
+	msr.currentsize = 0
+	msr.lastcc = -1
+}
 
-	} else {
-		if (packet.PayloadUnitStartIndicator(pkt)) {
-			//payload := packet.Payload(pkt)
+// total size of the section being rebuilt, only valid once header is received
+func (msr *MpegSectionReconstructor) sectionSize() int {
+	return mpegSectionHeaderSize + (int(msr.data[1]&0x0F)<<8 | int(msr.data[2]))
+}
+
+// check CRC of sections that carry one (long syntax sections)
+func (msr *MpegSectionReconstructor) checkCRC(section []byte) bool {
+	// section_syntax_indicator
+	if section[1]&0x80 == 0 {
+		return true
+	}
+
+	// a long section must at least contain extended header and CRC
+	if len(section) < mpegSectionHeaderSize+5+4 {
+		return false
+	}
+
+	return MpegCRC32(section) == 0
+}
+
+// section is complete, check it and send it to handler
+func (msr *MpegSectionReconstructor) deliver() {
+	section := make([]byte, msr.currentsize)
+	copy(section, msr.data[:msr.currentsize])
+	msr.currentsize = 0
+
+	if !msr.checkCRC(section) {
+		msr.CRCErrors++
+		return
+	}
 
+	msr.SectionCount++
+	msr.lastsection = section
 
+	if msr.handler != nil {
+		msr.handler(section)
+	}
+}
+
+// add payload bytes to current section, returns number of bytes used
+func (msr *MpegSectionReconstructor) appendData(payload []byte) int {
+	consumed := 0
+
+	for consumed < len(payload) {
+		// until header is complete we only know we need the header
+		target := mpegSectionHeaderSize
+		if msr.currentsize >= mpegSectionHeaderSize {
+			target = msr.sectionSize()
+		}
 
-		}	
+		// section can't fit, drop it and the rest of this payload
+		if target > len(msr.data) {
+			msr.OversizedSections++
+			msr.currentsize = 0
+			return len(payload)
+		}
+
+		n := copy(msr.data[msr.currentsize:target], payload[consumed:])
+		msr.currentsize += n
+		consumed += n
+
+		if msr.currentsize >= mpegSectionHeaderSize && msr.currentsize == msr.sectionSize() {
+			msr.deliver()
+			break
+		}
 	}
 
+	return consumed
 }
 
+// process one packet of the PID carrying the sections
+func (msr *MpegSectionReconstructor) ParsePacket(pkt *packet.Packet) {
+	if pkt.TransportErrorIndicator() {
+		msr.TransportErrors++
+		msr.Reset()
+		return
+	}
+
+	// continuity counter is only incremented by packets with payload
+	if !pkt.HasPayload() {
+		return
+	}
+
+	cc := pkt.ContinuityCounter()
+
+	if msr.lastcc >= 0 {
+		// duplicate packet, already processed
+		if cc == msr.lastcc {
+			return
+		}
+
+		// lost packets, current section is corrupted
+		if cc != (msr.lastcc+1)&0x0F {
+			msr.Discontinuities++
+			msr.currentsize = 0
+		}
+	}
+	msr.lastcc = cc
+
+	payload, err := pkt.Payload()
+
+	if err != nil || len(payload) == 0 {
+		return
+	}
+
+	if pkt.PayloadUnitStartIndicator() {
+		pointer := int(payload[0])
+		payload = payload[1:]
+
+		if pointer > len(payload) {
+			msr.currentsize = 0
+			return
+		}
+
+		// bytes before pointer end the previous section
+		if msr.currentsize != 0 {
+			msr.appendData(payload[:pointer])
+			// previous section was not finished where expected
+			msr.currentsize = 0
+		}
+
+		payload = payload[pointer:]
 
-// get the reconstructed section
+		// one or several new sections until stuffing
+		for len(payload) > 0 && payload[0] != mpegStuffingByte {
+			consumed := msr.appendData(payload)
+			payload = payload[consumed:]
+
+			// section continues in next packet
+			if msr.currentsize != 0 {
+				break
+			}
+		}
+	} else {
+		// nothing to continue, wait for a new section start
+		if msr.currentsize == 0 {
+			return
+		}
+
+		// remaining of the packet after the section is stuffing
+		msr.appendData(payload)
+	}
+}
+
+// get the last reconstructed section
 func (msr *MpegSectionReconstructor) GetSection() []byte {
-	if msr.currentsize == 0 {
+	if msr.lastsection == nil {
 		return msr.data[0:0] // return empty slice
 	}
 
-	return msr.data[0:msr.currentsize-1] // return slice with section data
-}
\ No newline at end of file
+	return msr.lastsection // return slice with section data
+}
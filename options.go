@@ -0,0 +1,133 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// environment variables overriding default values of options (for containers)
+const (
+	EnvConfig      = "DVBHB_CONFIG"
+	EnvTunerConfig = "DVBHB_TUNER_CONFIG"
+	EnvListen      = "DVBHB_LISTEN"
+	EnvWorkDir     = "DVBHB_WORKDIR"
+	EnvLogLevel    = "DVBHB_LOG_LEVEL"
+)
+
+// log levels, messages at debug level are only printed when requested
+const (
+	LogLevelDebug = iota
+	LogLevelInfo
+	LogLevelNone
+)
+
+var logLevelNames = []string{"debug", "info", "none"}
+
+var logLevel = LogLevelInfo
+
+// options of the command line
+type ServerOptions struct {
+	ConfigFile string
+	// configuration files of virtual tuners
+	TunerConfigFiles []string
+	// address to listen to (port from configuration if empty)
+	Listen string
+	// directory for transcode output
+	WorkDir     string
+	LogLevel    string
+	CheckConfig bool
+}
+
+// a repeatable option, value of environment can hold a list
+type stringListFlag struct {
+	values []string
+	// values are defaults until first given on command line
+	set bool
+}
+
+func (f *stringListFlag) String() string {
+	return strings.Join(f.values, string(os.PathListSeparator))
+}
+
+func (f *stringListFlag) Set(value string) error {
+	if !f.set {
+		f.values = nil
+		f.set = true
+	}
+
+	if value != "" {
+		f.values = append(f.values, value)
+	}
+
+	return nil
+}
+
+// get value of an environment variable or a default value
+func envOrDefault(name string, value string) string {
+	if env, found := os.LookupEnv(name); found {
+		return env
+	}
+
+	return value
+}
+
+// parse command line arguments, environment variables give default values
+func ParseServerOptions(args []string) (*ServerOptions, error) {
+	options := new(ServerOptions)
+
+	flags := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+
+	tunerconfigs := &stringListFlag{values: filepath.SplitList(envOrDefault(EnvTunerConfig, "test_tuner_config.yaml"))}
+
+	flags.StringVar(&options.ConfigFile, "config", envOrDefault(EnvConfig, "democonfig.yaml"), "main configuration file (env "+EnvConfig+")")
+	flags.Var(tunerconfigs, "tunerconfig", "virtual tuner configuration file, can be repeated, empty for none (env "+EnvTunerConfig+" as a path list)")
+	flags.StringVar(&options.Listen, "listen", envOrDefault(EnvListen, ""), "address or port to listen to, like :8080 (env "+EnvListen+", serverport of configuration by default)")
+	flags.StringVar(&options.WorkDir, "workdir", envOrDefault(EnvWorkDir, ""), "directory for transcode output (env "+EnvWorkDir+", workdir of configuration by default)")
+	flags.StringVar(&options.LogLevel, "loglevel", envOrDefault(EnvLogLevel, "info"), "log level: "+strings.Join(logLevelNames, ", ")+" (env "+EnvLogLevel+")")
+	flags.BoolVar(&options.CheckConfig, "check-config", false, "check configuration files and exit, exit code is not 0 if they are not valid")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if flags.NArg() != 0 {
+		return nil, fmt.Errorf("unexpected argument %s", flags.Arg(0))
+	}
+
+	options.TunerConfigFiles = tunerconfigs.values
+
+	return options, nil
+}
+
+// select log level from its name
+func SetLogLevel(name string) error {
+	for i, n := range logLevelNames {
+		if n == strings.ToLower(name) {
+			logLevel = i
+
+			var output io.Writer = os.Stderr
+			if logLevel == LogLevelNone {
+				output = ioutil.Discard
+			}
+			log.SetOutput(output)
+
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown log level %s", name)
+}
+
+// print a message only at debug level
+func logDebugf(format string, v ...interface{}) {
+	if logLevel <= LogLevelDebug {
+		log.Printf(format, v...)
+	}
+}
@@ -3,15 +3,21 @@ package main
 import (
 	"context"
 	"embed"
+	"flag"
 	"fmt"
 	"io/fs"
 	"log"
 	"mime"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"runtime"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 // this is where static files for the embedded DVB-I client goes
@@ -26,7 +32,13 @@ var fileServer = http.FileServer(http.FS(htmlstatic))
 
 var deviceconfig DeviceConfig
 
-var tm TunerManager
+var tm = NewTunerManager("main")
+
+// program guide collected from EIT of tuned streams
+var epgstore = NewEpgStore()
+
+// last output lines of external tools
+var toolLogs = NewToolLogStore()
 
 const ICONPATH = "/icon.png"
 
@@ -36,6 +48,12 @@ var icondata []byte
 
 var ServerUPnPDevice UPnPDevice
 
+// time given to running requests to complete at shutdown
+const shutdownTimeout = 10 * time.Second
+
+// time given to stop tools at exit, the server exits with an error if they do not stop
+const toolStopTimeout = 30 * time.Second
+
 func configurationHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/javascript")
 
@@ -60,6 +78,69 @@ func IconHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(icondata)
 }
 
+// get address to listen to from listen option (address or port) or configured port (80 if none)
+func listenAddress(listen string, port int) (string, int, error) {
+	if listen == "" {
+		if port == 0 {
+			port = 80
+		}
+
+		return fmt.Sprintf(":%d", port), port, nil
+	}
+
+	// a port alone
+	if !strings.Contains(listen, ":") {
+		listen = ":" + listen
+	}
+
+	_, portname, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "", 0, err
+	}
+
+	port, err = strconv.Atoi(portname)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid listen port %s", portname)
+	}
+
+	return listen, port, nil
+}
+
+// check configuration files, return exit code
+func checkConfig(options *ServerOptions) int {
+	code := 0
+
+	// errors give file and line
+	for _, err := range deviceconfig.Validate() {
+		fmt.Fprintln(os.Stderr, err)
+		code = 1
+	}
+
+	for _, tunerconfig := range options.TunerConfigFiles {
+		errs := ValidateVirtualTunerConfig(tunerconfig)
+
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+			code = 1
+		}
+
+		if len(errs) > 0 {
+			continue
+		}
+
+		if _, err := NewVirtualTuner(tunerconfig); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", tunerconfig, err)
+			code = 1
+		}
+	}
+
+	if code == 0 {
+		fmt.Println("configuration is valid")
+	}
+
+	return code
+}
+
 func main() {
 	var svr http.Server
 	var svrmux http.ServeMux
@@ -67,10 +148,47 @@ func main() {
 
 	mime.AddExtensionType(".js", "application/javascript")
 
+	options, err := ParseServerOptions(os.Args[1:])
+	if err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(0)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if err := SetLogLevel(options.LogLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
 	//deviceconfig.WriteConfig("democonfig.yaml")
-	deviceconfig.ReadConfig("democonfig.yaml")
+	if err := deviceconfig.ReadConfig(options.ConfigFile); err != nil {
+		fmt.Fprintf(os.Stderr, "cannot read configuration %s: %s\n", options.ConfigFile, err)
+		os.Exit(1)
+	}
 
-	transcoderManager := CreateDynamicTranscode(deviceconfig.TunerConfig, deviceconfig.TranscodeConfig, deviceconfig.MaxTuner, deviceconfig.TunerList)
+	// check mode only reads configuration files
+	if options.CheckConfig {
+		os.Exit(checkConfig(options))
+	}
+
+	for _, err := range deviceconfig.Validate() {
+		log.Printf("configuration %s\n", err)
+	}
+
+	listenaddress, listenport, err := listenAddress(options.Listen, deviceconfig.ServerPort)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if options.WorkDir != "" {
+		deviceconfig.WorkDir = options.WorkDir
+	}
+
+	transcoderManager := CreateDynamicTranscode(deviceconfig.TunerConfig, deviceconfig.TranscodeConfig, deviceconfig.MaxTuner, deviceconfig.TunerList, deviceconfig.ShareTuners)
+	transcoderManager.SetWorkDir(deviceconfig.WorkDir)
 
 	RegisterDynamicContent("transcode", transcoderManager)
 
@@ -80,52 +198,107 @@ func main() {
 	// serve channel map list and channel maps
 	svrmux.HandleFunc(ChannelMapPath, channelmapHandler)
 
+	// serve program guide
+	svrmux.HandleFunc(ContentGuidePath, contentguideHandler)
+
 	// serve channel map list and channel maps
 	svrmux.HandleFunc(DynamicContentPath, dynamicContentHandler)
 
+	// report tuner usage
+	svrmux.HandleFunc(TunerStatusPath, transcoderManager.ServeTunerStatus)
+
+	// report viewers of transcoded channels
+	svrmux.HandleFunc(ViewerStatusPath, transcoderManager.ServeViewerStatus)
+
+	// serve output of external tools, live tails end when server shuts down
+	svrmux.HandleFunc(ToolLogPath, toolLogs.ServeToolLogs)
+	svr.RegisterOnShutdown(toolLogs.CloseSubscribers)
+
 	// serve static files
 	svrmux.Handle("/video/", http.StripPrefix("/video/", http.FileServer(http.Dir("./video"))))
+
+	// serve channel logos if a directory is configured
+	if deviceconfig.LogoDir != "" {
+		svrmux.Handle(LogoPath, http.StripPrefix(LogoPath, http.FileServer(http.Dir(deviceconfig.LogoDir))))
+	}
 	svrmux.HandleFunc("/", staticHandler)
 
-	virtualtuner, _ := NewVirtualTuner("test_tuner_config.yaml")
+	for _, tunerconfig := range options.TunerConfigFiles {
+		virtualtuner, err := NewVirtualTuner(tunerconfig)
 
-	tm.AttachTuner(virtualtuner)
+		if err != nil {
+			log.Printf("cannot create virtual tuner from %s\n%s\n", tunerconfig, err)
+			continue
+		}
+
+		tm.AttachTuner(virtualtuner)
 
-	deviceconfig.RegisterDynamicChannelMap(virtualtuner)
+		deviceconfig.RegisterDynamicChannelMap(virtualtuner)
+
+		RegisterDynamicChannelMap(virtualtuner)
+	}
 
-	RegisterDynamicChannelMap(virtualtuner)
+	// collect EIT from all tuners
+	NewDvbEITCollector(tm.GetDemux(), epgstore)
+	epgstore.Start()
 
 	deviceconfig.helpertoolsruntime = make([]*CommandLineTool, len(deviceconfig.HelperTools))
-	Args := make(map[string]string)
+	Args := make(ToolParameters)
 
 	for i := range deviceconfig.HelperTools {
 		deviceconfig.helpertoolsruntime[i] = CreateCommandLineTool(deviceconfig.HelperTools[i])
-		Args["index"] = fmt.Sprintf("%d", i)
-		deviceconfig.helpertoolsruntime[i].Start(Args)
+
+		helperLog := NewToolLog("helper", i, deviceconfig.HelperTools[i].Command, "", "")
+		toolLogs.Register(helperLog)
+		deviceconfig.helpertoolsruntime[i].SetLog(helperLog)
+
+		Args.Set("index", fmt.Sprintf("%d", i))
+		// helper tools are restarted as configured by their own restart policy
+		if err := deviceconfig.helpertoolsruntime[i].Start(Args); err != nil {
+			log.Printf("cannot start helper tool %s\n%s\n", deviceconfig.HelperTools[i].Command, err)
+		}
 	}
 
 	// this channel is used to signal when the main server has stopped
 	idleConnsClosed := make(chan struct{})
 
-	// this async function wait for a keypress to stop server properly
+	// this async function wait for an interrupt, a terminate signal or a keypress to stop server properly
 	go func() {
-		var b []byte = make([]byte, 1)
-		os.Stdin.Read(b)
-		fmt.Print("Closing ...\n")
-
-		// We received an interrupt signal, shut down.
-		if err := svr.Shutdown(context.Background()); err != nil {
+		stop := make(chan os.Signal, 2)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+		// keypress only when running from a console, stdin is closed for services
+		go func() {
+			var b []byte = make([]byte, 1)
+			if n, _ := os.Stdin.Read(b); n > 0 {
+				stop <- os.Interrupt
+			}
+		}()
+
+		sig := <-stop
+		fmt.Printf("Closing on %s ...\n", sig)
+
+		// a second signal exits at once
+		go func() {
+			<-stop
+			log.Println("Forced exit")
+			os.Exit(1)
+		}()
+
+		// We received an interrupt signal, shut down, running requests are given some time to complete.
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		if err := svr.Shutdown(ctx); err != nil {
 			// Error from closing listeners, or context timeout:
 			log.Printf("HTTP server Shutdown: %v", err)
+			svr.Close()
 		}
 		// signal main that we have stopped
 		close(idleConnsClosed)
 	}()
 
-	// configure default port to 80 if none is specified
-	if deviceconfig.ServerPort == 0 {
-		deviceconfig.ServerPort = 80
-	}
+	deviceconfig.ServerPort = listenport
 
 	// under windows launch browser if requested to 
 	if runtime.GOOS == "windows" && deviceconfig.OpenPage {
@@ -133,7 +306,7 @@ func main() {
 	}
 
 	fmt.Printf("Starting server at port %d\n", deviceconfig.ServerPort)
-	svr.Addr = fmt.Sprintf(":%d", deviceconfig.ServerPort)
+	svr.Addr = listenaddress
 
 	svrmux.HandleFunc(ICONPATH, IconHandler)
 
@@ -144,26 +317,49 @@ func main() {
 	ServerUPnPDevice.presentation_page = "/index.html"
 	ServerUPnPDevice.Start(&svrmux)
 
-	// run server
-	if err := svr.ListenAndServe(); err != nil {
-		log.Fatal(err)
-	}
+	// run server, closing server is not an error
+	err = svr.ListenAndServe()
 
-	// wait to server to close
-	<-idleConnsClosed
+	if err != http.ErrServerClosed {
+		// cleanup is still required for tools already started
+		log.Printf("HTTP server error: %v\n", err)
+	} else {
+		// wait to server to close
+		<-idleConnsClosed
+	}
 
 	// eventually stop launched tasks before exits (avoid hanging processes)
-	log.Println("stopping running transcoders")
-	transcoderManager.StopAll()
+	toolsStopped := make(chan struct{})
+
+	go func() {
+		log.Println("stopping running transcoders")
+		transcoderManager.StopAll()
 
-	log.Println("stopping running tools")
+		log.Println("stopping running tools")
 
-	for i := range deviceconfig.helpertoolsruntime {
-		deviceconfig.helpertoolsruntime[i].Stop()
-	} 
+		for i := range deviceconfig.helpertoolsruntime {
+			deviceconfig.helpertoolsruntime[i].Stop()
+		}
 
+		close(toolsStopped)
+	}()
+
+	select {
+	case <-toolsStopped:
+	case <-time.After(toolStopTimeout):
+		log.Printf("tools did not stop within %s, exit\n", toolStopTimeout)
+		os.Exit(1)
+	}
+
+	log.Println("stopping UPnP advertisement")
 	ServerUPnPDevice.Stop()
 
+	epgstore.Stop()
+
 	log.Println("Finished, exit")
 
+	if err != http.ErrServerClosed {
+		os.Exit(1)
+	}
+
 }
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// delivery names used in service list registry queries
+const (
+	DeliveryDVBT        = "dvb-t"
+	DeliveryDVBS        = "dvb-s"
+	DeliveryDVBC        = "dvb-c"
+	DeliveryDASH        = "dvb-dash"
+	DeliveryIPTV        = "dvb-iptv"
+	DeliveryApplication = "application"
+)
+
+// get element of a delivery from its query name, nil if unknown
+func (delivery *DVBIDelivery) field(name string) **struct{} {
+	switch strings.ToLower(name) {
+	case DeliveryDVBT:
+		return &delivery.DVBTDelivery
+	case DeliveryDVBS:
+		return &delivery.DVBSDelivery
+	case DeliveryDVBC:
+		return &delivery.DVBCDelivery
+	case DeliveryDASH:
+		return &delivery.DASHDelivery
+	case DeliveryIPTV:
+		return &delivery.RTSPDelivery
+	case DeliveryApplication:
+		return &delivery.ApplicationDelivery
+	}
+
+	return nil
+}
+
+// add a delivery type, return false if name is unknown
+func (delivery *DVBIDelivery) Set(name string) bool {
+	f := delivery.field(name)
+
+	if f == nil {
+		return false
+	}
+
+	*f = &struct{}{}
+
+	return true
+}
+
+// check if a delivery type is used
+func (delivery *DVBIDelivery) Has(name string) bool {
+	f := delivery.field(name)
+
+	return f != nil && *f != nil
+}
+
+// filter of a service list registry query, empty criteria match everything
+type ServiceListQuery struct {
+	Providers     []string
+	Languages     []string
+	Genres        []string
+	Countries     []string
+	Delivery      []string
+	RegulatorOnly bool
+}
+
+// get values of a parameter given either as name or name[]
+func queryValues(r *http.Request, name string) []string {
+	var values []string
+
+	query := r.URL.Query()
+
+	for _, value := range append(query[name], query[name+"[]"]...) {
+		// also accept comma separated lists
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+
+	return values
+}
+
+// get query parameters of a service list discovery request
+func NewServiceListQuery(r *http.Request) ServiceListQuery {
+	var q ServiceListQuery
+
+	q.Providers = queryValues(r, "ProviderName")
+	q.Languages = queryValues(r, "Language")
+	q.Genres = queryValues(r, "Genre")
+	q.Countries = queryValues(r, "TargetCountry")
+	q.Delivery = queryValues(r, "Delivery")
+	q.RegulatorOnly = r.URL.Query().Get("regulatorListFlag") == "true"
+
+	return q
+}
+
+// true if one of wanted values is in values, a list without values is not restricted
+func matchAny(wanted []string, values []string) bool {
+	if len(wanted) == 0 || len(values) == 0 {
+		return true
+	}
+
+	for _, w := range wanted {
+		for _, v := range values {
+			if strings.EqualFold(w, v) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// check if a service list offering matches the query
+func (q ServiceListQuery) Matches(provider string, list DVBIServiceListOffering) bool {
+	if q.RegulatorOnly && !list.RegulatorListFlag {
+		return false
+	}
+
+	if len(q.Providers) > 0 && !matchAny(q.Providers, []string{provider}) {
+		return false
+	}
+
+	genres := make([]string, 0, len(list.Genres))
+	for _, genre := range list.Genres {
+		genres = append(genres, genre.Href)
+	}
+
+	if !matchAny(q.Languages, list.Languages) || !matchAny(q.Genres, genres) || !matchAny(q.Countries, list.TargetCountry) {
+		return false
+	}
+
+	if len(q.Delivery) == 0 {
+		return true
+	}
+
+	for _, name := range q.Delivery {
+		if list.Delivery.Has(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// remove service lists not matching the query, and providers left without lists
+func (q ServiceListQuery) Filter(entrypoints *DVBIServiceListEntryPoints) {
+	offerings := entrypoints.ProviderOfferings[:0]
+
+	for _, offering := range entrypoints.ProviderOfferings {
+		lists := offering.ServiceListOfferings[:0]
+
+		for _, list := range offering.ServiceListOfferings {
+			if q.Matches(offering.Provider.Name, list) {
+				lists = append(lists, list)
+			}
+		}
+
+		if len(lists) > 0 {
+			offering.ServiceListOfferings = lists
+			offerings = append(offerings, offering)
+		}
+	}
+
+	entrypoints.ProviderOfferings = offerings
+}
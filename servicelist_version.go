@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// versions are seconds since this date so that a restarted server gives newer versions than the previous run
+var versionEpoch = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// version of one item, increased each time its content changes
+type contentVersion struct {
+	hash         [sha256.Size]byte
+	version      int
+	lastmodified time.Time
+}
+
+// update version if content hash changed, return true on change
+func (v *contentVersion) update(hash [sha256.Size]byte) bool {
+	if v.version != 0 && v.hash == hash {
+		return false
+	}
+
+	now := time.Now().UTC()
+
+	// version follows time, changes within the same second still increase it
+	version := int(now.Sub(versionEpoch) / time.Second)
+	if version <= v.version {
+		version = v.version + 1
+	}
+
+	v.hash = hash
+	v.version = version
+	v.lastmodified = now.Truncate(time.Second)
+
+	return true
+}
+
+// versions of a service list and of its services
+type serviceListVersion struct {
+	list     contentVersion
+	services map[string]*contentVersion
+}
+
+// keep track of service list changes to give them versions and modification dates
+type ServiceListVersioning struct {
+	mutex sync.Mutex
+	lists map[string]*serviceListVersion
+}
+
+var servicelistversions = NewServiceListVersioning()
+
+func NewServiceListVersioning() *ServiceListVersioning {
+	v := new(ServiceListVersioning)
+	v.lists = make(map[string]*serviceListVersion)
+
+	return v
+}
+
+// hash the XML form of a value
+func hashXML(v interface{}) [sha256.Size]byte {
+	out, _ := xml.Marshal(v)
+
+	return sha256.Sum256(out)
+}
+
+// get versions of a list, create if required (lock must be held)
+func (v *ServiceListVersioning) get(name string) *serviceListVersion {
+	state, found := v.lists[name]
+
+	if !found {
+		state = new(serviceListVersion)
+		state.services = make(map[string]*contentVersion)
+		v.lists[name] = state
+	}
+
+	return state
+}
+
+// set version attributes of a service list and its services, return last modification time
+func (v *ServiceListVersioning) ApplyServiceList(name string, sl *DVBIServiceList) time.Time {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	state := v.get(name)
+
+	// versions are computed without versions and host so that they only depend on content
+	for i := range sl.Services {
+		service := sl.Services[i]
+		service.Version = 0
+
+		servicestate, found := state.services[service.UniqueIdentifier]
+		if !found {
+			servicestate = new(contentVersion)
+			state.services[service.UniqueIdentifier] = servicestate
+		}
+
+		servicestate.update(hashXML(service))
+		sl.Services[i].Version = servicestate.version
+	}
+
+	reference := *sl
+	reference.Version = 0
+	state.list.update(hashXML(reference))
+	sl.Version = state.list.version
+
+	return state.list.lastmodified
+}
+
+// get last modification time of any document (without version attribute)
+func (v *ServiceListVersioning) ApplyDocument(name string, doc interface{}) time.Time {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	state := v.get(name)
+	state.list.update(hashXML(doc))
+
+	return state.list.lastmodified
+}
+
+// serve a document with ETag and Last-Modified, answering conditional requests
+func serveVersionedXML(w http.ResponseWriter, r *http.Request, doc interface{}, lastmodified time.Time) {
+	out, err := MarshalXMLDocument(doc)
+
+	if err != nil {
+		http.Error(w, "500 internal error.", http.StatusInternalServerError)
+		return
+	}
+
+	hash := sha256.Sum256(out)
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Header().Set("ETag", "\""+hex.EncodeToString(hash[:12])+"\"")
+	// clients must check for updates but can use their copy if unchanged
+	w.Header().Set("Cache-Control", "no-cache")
+
+	http.ServeContent(w, r, "", lastmodified, bytes.NewReader(out))
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// split a command line into arguments like a POSIX shell without expansions:
+// blanks separate arguments, single quotes keep text as is, double quotes keep text with \" and \\ escaped,
+// a backslash outside quotes escapes the next character
+func SplitArgs(line string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+
+	// an argument is started by any character, even an empty quoted string
+	started := false
+
+	runes := []rune(line)
+
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if started {
+				args = append(args, current.String())
+				current.Reset()
+				started = false
+			}
+
+		case c == '\\':
+			i++
+			if i >= len(runes) {
+				return nil, fmt.Errorf("trailing backslash in %s", line)
+			}
+			current.WriteRune(runes[i])
+			started = true
+
+		case c == '\'':
+			end := i + 1
+			for end < len(runes) && runes[end] != '\'' {
+				end++
+			}
+			if end >= len(runes) {
+				return nil, fmt.Errorf("unterminated single quote in %s", line)
+			}
+			current.WriteString(string(runes[i+1 : end]))
+			i = end
+			started = true
+
+		case c == '"':
+			i++
+			for i < len(runes) && runes[i] != '"' {
+				if runes[i] == '\\' && i+1 < len(runes) && (runes[i+1] == '"' || runes[i+1] == '\\') {
+					i++
+				}
+				current.WriteRune(runes[i])
+				i++
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated double quote in %s", line)
+			}
+			started = true
+
+		default:
+			current.WriteRune(c)
+			started = true
+		}
+	}
+
+	if started {
+		args = append(args, current.String())
+	}
+
+	return args, nil
+}
+
+// arguments of a tool given in YAML as a single string (split like a shell command line) or as a list
+type ToolArgs struct {
+	// string as written in configuration, kept to write configuration back
+	text   string
+	tokens []string
+}
+
+// create arguments from a list
+func NewToolArgs(tokens ...string) ToolArgs {
+	return ToolArgs{tokens: tokens}
+}
+
+// create arguments from a command line
+func ParseToolArgs(line string) (ToolArgs, error) {
+	tokens, err := SplitArgs(line)
+
+	return ToolArgs{text: line, tokens: tokens}, err
+}
+
+// arguments before parameter substitution
+func (a ToolArgs) Tokens() []string {
+	return a.tokens
+}
+
+func (a ToolArgs) String() string {
+	if a.text != "" {
+		return a.text
+	}
+
+	return strings.Join(a.tokens, " ")
+}
+
+func (a *ToolArgs) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.SequenceNode {
+		a.text = ""
+		return value.Decode(&a.tokens)
+	}
+
+	var line string
+	if err := value.Decode(&line); err != nil {
+		return err
+	}
+
+	args, err := ParseToolArgs(line)
+	if err != nil {
+		return fmt.Errorf("line %d: %s", value.Line, err)
+	}
+
+	*a = args
+
+	return nil
+}
+
+func (a ToolArgs) MarshalYAML() (interface{}, error) {
+	if a.tokens == nil || a.text != "" {
+		return a.text, nil
+	}
+
+	return a.tokens, nil
+}
+
+// arguments are omitted from configuration when empty
+func (a ToolArgs) IsZero() bool {
+	return a.text == "" && len(a.tokens) == 0
+}
+
+// parameters substituted in tool arguments, a parameter can hold several arguments (like feed arguments)
+type ToolParameters map[string][]string
+
+// set a parameter holding one argument
+func (p ToolParameters) Set(name string, value string) {
+	p[name] = []string{value}
+}
+
+// get a parameter as a single string
+func (p ToolParameters) Get(name string) string {
+	return strings.Join(p[name], " ")
+}
+
+// substitute ${name} (or $name) in each argument, $$ gives a $
+// a value never splits an argument, except an argument made only of ${name} which gives all values of the parameter
+// (none if the parameter is not set)
+func ExpandArgs(tokens []string, params ToolParameters) []string {
+	args := make([]string, 0, len(tokens))
+
+	for _, token := range tokens {
+		if strings.HasPrefix(token, "${") && strings.HasSuffix(token, "}") && strings.Count(token, "$") == 1 {
+			args = append(args, params[token[2:len(token)-1]]...)
+			continue
+		}
+
+		args = append(args, expandToken(token, params))
+	}
+
+	return args
+}
+
+// substitute parameters in one argument
+func expandToken(token string, params ToolParameters) string {
+	var result strings.Builder
+
+	for i := 0; i < len(token); i++ {
+		if token[i] != '$' || i+1 >= len(token) {
+			result.WriteByte(token[i])
+			continue
+		}
+
+		switch {
+		case token[i+1] == '$':
+			result.WriteByte('$')
+			i++
+
+		case token[i+1] == '{':
+			end := strings.IndexByte(token[i+2:], '}')
+			if end < 0 {
+				// not a reference, keep as is
+				result.WriteString(token[i:])
+				return result.String()
+			}
+
+			result.WriteString(params.Get(token[i+2 : i+2+end]))
+			i += end + 2
+
+		default:
+			// $name ends at first character which is not a letter, a digit or an underscore
+			end := i + 1
+			for end < len(token) && isParameterChar(token[end]) {
+				end++
+			}
+
+			if end == i+1 {
+				result.WriteByte('$')
+				continue
+			}
+
+			result.WriteString(params.Get(token[i+1 : end]))
+			i = end - 1
+		}
+	}
+
+	return result.String()
+}
+
+func isParameterChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want []string
+		err  string
+	}{
+		{"blanks", "  -a\t1 \n -b  ", []string{"-a", "1", "-b"}, ""},
+		{"empty", "", nil, ""},
+		{"two quoted arguments", `-metadata "title=A B" -metadata 'artist=C D'`, []string{"-metadata", "title=A B", "-metadata", "artist=C D"}, ""},
+		{"quotes inside argument", `--name="a b"'c d'e`, []string{"--name=a bc de"}, ""},
+		{"empty quoted argument", `-a "" ''`, []string{"-a", "", ""}, ""},
+		{"escaped blank", `a\ b c`, []string{"a b", "c"}, ""},
+		{"escapes in double quotes", `"a \"b\" \\ \n"`, []string{`a "b" \ \n`}, ""},
+		{"no escape in single quotes", `'a \" b'`, []string{`a \" b`}, ""},
+		{"unterminated double quote", `-a "b c`, nil, "unterminated double quote"},
+		{"unterminated single quote", `-a 'b c`, nil, "unterminated single quote"},
+		{"trailing backslash", `-a b\`, nil, "trailing backslash"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := SplitArgs(test.line)
+
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("SplitArgs(%q) error = %v, want %q", test.line, err, test.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("SplitArgs(%q) error = %v", test.line, err)
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("SplitArgs(%q) = %q, want %q", test.line, got, test.want)
+			}
+		})
+	}
+}
+
+func TestExpandArgs(t *testing.T) {
+	params := make(ToolParameters)
+	params.Set("program", "RAI 1 HD")
+	params.Set("port", "1234")
+	params["source"] = []string{"--polarity", "vertical axis", "-f", "11766000000"}
+
+	tests := []struct {
+		name   string
+		tokens []string
+		want   []string
+	}{
+		{"value with blanks stays one argument", []string{"-P", "zap", "${program}"}, []string{"-P", "zap", "RAI 1 HD"}},
+		{"feed gives separate arguments", []string{"-I", "dvb", "${source}", "-O"}, []string{"-I", "dvb", "--polarity", "vertical axis", "-f", "11766000000", "-O"}},
+		{"feed inside argument is joined", []string{"x=${source}"}, []string{"x=--polarity vertical axis -f 11766000000"}},
+		{"short form", []string{"udp://127.0.0.1:$port?pkt_size=1316"}, []string{"udp://127.0.0.1:1234?pkt_size=1316"}},
+		{"dollar escape", []string{"$$HOME", "a$$b", "$${port}"}, []string{"$HOME", "a$b", "${port}"}},
+		{"missing parameter", []string{"-a", "${unknown}", "b${unknown}c"}, []string{"-a", "bc"}},
+		{"not a reference", []string{"$", "a$", "${open", "$-"}, []string{"$", "a$", "${open", "$-"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := ExpandArgs(test.tokens, params)
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ExpandArgs(%q) = %q, want %q", test.tokens, got, test.want)
+			}
+		})
+	}
+}
+
+func TestToolArgsYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want []string
+		err  bool
+	}{
+		{"string", `args: -a "b c" d`, []string{"-a", "b c", "d"}, false},
+		{"list", `args: [-a, "b c", "${source}"]`, []string{"-a", "b c", "${source}"}, false},
+		{"block list", "args:\n  - -a\n  - b c\n", []string{"-a", "b c"}, false},
+		{"unterminated quote", `args: -a "b`, nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var config CommandLineToolConfig
+
+			err := yaml.Unmarshal([]byte(test.yaml), &config)
+
+			if test.err {
+				if err == nil {
+					t.Fatalf("Unmarshal(%q) gave no error", test.yaml)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unmarshal(%q) error = %v", test.yaml, err)
+			}
+
+			if !reflect.DeepEqual(config.Args.Tokens(), test.want) {
+				t.Errorf("Unmarshal(%q) args = %q, want %q", test.yaml, config.Args.Tokens(), test.want)
+			}
+		})
+	}
+}
+
+// command lines of the demo configuration as given to the tools
+func TestDemoConfigArgs(t *testing.T) {
+	var config DeviceConfig
+
+	err := config.ReadConfig("democonfig.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source, found := config.Feeds["TP5200"]
+	if !found {
+		t.Fatal("feed TP5200 not found")
+	}
+
+	params := make(ToolParameters)
+	params["source"] = source.Tokens()
+	params.Set("program", "RAI1HD")
+	params.Set("tunerindex", "0")
+	params.Set("instanceindex", "0")
+	params.Set("_portin_", "56320")
+	params.Set("_portout_", "48210")
+	params.Set("_portcommand_", "45210")
+
+	tests := []struct {
+		name   string
+		config CommandLineToolConfig
+		want   []string
+	}{
+		{"tunerconfig", config.TunerConfig, []string{
+			"-I", "dvb", "-a", "0",
+			"--delivery-system", "DVB-S2", "-f", "11766000000", "-m", "8-PSK", "-s", "29900000", "--polarity", "vertical",
+			"-P", "cutoff", "45210", "-P", "zap", "RAI1HD", "-O", "ip", "127.0.0.1:48210",
+		}},
+		{"transcodeconfig", config.TranscodeConfig, []string{
+			"-hide_banner", "-loglevel", "error", "-f", "mpegts", "-analyzeduration", "1M", "-probesize", "1M",
+			"-i", "udp://127.0.0.1:56320?fifo_size=1000000&overrun_nonfatal=1&timeout=5000000",
+			"-map", "0:v", "-map", "0:a", "-c:a", "aac", "-c:v", "h264_nvenc", "-rc-lookahead", "25",
+			"-b:v:0", "7M", "-minrate", "6M", "-maxrate", "7M", "-bufsize", "14M", "-pix_fmt", "yuv420p", "-profile:v:0", "main",
+			"-bf", "1", "-remove_at_exit", "1", "-keyint_min", "25", "-g", "25", "-sc_threshold", "0", "-b_strategy", "0",
+			"-use_template", "1", "-window_size", "20", "-seg_duration", "2", "-f", "dash", "0/out.mpd",
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := ExpandArgs(test.config.Args.Tokens(), params)
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("args of %s = %q, want %q", test.name, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// path of tool output logs, followed by a log id for the lines of one tool (like /admin/logs/transcoder/2)
+const ToolLogPath = "/admin/logs/"
+
+// number of lines kept for each tool
+const toolLogSize = 500
+
+// lines buffered for a live tail client, more lines are dropped for a slow client
+const toolLogEventBuffer = 64
+
+// a line written by a tool on stdout or stderr
+type ToolLogLine struct {
+	Time   time.Time `json:"time"`
+	Stream string    `json:"stream"`
+	Text   string    `json:"text"`
+}
+
+// last output lines of a tool, kept after the tool stops until another tool gets the same id
+type ToolLog struct {
+	mutex sync.Mutex
+	// kind and index of the tool (like tuner/2)
+	ID      string
+	Command string
+	// tuner, instance or helper tool index and the program the tool works on
+	Instance int
+	Feed     string
+	Program  string
+	Since    time.Time
+	running  bool
+
+	// ring buffer, next is the position of the next line once full
+	lines []ToolLogLine
+	next  int
+	// channels of live tail clients
+	subscribers map[chan ToolLogLine]bool
+}
+
+// create the log of a tool, it is not registered
+func NewToolLog(kind string, instance int, command string, feed string, program string) *ToolLog {
+	l := new(ToolLog)
+	l.ID = fmt.Sprintf("%s/%d", kind, instance)
+	l.Command = command
+	l.Instance = instance
+	l.Feed = feed
+	l.Program = program
+	l.Since = time.Now()
+	l.running = true
+	l.subscribers = make(map[chan ToolLogLine]bool)
+
+	return l
+}
+
+// add a line written by the tool
+func (l *ToolLog) Add(stream string, text string) {
+	text = strings.TrimRight(text, "\r\n")
+
+	// progress lines are overwritten with carriage returns, keep only the last one
+	if position := strings.LastIndex(text, "\r"); position >= 0 {
+		text = text[position+1:]
+	}
+
+	line := ToolLogLine{time.Now(), stream, text}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if len(l.lines) < toolLogSize {
+		l.lines = append(l.lines, line)
+	} else {
+		l.lines[l.next] = line
+		l.next = (l.next + 1) % toolLogSize
+	}
+
+	for events := range l.subscribers {
+		select {
+		case events <- line:
+		default:
+		}
+	}
+}
+
+// get lines from the oldest (lock must be held)
+func (l *ToolLog) orderedLines() []ToolLogLine {
+	lines := make([]ToolLogLine, 0, len(l.lines))
+	lines = append(lines, l.lines[l.next:]...)
+	lines = append(lines, l.lines[:l.next]...)
+
+	return lines
+}
+
+// get kept lines from the oldest
+func (l *ToolLog) Lines() []ToolLogLine {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.orderedLines()
+}
+
+// get kept lines and a channel receiving next lines, the channel is closed when the tool stops
+func (l *ToolLog) subscribe() ([]ToolLogLine, chan ToolLogLine) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	events := make(chan ToolLogLine, toolLogEventBuffer)
+
+	if l.running {
+		l.subscribers[events] = true
+	} else {
+		close(events)
+	}
+
+	return l.orderedLines(), events
+}
+
+func (l *ToolLog) unsubscribe(events chan ToolLogLine) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.subscribers[events] {
+		delete(l.subscribers, events)
+		close(events)
+	}
+}
+
+// end live tails (lock must be held)
+func (l *ToolLog) closeSubscribers() {
+	for events := range l.subscribers {
+		close(events)
+	}
+	l.subscribers = make(map[chan ToolLogLine]bool)
+}
+
+// mark the tool stopped, live tails end, lines are still served
+func (l *ToolLog) Close() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.running = false
+	l.closeSubscribers()
+}
+
+// tool logs by id
+type ToolLogStore struct {
+	mutex sync.Mutex
+	logs  map[string]*ToolLog
+}
+
+func NewToolLogStore() *ToolLogStore {
+	s := new(ToolLogStore)
+	s.logs = make(map[string]*ToolLog)
+
+	return s
+}
+
+// add the log of a tool, replacing the log of a previous tool with the same id
+func (s *ToolLogStore) Register(l *ToolLog) {
+	s.mutex.Lock()
+	previous := s.logs[l.ID]
+	s.logs[l.ID] = l
+	s.mutex.Unlock()
+
+	if previous != nil {
+		previous.Close()
+	}
+}
+
+// get a log by id, nil if not found
+func (s *ToolLogStore) Get(id string) *ToolLog {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.logs[id]
+}
+
+// end all live tails (server is shutting down)
+func (s *ToolLogStore) CloseSubscribers() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, l := range s.logs {
+		l.mutex.Lock()
+		l.closeSubscribers()
+		l.mutex.Unlock()
+	}
+}
+
+// tool log report
+type ToolLogStatus struct {
+	ID       string    `json:"id"`
+	Command  string    `json:"command"`
+	Instance int       `json:"instance"`
+	Feed     string    `json:"feed"`
+	Program  string    `json:"program"`
+	Since    time.Time `json:"since"`
+	Running  bool      `json:"running"`
+	Count    int       `json:"count"`
+}
+
+type ToolLogReport struct {
+	ToolLogStatus
+	Lines []ToolLogLine `json:"lines"`
+}
+
+func (l *ToolLog) status() ToolLogStatus {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return ToolLogStatus{l.ID, l.Command, l.Instance, l.Feed, l.Program, l.Since, l.running, len(l.lines)}
+}
+
+// list logs of all tools
+func (s *ToolLogStore) GetToolLogs() []ToolLogStatus {
+	s.mutex.Lock()
+	logs := make([]*ToolLog, 0, len(s.logs))
+	for _, l := range s.logs {
+		logs = append(logs, l)
+	}
+	s.mutex.Unlock()
+
+	report := []ToolLogStatus{}
+	for _, l := range logs {
+		report = append(report, l.status())
+	}
+
+	sort.Slice(report, func(i, j int) bool { return report[i].ID < report[j].ID })
+
+	return report
+}
+
+// send kept lines then each new line as server sent events until the tool stops or the client leaves
+func (l *ToolLog) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "500 streaming not supported.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	lines, events := l.subscribe()
+	defer l.unsubscribe(events)
+
+	send := func(line ToolLogLine) {
+		data, _ := json.Marshal(line)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+	}
+
+	for _, line := range lines {
+		send(line)
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case line, ok := <-events:
+			if !ok {
+				fmt.Fprintf(w, "event: end\ndata: %s stopped\n\n", l.ID)
+				flusher.Flush()
+				return
+			}
+
+			send(line)
+			flusher.Flush()
+
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// serve list of logs, lines of one log as JSON, or live tail as server sent events (with follow parameter or event stream accepted)
+func (s *ToolLogStore) ServeToolLogs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, ToolLogPath), "/")
+
+	if id == "" {
+		w.Header().Set("Content-Type", "application/json")
+
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", " ")
+		encoder.Encode(s.GetToolLogs())
+		return
+	}
+
+	l := s.Get(id)
+
+	if l == nil {
+		http.Error(w, "404 not found.", http.StatusNotFound)
+		return
+	}
+
+	if r.URL.Query().Get("follow") != "" || strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		l.serveEvents(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", " ")
+	encoder.Encode(ToolLogReport{l.status(), l.Lines()})
+}
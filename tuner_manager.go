@@ -8,11 +8,14 @@ type TunerManager struct {
 	Name          string
 	Tuners        []Tuner
 	outputchannel MpegTSChannel
+	// demultiplexer receiving all packets from tuners
+	demux *MpegDemux
 }
 
 func NewTunerManager(name string) *TunerManager {
 	tm := new(TunerManager)
 	tm.Name = name
+	tm.demux = NewMpegDemux()
 
 	return tm
 }
@@ -24,13 +27,8 @@ func (tm *TunerManager) AttachTuner(tuner Tuner) {
 
 func (tm *TunerManager) ReceivePackets(tc MpegTSChannel) {
 	for pkt := range tc {
-		pid := pkt.PID()
-		switch pid {
-		case 0:
-			//log.Print("PAT")
-			break
-		default:
-		}
+		// route to PID parsers
+		tm.demux.ProcessPacket(pkt)
 
 		// forward data
 		if tm.outputchannel != nil {
@@ -43,8 +41,13 @@ func (tm *TunerManager) ReceivePackets(tc MpegTSChannel) {
 
 func (tm *TunerManager) GetChannel() MpegTSChannel {
 	if tm.outputchannel == nil {
-		tm.outputchannel = make(MpegTSChannel , 128)
+		tm.outputchannel = make(MpegTSChannel, 128)
 	}
 
 	return tm.outputchannel
 }
+
+// get demultiplexer to register PID parsers
+func (tm *TunerManager) GetDemux() *MpegDemux {
+	return tm.demux
+}
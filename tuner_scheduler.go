@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// path of tuner usage report
+const TunerStatusPath = "/admin/tuners"
+
+// priority classes of tuner users, a request can preempt tuners used only by lower classes
+type TunerPriority int
+
+const (
+	TunerPriorityEPG TunerPriority = iota
+	TunerPriorityLive
+	TunerPriorityRecording
+)
+
+var tunerPriorityNames = []string{"epg", "live", "recording"}
+
+func (p TunerPriority) String() string {
+	if p < 0 || int(p) >= len(tunerPriorityNames) {
+		return fmt.Sprintf("priority%d", int(p))
+	}
+
+	return tunerPriorityNames[p]
+}
+
+// get priority class from its name
+func ParseTunerPriority(name string) (TunerPriority, bool) {
+	for i, n := range tunerPriorityNames {
+		if n == name {
+			return TunerPriority(i), true
+		}
+	}
+
+	return TunerPriorityLive, false
+}
+
+// minimum wait of a request which preempted a tuner, stopping tools takes time
+const tunerPreemptWait = 10 * time.Second
+
+// a client request which may need a tuner
+type tunerRequest struct {
+	Path     string
+	Priority TunerPriority
+	Client   string
+	Since    time.Time
+	// time to wait for a tuner before failing
+	Wait time.Duration
+	// order of arrival in queue
+	sequence uint64
+	// a lower priority session was stopped for this request
+	preempting bool
+}
+
+// get class and wait time of a request from priority and wait parameters (like ?priority=recording&wait=30s)
+func newTunerRequest(r *http.Request, path string) *tunerRequest {
+	req := new(tunerRequest)
+	req.Path = path
+	req.Client = r.RemoteAddr
+	req.Since = time.Now()
+	req.Priority = TunerPriorityLive
+	req.Wait = deviceconfig.TunerWait
+
+	query := r.URL.Query()
+
+	if name := query.Get("priority"); name != "" {
+		priority, found := ParseTunerPriority(name)
+		if !found {
+			log.Printf("Unknown priority %s for %s, using %s\n", name, path, priority)
+		}
+
+		// any client could otherwise preempt viewers, only configured ones get above live
+		if priority > TunerPriorityLive && !isPriorityClient(r.RemoteAddr) {
+			log.Printf("Client %s not in priorityclients cannot use %s priority for %s, using %s\n", r.RemoteAddr, priority, path, TunerPriorityLive)
+			priority = TunerPriorityLive
+		}
+
+		req.Priority = priority
+	}
+
+	if wait, err := time.ParseDuration(query.Get("wait")); err == nil && wait >= 0 {
+		req.Wait = wait
+	}
+
+	return req
+}
+
+// parse an address or a network of priorityclients, nil if invalid
+func parseClientNetwork(value string) *net.IPNet {
+	if _, network, err := net.ParseCIDR(value); err == nil {
+		return network
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil
+	}
+
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 8 * net.IPv4len
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
+
+// check if a client address (host:port of request) is allowed to request priority above live
+func isPriorityClient(remoteaddr string) bool {
+	host, _, err := net.SplitHostPort(remoteaddr)
+	if err != nil {
+		host = remoteaddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, value := range deviceconfig.PriorityClients {
+		if network := parseClientNetwork(value); network != nil && network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// add a request to the queue of requests waiting for tuners (lock must be held)
+func (t *DynamicTranscodeManager) enqueue(req *tunerRequest) {
+	t.sequence++
+	req.sequence = t.sequence
+	t.queue = append(t.queue, req)
+}
+
+// remove a request from the queue, other requests may now get a tuner (lock must be held)
+func (t *DynamicTranscodeManager) dequeue(req *tunerRequest) {
+	for i, q := range t.queue {
+		if q == req {
+			t.queue = append(t.queue[:i], t.queue[i+1:]...)
+			t.signalTuners()
+			return
+		}
+	}
+}
+
+// check if a queued request must get a tuner before this one (lock must be held)
+func (t *DynamicTranscodeManager) hasQueuedBefore(req *tunerRequest) bool {
+	for _, q := range t.queue {
+		// requests not yet queued come after all queued ones
+		if q != req && (q.Priority > req.Priority || (q.Priority == req.Priority && (req.sequence == 0 || q.sequence < req.sequence))) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// wake up requests waiting for a tuner (lock must be held)
+func (t *DynamicTranscodeManager) signalTuners() {
+	close(t.released)
+	t.released = make(chan struct{})
+}
+
+// wait until tuners change, false if deadline is reached (lock must be held, it is released while waiting)
+func (t *DynamicTranscodeManager) waitTuner(deadline time.Time) bool {
+	wait := time.Until(deadline)
+	if wait <= 0 {
+		return false
+	}
+
+	released := t.released
+	t.mutex.Unlock()
+	defer t.mutex.Lock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-released:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// highest priority of instances using a session (lock must be held)
+func (t *DynamicTranscodeManager) sessionPriority(session *TunerSession) TunerPriority {
+	priority := TunerPriorityEPG
+
+	for _, instance := range t.activeInstances {
+		if instance.Session == session && instance.Priority > priority {
+			priority = instance.Priority
+		}
+	}
+
+	return priority
+}
+
+// find the session to stop for a request, nil if all are used by same or higher priorities (lock must be held)
+func (t *DynamicTranscodeManager) preemptionCandidate(req *tunerRequest) *TunerSession {
+	var candidate *TunerSession
+	var candidatePriority TunerPriority
+
+	for _, session := range t.sessions {
+		starting := false
+		for _, instance := range t.activeInstances {
+			if instance.Session == session && !instance.isStarted() {
+				starting = true
+			}
+		}
+
+		// tools being started cannot be stopped
+		if starting {
+			continue
+		}
+
+		priority := t.sessionPriority(session)
+
+		if priority >= req.Priority {
+			continue
+		}
+
+		if candidate == nil || priority < candidatePriority || (priority == candidatePriority && session.TunerIndex < candidate.TunerIndex) {
+			candidate = session
+			candidatePriority = priority
+		}
+	}
+
+	return candidate
+}
+
+// stop all instances of a session for a higher priority request, return sessions to release (lock must be held)
+func (t *DynamicTranscodeManager) preemptSession(session *TunerSession, req *tunerRequest) []*TunerSession {
+	var released []*TunerSession
+
+	notice := fmt.Sprintf("tuner %d preempted by %s request for %s", session.TunerIndex, req.Priority, req.Path)
+
+	for name, instance := range t.activeInstances {
+		if instance.Session != session {
+			continue
+		}
+
+		log.Printf("Instance %s stopped, %s\n", name, notice)
+
+		// clients of the instance get the notice on their next request
+		instance.preempted = notice
+		t.notices[name] = notice
+
+		if s := t.stopInstance(name, instance); s != nil {
+			released = append(released, s)
+		}
+	}
+
+	return released
+}
+
+// called when no tuner is free for a request, stop a lower priority session or wait for a release
+// return false when deadline is reached (lock must be held, it is released while waiting)
+func (t *DynamicTranscodeManager) waitForTuner(req *tunerRequest, deadline *time.Time) bool {
+	if req.sequence == 0 {
+		t.enqueue(req)
+	}
+
+	// a tuner being released will be free soon, otherwise try to free one
+	if !req.preempting && len(t.releasing) == 0 && !t.hasQueuedBefore(req) {
+		if session := t.preemptionCandidate(req); session != nil {
+			req.preempting = true
+
+			for _, s := range t.preemptSession(session, req) {
+				go t.releaseSession(s)
+			}
+
+			if d := time.Now().Add(tunerPreemptWait); d.After(*deadline) {
+				*deadline = d
+			}
+		}
+	}
+
+	return t.waitTuner(*deadline)
+}
+
+// tuner usage report
+type TunerInstanceStatus struct {
+	Path     string    `json:"path"`
+	Priority string    `json:"priority"`
+	Client   string    `json:"client"`
+	Since    time.Time `json:"since"`
+	Started  bool      `json:"started"`
+	Viewers  int       `json:"viewers"`
+	// packets of the multiplex dropped because the instance did not read them in time
+	Dropped uint64 `json:"dropped"`
+	// transcoder tool of the instance, none for remuxed feeds
+	Transcoder *CommandLineToolStatus `json:"transcoder,omitempty"`
+}
+
+type TunerStatus struct {
+	Tuner     int                   `json:"tuner"`
+	Session   string                `json:"session"`
+	Releasing bool                  `json:"releasing"`
+	Instances []TunerInstanceStatus `json:"instances"`
+	// tuner tool with its restarts
+	Tool CommandLineToolStatus `json:"tool"`
+}
+
+type TunerRequestStatus struct {
+	Path     string    `json:"path"`
+	Priority string    `json:"priority"`
+	Client   string    `json:"client"`
+	Since    time.Time `json:"since"`
+}
+
+type TunerReport struct {
+	Tuners []TunerStatus        `json:"tuners"`
+	Queue  []TunerRequestStatus `json:"queue"`
+}
+
+// list tuners with the requests holding them and requests waiting for a tuner
+func (t *DynamicTranscodeManager) GetTunerReport() TunerReport {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var report TunerReport
+
+	status := func(session *TunerSession, releasing bool) TunerStatus {
+		s := TunerStatus{Tuner: session.TunerIndex, Session: session.Name, Releasing: releasing, Instances: []TunerInstanceStatus{}, Tool: session.Tuner.Status()}
+
+		for name, instance := range t.activeInstances {
+			if instance.Session == session {
+				started := instance.isStarted()
+				status := TunerInstanceStatus{name, instance.Priority.String(), instance.Client, instance.Since, started, len(instance.viewers), instance.filter.Dropped(), nil}
+
+				// transcoder is set by the start of the instance
+				if started && instance.Transcoder != nil {
+					transcoder := instance.Transcoder.Status()
+					status.Transcoder = &transcoder
+				}
+
+				s.Instances = append(s.Instances, status)
+			}
+		}
+
+		sort.Slice(s.Instances, func(i, j int) bool { return s.Instances[i].Path < s.Instances[j].Path })
+
+		return s
+	}
+
+	report.Tuners = []TunerStatus{}
+	for _, session := range t.sessions {
+		report.Tuners = append(report.Tuners, status(session, false))
+	}
+	for session := range t.releasing {
+		report.Tuners = append(report.Tuners, status(session, true))
+	}
+
+	sort.Slice(report.Tuners, func(i, j int) bool { return report.Tuners[i].Tuner < report.Tuners[j].Tuner })
+
+	report.Queue = []TunerRequestStatus{}
+	for _, req := range t.queue {
+		report.Queue = append(report.Queue, TunerRequestStatus{req.Path, req.Priority.String(), req.Client, req.Since})
+	}
+
+	return report
+}
+
+// serve tuner usage report as JSON
+func (t *DynamicTranscodeManager) ServeTunerStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", " ")
+	encoder.Encode(t.GetTunerReport())
+}
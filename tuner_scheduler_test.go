@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// only configured clients can raise priority above live
+func TestTunerRequestPriority(t *testing.T) {
+	savedConfig := deviceconfig
+	defer func() { deviceconfig = savedConfig }()
+
+	deviceconfig.PriorityClients = []string{"192.168.1.10", "10.0.0.0/8", "::1"}
+
+	tests := []struct {
+		client   string
+		priority string
+		want     TunerPriority
+	}{
+		{"192.168.1.10:4000", "recording", TunerPriorityRecording},
+		{"10.1.2.3:4000", "recording", TunerPriorityRecording},
+		{"[::1]:4000", "recording", TunerPriorityRecording},
+		{"192.168.1.11:4000", "recording", TunerPriorityLive},
+		{"192.168.1.11:4000", "live", TunerPriorityLive},
+		{"192.168.1.11:4000", "epg", TunerPriorityEPG},
+		{"192.168.1.11:4000", "", TunerPriorityLive},
+		{"unknown", "recording", TunerPriorityLive},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/dynamic/transcode/feed/1/out.mpd?priority="+test.priority, nil)
+		r.RemoteAddr = test.client
+
+		if got := newTunerRequest(r, "feed/1").Priority; got != test.want {
+			t.Errorf("client %s asking for %q got priority %s, want %s", test.client, test.priority, got, test.want)
+		}
+	}
+
+	if parseClientNetwork("192.168.1.") != nil || parseClientNetwork("10.0.0.0/33") != nil {
+		t.Error("invalid priorityclients entries were accepted")
+	}
+}
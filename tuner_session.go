@@ -0,0 +1,123 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// a tuner tool receiving one multiplex, shared by the transcode instances of its programs
+type TunerSession struct {
+	mutex sync.Mutex
+	// feed name, or feed/program path when the tuner tool selects the program itself
+	Name       string
+	TunerIndex int
+	Tuner      *CommandLineTool
+	// parameters of the tuner tool
+	args ToolParameters
+	// tool is started by the first program ready
+	once     sync.Once
+	starterr error
+
+	// tables of the multiplex used to select programs
+	demux    *MpegDemux
+	programs *MpegProgramTracker
+	services *DvbServiceTracker
+
+	// one output per program being transcoded, the session is in use while not empty
+	filters []*MpegProgramFilter
+}
+
+// create a session on a tuner, tool is not started
+func NewTunerSession(name string, tunerindex int, config CommandLineToolConfig) *TunerSession {
+	s := new(TunerSession)
+	s.Name = name
+	s.TunerIndex = tunerindex
+
+	config.PortOffset = (uint16)(tunerindex)
+	s.Tuner = CreateCommandLineTool(config)
+
+	s.demux = NewMpegDemux()
+	s.programs = NewMpegProgramTracker(s.demux)
+	s.services = NewDvbServiceTracker(s.demux)
+
+	return s
+}
+
+// start the tuner tool and the distribution of packets to programs
+func (s *TunerSession) Start(args ToolParameters) error {
+	go s.run(s.Tuner.GetOutputPipe())
+
+	return s.Tuner.Start(args)
+}
+
+// start the tuner tool with session parameters unless already started, return start error
+func (s *TunerSession) StartOnce() error {
+	s.once.Do(func() {
+		s.starterr = s.Start(s.args)
+	})
+
+	return s.starterr
+}
+
+func (s *TunerSession) run(c MpegTSChannel) {
+	for pkt := range c {
+		// update tables first so that filters see changes of this packet
+		s.demux.ProcessPacket(pkt)
+
+		s.mutex.Lock()
+		for _, f := range s.filters {
+			f.ProcessPacket(pkt)
+		}
+		s.mutex.Unlock()
+	}
+
+	// tuner stopped, stop all programs
+	s.mutex.Lock()
+	for _, f := range s.filters {
+		close(f.output)
+	}
+	s.filters = nil
+	s.mutex.Unlock()
+
+	log.Printf("Tuner session %s exit receive loop\n", s.Name)
+}
+
+// add an output for a program (number or service name), empty program outputs the whole stream
+func (s *TunerSession) AddProgram(program string) *MpegProgramFilter {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	f := NewMpegProgramFilter(program, s.programs, s.services)
+	s.filters = append(s.filters, f)
+
+	return f
+}
+
+// remove an output and close its channel, return number of outputs still using the session
+func (s *TunerSession) RemoveProgram(f *MpegProgramFilter) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, current := range s.filters {
+		if current == f {
+			s.filters = append(s.filters[:i], s.filters[i+1:]...)
+			close(f.output)
+			break
+		}
+	}
+
+	return len(s.filters)
+}
+
+// number of outputs using the session
+func (s *TunerSession) Users() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.filters)
+}
+
+// stop the tuner tool, remaining outputs are closed
+func (s *TunerSession) Stop() {
+	s.Tuner.Stop()
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/Comcast/gots/packet"
 )
@@ -13,13 +14,62 @@ type Channel struct {
 	Source  string `yaml:"source"`
 	Tune    string `yaml:"tune"`
 	Demux   string `yaml:"demux"`
+	// DVB triplet of the service, used to find program guide (optional)
+	ONID int `yaml:"onid"`
+	TSID int `yaml:"tsid"`
+	SID  int `yaml:"sid"`
+	// optional metadata, images are URLs or file names in logo directory
+	Logo                   string   `yaml:"logo"`
+	OutOfServiceImage      string   `yaml:"outofserviceimage"`
+	Genre                  string   `yaml:"genre"`
+	Description            string   `yaml:"description"`
+	DescriptionLanguage    string   `yaml:"descriptionlanguage"`
+	TargetRegions          []string `yaml:"targetregions"`
+	ContentGuideServiceRef string   `yaml:"contentguideserviceref"`
+	// DRM systems required to play the channel
+	DRMSystems []DRMSystem `yaml:"drmsystems"`
+	// HLS playlist advertised as second service instance (optional)
+	HLSSource string `yaml:"hlssource"`
+}
+
+type DRMSystem struct {
+	SystemID         string `yaml:"systemid"`
+	EncryptionScheme string `yaml:"encryptionscheme"`
+	CPSIndex         string `yaml:"cpsindex"`
+}
+
+// a region where services can be targeted, regions can be nested
+type Region struct {
+	ID           string   `yaml:"id"`
+	CountryCodes string   `yaml:"countrycodes"`
+	Name         string   `yaml:"name"`
+	Regions      []Region `yaml:"regions"`
+}
+
+// how a channel map is advertised in service list discovery
+type ServiceListDiscoveryConfig struct {
+	// ISO 3166 alpha-3 country codes (all countries if empty)
+	TargetCountries []string `yaml:"targetcountries,omitempty"`
+	// ISO 639 language codes
+	Languages []string `yaml:"languages,omitempty"`
+	// genre term URIs
+	Genres []string `yaml:"genres,omitempty"`
+	// delivery types as used in queries (dvb-dash if empty)
+	Delivery      []string `yaml:"delivery,omitempty"`
+	RegulatorList bool     `yaml:"regulatorlist,omitempty"`
 }
 
 type ChannelMap struct {
-	Description string          `yaml:"name"`
-	Provider    string          `yaml:"provider"`
-	ProviderURL string          `yaml:"providerurl"`
-	Channels    map[int]Channel `yaml:"channels"`
+	Description string   `yaml:"name"`
+	Provider    string   `yaml:"provider"`
+	ProviderURL string   `yaml:"providerurl"`
+	Logo        string   `yaml:"logo"`
+	Regions     []Region `yaml:"regions"`
+	// advertise HLS playlist next to DASH manifest of transcoded channels
+	HLS      bool            `yaml:"hls"`
+	Channels map[int]Channel `yaml:"channels"`
+
+	ServiceListDiscoveryConfig `yaml:",inline"`
 }
 
 type DynamicChannelMap interface {
@@ -32,20 +82,38 @@ type DynamicContent interface {
 }
 
 type DeviceConfig struct {
-	Name               string                `yaml:"name"`
-	ChannelMaps        map[string]ChannelMap `yaml:"channelmaps"`
-	TunerConfig        CommandLineToolConfig `yaml:"tunerconfig"`
-	Feeds              map[string]string     `yaml:"feeds"`
-	Aliases            map[string]string     `yaml:"aliases"`
-	TranscodeConfig    CommandLineToolConfig `yaml:"transcodeconfig"`
-	MaxTuner           int                   `yaml:"maxtuner"`
-	TunerList          []int                 `yaml:"tunerlist"`
-	OpenPage           bool                  `yaml:"openpage"`
-	ServerPort         int                   `yaml:"serverport"`
-	HelperTools        []CommandLineToolConfig `yaml:"helpertools"`
+	Name            string                  `yaml:"name"`
+	ChannelMaps     map[string]ChannelMap   `yaml:"channelmaps"`
+	TunerConfig     CommandLineToolConfig   `yaml:"tunerconfig"`
+	Feeds           map[string]ToolArgs     `yaml:"feeds"`
+	Aliases         map[string]string       `yaml:"aliases"`
+	TranscodeConfig CommandLineToolConfig   `yaml:"transcodeconfig"`
+	MaxTuner        int                     `yaml:"maxtuner"`
+	TunerList       []int                   `yaml:"tunerlist"`
+	OpenPage        bool                    `yaml:"openpage"`
+	ServerPort      int                     `yaml:"serverport"`
+	HelperTools     []CommandLineToolConfig `yaml:"helpertools"`
+	LogoDir         string                  `yaml:"logodir"`
+	// name of the service list registry entity (server name if empty)
+	RegistryName string `yaml:"registryname"`
+	// target countries of channel maps which do not give theirs
+	TargetCountries []string `yaml:"targetcountries"`
+	// feeds (or feed/program) already in H.264/AAC, packaged to DASH without transcoder tool
+	RemuxFeeds []string `yaml:"remuxfeeds"`
+	// one tuner per feed shared by its programs, tuner tool must output the whole multiplex
+	ShareTuners bool `yaml:"sharetuners"`
+	// time a request waits for a tuner when all are used (like 10s), requests can give their own with wait parameter
+	TunerWait time.Duration `yaml:"tunerwait"`
+	// client addresses or networks (like 192.168.1.10 or 10.0.0.0/8) allowed to request priority above live
+	PriorityClients []string `yaml:"priorityclients"`
+	// directory for transcode output (current directory if empty)
+	WorkDir            string `yaml:"workdir"`
 	dynamicchannelmaps map[string]DynamicChannelMap
 	dynamiccontent     map[string]DynamicContent
 	helpertoolsruntime []*CommandLineTool
+	// file and content the configuration was read from
+	filename string
+	source   []byte
 }
 
 // transcoding
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// path of viewer session report
+const ViewerStatusPath = "/admin/sessions"
+
+// name of the manifest URL parameter giving the session of a viewer (like out.mpd?session=abc)
+const ViewerSessionParameter = "session"
+
+// directory of channel paths holding the session id (like feed/program/session/abc/out.mpd),
+// relative URLs of segments and playlists in manifests keep it
+const ViewerSessionPath = "session/"
+
+// longest session id accepted from clients
+const viewerSessionMaxLength = 64
+
+// identify a viewer: client address and session id given in manifest and segment URLs
+type viewerKey struct {
+	Client  string
+	Session string
+}
+
+// a client watching an instance, it leaves when it stops requesting files
+type ViewerSession struct {
+	viewerKey
+	Since    time.Time
+	LastSeen time.Time
+	Requests int
+	// ticks before the viewer is considered gone
+	TimeOut int
+}
+
+// get client address and session id of a request, session is taken from the path of the file
+func newViewerKey(r *http.Request, session string) viewerKey {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+
+	return viewerKey{Client: client, Session: session}
+}
+
+// check characters of a session id, it is used in URLs
+func isViewerSession(session string) bool {
+	if session == "" || len(session) > viewerSessionMaxLength {
+		return false
+	}
+
+	for _, c := range session {
+		if !(c == '-' || c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// split session id from the path of a file in a channel (session/abc/out.mpd), empty session if none
+func splitViewerSession(file string) (string, string) {
+	if !strings.HasPrefix(file, ViewerSessionPath) {
+		return "", file
+	}
+
+	split := strings.SplitN(strings.TrimPrefix(file, ViewerSessionPath), "/", 2)
+
+	if len(split) < 2 || !isViewerSession(split[0]) {
+		return "", file
+	}
+
+	return split[0], split[1]
+}
+
+// create a new session id
+func newViewerSession() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+// manifests start a viewer session, requests of segments then carry it in their path
+func isViewerManifest(file string) bool {
+	return strings.HasSuffix(file, ".mpd") || strings.HasSuffix(file, ".m3u8")
+}
+
+// redirect a manifest request without session to the same manifest in a session directory,
+// session id is the session parameter of the request or a new one
+func redirectViewerSession(w http.ResponseWriter, r *http.Request, file string) {
+	session := r.URL.Query().Get(ViewerSessionParameter)
+	if !isViewerSession(session) {
+		session = newViewerSession()
+	}
+
+	query := r.URL.Query()
+	query.Del(ViewerSessionParameter)
+
+	location := url.URL{
+		Path:     strings.TrimSuffix(r.URL.Path, file) + ViewerSessionPath + session + "/" + file,
+		RawQuery: query.Encode(),
+	}
+
+	http.Redirect(w, r, location.String(), http.StatusFound)
+}
+
+// record a file request of a viewer, requests without session are counted by client address (lock must be held)
+func (d *DynamicTranscodeInstance) touchViewer(name string, key viewerKey) {
+	now := time.Now()
+
+	viewer, found := d.viewers[key]
+
+	if !found {
+		viewer = &ViewerSession{viewerKey: key, Since: now}
+		d.viewers[key] = viewer
+
+		log.Printf("Viewer %s (session %s) joins %s, %d viewers\n", key.Client, key.Session, name, len(d.viewers))
+	}
+
+	viewer.LastSeen = now
+	viewer.Requests++
+	viewer.TimeOut = tickTimeout
+}
+
+// time out viewers which stopped requesting files, return number of remaining viewers (lock must be held)
+func (d *DynamicTranscodeInstance) tickViewers(name string) int {
+	for key, viewer := range d.viewers {
+		viewer.TimeOut--
+
+		if viewer.TimeOut <= 0 {
+			delete(d.viewers, key)
+			log.Printf("Viewer %s (session %s) left %s, %d viewers\n", key.Client, key.Session, name, len(d.viewers))
+		}
+	}
+
+	return len(d.viewers)
+}
+
+// viewer session report
+type ViewerStatus struct {
+	Client   string    `json:"client"`
+	Session  string    `json:"session"`
+	Since    time.Time `json:"since"`
+	LastSeen time.Time `json:"lastseen"`
+	Requests int       `json:"requests"`
+}
+
+type InstanceViewers struct {
+	Path    string         `json:"path"`
+	Count   int            `json:"count"`
+	Viewers []ViewerStatus `json:"viewers"`
+}
+
+// list viewers of each running instance
+func (t *DynamicTranscodeManager) GetViewers() []InstanceViewers {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	instances := []InstanceViewers{}
+
+	for name, instance := range t.activeInstances {
+		entry := InstanceViewers{Path: name, Count: len(instance.viewers), Viewers: []ViewerStatus{}}
+
+		for _, viewer := range instance.viewers {
+			entry.Viewers = append(entry.Viewers, ViewerStatus{viewer.Client, viewer.Session, viewer.Since, viewer.LastSeen, viewer.Requests})
+		}
+
+		sort.Slice(entry.Viewers, func(i, j int) bool { return entry.Viewers[i].Since.Before(entry.Viewers[j].Since) })
+
+		instances = append(instances, entry)
+	}
+
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Path < instances[j].Path })
+
+	return instances
+}
+
+// serve viewer session report as JSON
+func (t *DynamicTranscodeManager) ServeViewerStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", " ")
+	encoder.Encode(t.GetViewers())
+}
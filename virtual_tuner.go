@@ -1,42 +1,42 @@
 package main
 
 import (
-	"bufio"
-	"fmt"
+	"bytes"
+	"errors"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
-	"regexp"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/Comcast/gots/packet"
 	"gopkg.in/yaml.v3"
 )
 
-type ExternConfig struct {
-	Command string `yaml:"command"`
-	Args    string `yaml:"args"`
-}
-
 type VirtualServiceConfig struct {
-	Name string `yaml:"name"`
-	LCN  int    `yaml:"lcn"`
-	SID  int    `yaml:"sid"`
+	Name        string `yaml:"name"`
+	LCN         int    `yaml:"lcn"`
+	SID         int    `yaml:"sid"`
+	Provider    string `yaml:"provider,omitempty"`
+	ServiceType int    `yaml:"servicetype,omitempty"`
+	// service was found by a scan and can be updated by the next one
+	Scanned bool `yaml:"scanned,omitempty"`
 }
 
 type VirtualFrequencyConfig struct {
 	TuneString string                          `yaml:"tunestring"`
-	File       string                          `yaml:"file"`
-	Port       string                          `yaml:"port"`
-	Extern     ExternConfig                    `yaml:"extern"`
-	BitRate    int                             `yaml:"bitrate"`
-	TSID       int                             `yaml:"tsid"`
-	ONID       int                             `yaml:"onid"`
-	Services   map[string]VirtualServiceConfig `yaml:"services"`
+	File       string                          `yaml:"file,omitempty"`
+	Port       string                          `yaml:"port,omitempty"`
+	Extern     CommandLineToolConfig           `yaml:"extern,omitempty"`
+	BitRate    int                             `yaml:"bitrate,omitempty"`
+	TSID       int                             `yaml:"tsid,omitempty"`
+	ONID       int                             `yaml:"onid,omitempty"`
+	Services   map[string]VirtualServiceConfig `yaml:"services,omitempty"`
 }
 
 type VirtualTunerConfig struct {
@@ -44,12 +44,17 @@ type VirtualTunerConfig struct {
 	Provider    string                            `yaml:"provider"`
 	ProviderURL string                            `yaml:"providerurl"`
 	Frequencies map[string]VirtualFrequencyConfig `yaml:"frequencies"`
-	Transcode   ExternConfig                      `yaml:"transcode"`
+	// write scanned services back to the configuration file at end of scan
+	SaveScan bool `yaml:"savescan,omitempty"`
+
+	ServiceListDiscoveryConfig `yaml:",inline"`
 }
 
 type VirtualTuner struct {
 	// configuration of the virtual tuner (read from file)
 	config VirtualTunerConfig
+	// file the configuration was read from
+	configfile string
 
 	// list of channel names (to keep fixed order while scanning)
 	frequencynames []string
@@ -64,17 +69,28 @@ type VirtualTuner struct {
 	currentconnection *net.UDPConn
 
 	// using command line input
-	input      exec.Cmd
-	pipestdin  io.WriteCloser
-	pipestdout io.ReadCloser
-	pipestderr io.ReadCloser
+	input *CommandLineTool
 
 	// the golang channel to output MPEG TS Packets
 	tschannel MpegTSChannel
 	// ticker to send timer event to read streams
 	streamticker *time.Ticker
+	// closed to stop the file streamer
+	stopstream chan struct{}
+
+	// protect configuration updated by scan
+	configmutex sync.Mutex
+	// demux of the tuned stream to follow PSI
+	demux *MpegDemux
+	// programs of the tuned stream
+	programs *MpegProgramTracker
+	// services named by SDT and NIT of the tuned stream
+	services *DvbServiceTracker
 }
 
+// time to wait for PAT and PMT during a scan
+const scanTimeout = 5 * time.Second
+
 func NewVirtualTuner(ConfigFile string) (*VirtualTuner, error) {
 	var vt VirtualTuner
 
@@ -97,9 +113,14 @@ func NewVirtualTuner(ConfigFile string) (*VirtualTuner, error) {
 	for k := range vt.config.Frequencies {
 		vt.frequencynames = append(vt.frequencynames, k)
 	}
+	sort.Strings(vt.frequencynames)
 
 	vt.scanfrequencyindex = 0
 	vt.tschannel = make(MpegTSChannel, 128)
+	vt.demux = NewMpegDemux()
+	vt.programs = NewMpegProgramTracker(vt.demux)
+	vt.services = NewDvbServiceTracker(vt.demux)
+	vt.configfile = ConfigFile
 
 	return &vt, nil
 }
@@ -109,13 +130,27 @@ func (vt *VirtualTuner) GetChannel() MpegTSChannel {
 	return vt.tschannel
 }
 
+// follow PSI of the packet and send it to output
+func (vt *VirtualTuner) sendPacket(pkt packet.Packet) {
+	vt.demux.ProcessPacket(pkt)
+	vt.tschannel <- pkt
+}
+
 // tick handler to stream a file
-func (vt *VirtualTuner) filestreamer() {
+func (vt *VirtualTuner) filestreamer(file *os.File, stop chan struct{}) {
 	lasttime := time.Now()
 	bitbudget := 0
 
 	// receive time tick from ticker channel
-	for currenttime := range vt.streamticker.C {
+	for {
+		var currenttime time.Time
+
+		select {
+		case <-stop:
+			return
+		case currenttime = <-vt.streamticker.C:
+		}
+
 		// compute effective offset (tick may not occur with exact timing)
 		offset := currenttime.Sub(lasttime)
 		// store time for next offset
@@ -128,14 +163,15 @@ func (vt *VirtualTuner) filestreamer() {
 		for bitbudget > (packet.PacketSize * 8) {
 			readpacket := new(packet.Packet)
 
-			readlen, err := vt.currentfile.Read(readpacket[:])
+			readlen, err := file.Read(readpacket[:])
 
 			if err != nil {
 				// loop if end of file
 				if err == io.EOF {
-					vt.currentfile.Seek(0, 0)
+					file.Seek(0, 0)
 				} else {
 					vt.streamticker.Stop()
+					return
 				}
 			}
 
@@ -148,25 +184,29 @@ func (vt *VirtualTuner) filestreamer() {
 			// remove read packet from budget
 			bitbudget -= packet.PacketSize * 8
 			// forward to output channel
-			vt.tschannel <- *readpacket
+			vt.sendPacket(*readpacket)
 		}
 	}
 }
 
-func (vt *VirtualTuner) udpstreamer() {
+func (vt *VirtualTuner) udpstreamer(connection *net.UDPConn) {
 	buffer := make([]byte, 1500)
 
 	for {
-		packetsize, _, err := vt.currentconnection.ReadFrom(buffer)
+		packetsize, _, err := connection.ReadFrom(buffer)
 		index := 0
 		if err != nil {
+			// socket closed by Stop
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			continue
 		}
 
 		for packetsize >= packet.PacketSize {
 			readpacket := new(packet.Packet)
 			copy(readpacket[:], buffer[index:index+packet.PacketSize])
-			vt.tschannel <- *readpacket
+			vt.sendPacket(*readpacket)
 			packetsize -= packet.PacketSize
 			index += packet.PacketSize
 		}
@@ -178,43 +218,13 @@ func (vt *VirtualTuner) udpstreamer() {
 
 }
 
-func (vt *VirtualTuner) handleConsoleReader(reader io.ReadCloser) {
-	bufreader := bufio.NewReader(reader)
-
-	for {
-		str, err := bufreader.ReadString('\n')
-		if err != nil {
-			break
-		}
-		fmt.Print(str)
-	}
-}
-
-func (vt *VirtualTuner) handleTSReader(reader io.ReadCloser) {
-	for {
-		readpacket := new(packet.Packet)
-
-		readlen, err := reader.Read(readpacket[:])
-
-		if err != nil {
-			return
-		}
-
-		// check size of read packet
-		if readlen != packet.PacketSize {
-			// assume that source file contains partial packet, loop so that next read will read EOF
-			continue
-		}
-
-		// forward to output channel
-		vt.tschannel <- *readpacket
-	}
-}
-
 // tune to a TS, true if OK
 func (vt *VirtualTuner) Tune(parameters string) bool {
 	var err error
+
+	vt.configmutex.Lock()
 	targetchannel, found := vt.config.Frequencies[parameters]
+	vt.configmutex.Unlock()
 
 	// check if channel exists
 	if !found {
@@ -224,6 +234,11 @@ func (vt *VirtualTuner) Tune(parameters string) bool {
 	// store current channel
 	vt.currentfrequency = &targetchannel
 
+	// restart PSI acquisition for the new stream
+	vt.demux.ResetCounters()
+	vt.programs.Reset()
+	vt.services.Reset()
+
 	// check if source is a file
 	if vt.currentfrequency.File != "" {
 		// try to open TS file
@@ -241,7 +256,8 @@ func (vt *VirtualTuner) Tune(parameters string) bool {
 		}
 
 		// this asynchronous go routine will get timer tick and read from file
-		go vt.filestreamer()
+		vt.stopstream = make(chan struct{})
+		go vt.filestreamer(vt.currentfile, vt.stopstream)
 
 		return true
 	}
@@ -258,54 +274,31 @@ func (vt *VirtualTuner) Tune(parameters string) bool {
 			return false
 		}
 
-		go vt.udpstreamer()
+		go vt.udpstreamer(vt.currentconnection)
 
 		return true
 	}
 
 	if vt.currentfrequency.Extern.Command != "" {
-		var err error
-
-		// regexep to parse argument string
-		r := regexp.MustCompile("'.+'|\".+\"|\\S+")
-
-		//	t.transcoder = *exec.Command(t.cmd, strings.Fields(args)...)  // this will split only by white space
-		vt.input = *exec.Command(vt.currentfrequency.Extern.Command, r.FindAllString(vt.currentfrequency.Extern.Args, -1)...) // this will take in account quote around arguments
-
-		// get stdin to flow data
-		vt.pipestdin, err = vt.input.StdinPipe()
-
-		if err != nil {
-			log.Print(err)
-			return false
-		}
-
-		// get output
-		vt.pipestdout, err = vt.input.StdoutPipe()
+		// tool output comes from stdout or portout, tool stops as configured by exit command
+		vt.input = CreateCommandLineTool(vt.currentfrequency.Extern)
+		output := vt.input.GetOutputPipe()
 
-		if err != nil {
-			log.Print(err)
-			return false
-		}
-
-		// dump to console
-		go vt.handleTSReader(vt.pipestdout)
-
-		// get error output
-		vt.pipestderr, err = vt.input.StderrPipe()
-
-		if err != nil {
-			log.Print(err)
-			return false
-		}
+		go func() {
+			for pkt := range output {
+				vt.sendPacket(pkt)
+			}
+		}()
 
-		// dump to console
-		go vt.handleConsoleReader(vt.pipestderr)
+		params := make(ToolParameters)
+		params.Set("tunestring", parameters)
 
-		err = vt.input.Start()
+		err = vt.input.Start(params)
 
 		if err != nil {
 			log.Print(err)
+			vt.input.Stop()
+			vt.input = nil
 			return false
 		}
 
@@ -322,21 +315,26 @@ func (vt *VirtualTuner) Stop() {
 		vt.streamticker.Stop()
 	}
 
+	// stop file streamer
+	if vt.stopstream != nil {
+		close(vt.stopstream)
+		vt.stopstream = nil
+	}
+
 	// close file and unreference
 	if vt.currentfile != nil {
 		vt.currentfile.Close()
 		vt.currentfile = nil
 	}
 
-	vt.currentconnection.Close()
+	if vt.currentconnection != nil {
+		vt.currentconnection.Close()
+		vt.currentconnection = nil
+	}
 
-	if vt.input.Process != nil {
-		//vt.pipestdin.Write([]byte{'q'} )
-		vt.pipestdin.Close()
-		vt.pipestdout.Close()
-		vt.pipestderr.Close()
-		vt.input.Process.Kill()
-		vt.input.Wait()
+	if vt.input != nil {
+		vt.input.Stop()
+		vt.input = nil
 	}
 }
 
@@ -358,12 +356,25 @@ func (vt *VirtualTuner) StartScan() string {
 
 // go to next frequency during a scan, return tune string or empty on failure
 func (vt *VirtualTuner) ScanNext() string {
+	// collect services of current channel
+	if vt.scanfrequencyindex < len(vt.frequencynames) {
+		vt.updateServicesFromStream(vt.frequencynames[vt.scanfrequencyindex])
+		vt.Stop()
+	}
+
 	// move to next channel
 	vt.scanfrequencyindex++
 
 	// if we got past last channel, just stop
 	if vt.scanfrequencyindex >= len(vt.frequencynames) {
 		vt.Stop()
+
+		if vt.config.SaveScan {
+			err := vt.WriteConfig()
+			if err != nil {
+				log.Printf("cannot save scan result to %s\n%s", vt.configfile, err)
+			}
+		}
 		return ""
 	}
 
@@ -373,12 +384,323 @@ func (vt *VirtualTuner) ScanNext() string {
 	return vt.frequencynames[vt.scanfrequencyindex]
 }
 
+// get programs found in the currently tuned stream
+func (vt *VirtualTuner) GetPrograms() []MpegProgram {
+	return vt.programs.GetPrograms()
+}
+
+// get services named by SI in the currently tuned stream
+func (vt *VirtualTuner) GetServices() []DvbService {
+	return vt.services.GetServices()
+}
+
+// get first LCN not used by any service (lock must be held)
+func (vt *VirtualTuner) nextFreeLCN() int {
+	lcn := 1
+
+	for _, freq := range vt.config.Frequencies {
+		for _, svc := range freq.Services {
+			if svc.LCN >= lcn {
+				lcn = svc.LCN + 1
+			}
+		}
+	}
+
+	return lcn
+}
+
+// check if a LCN is used by another service than key (lock must be held)
+func (vt *VirtualTuner) isLCNUsed(lcn int, tunestring string, key string) bool {
+	for freqname, freq := range vt.config.Frequencies {
+		for name, svc := range freq.Services {
+			if svc.LCN == lcn && (freqname != tunestring || name != key) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// add services found in the stream to the configuration of the frequency
+func (vt *VirtualTuner) updateServicesFromStream(tunestring string) {
+	complete := vt.programs.WaitComplete(scanTimeout)
+	if !complete {
+		log.Printf("Scan of %s timed out, program list may be incomplete\n", tunestring)
+	}
+
+	// SI is optional, some streams only carry PSI
+	if !vt.services.WaitSDT(scanTimeout) {
+		log.Printf("No SDT found on %s\n", tunestring)
+	}
+	vt.services.WaitNIT(scanTimeout)
+
+	vt.configmutex.Lock()
+	defer vt.configmutex.Unlock()
+
+	freq, found := vt.config.Frequencies[tunestring]
+
+	if !found {
+		return
+	}
+
+	if freq.Services == nil {
+		freq.Services = make(map[string]VirtualServiceConfig)
+	}
+
+	// find configured services by service id
+	known := make(map[int]string)
+	for key, svc := range freq.Services {
+		known[svc.SID] = key
+	}
+
+	programs := vt.programs.GetPrograms()
+	present := make(map[int]bool)
+
+	for _, program := range programs {
+		present[program.ProgramNumber] = true
+		key, found := known[program.ProgramNumber]
+
+		// services written by hand in configuration are kept as is
+		if found && !freq.Services[key].Scanned {
+			continue
+		}
+
+		if !found {
+			key = strconv.Itoa(program.ProgramNumber)
+		}
+
+		svc := freq.Services[key]
+		svc.SID = program.ProgramNumber
+		svc.Scanned = true
+
+		si, hassi := vt.services.GetActualService(program.ProgramNumber)
+
+		if hassi {
+			// only keep television and radio services
+			if si.ServiceType != 0 && !IsTelevisionService(si.ServiceType) && !IsRadioService(si.ServiceType) {
+				delete(freq.Services, key)
+				continue
+			}
+
+			// hidden services are not listed
+			if !si.Visible {
+				delete(freq.Services, key)
+				continue
+			}
+
+			svc.Name = si.Name
+			svc.Provider = si.Provider
+			svc.ServiceType = si.ServiceType
+
+			// use LCN from NIT when it is free
+			if si.LCN > 0 && !vt.isLCNUsed(si.LCN, tunestring, key) {
+				svc.LCN = si.LCN
+			}
+		}
+
+		if svc.Name == "" {
+			svc.Name = "Service " + strconv.Itoa(program.ProgramNumber)
+		}
+
+		if svc.LCN == 0 || vt.isLCNUsed(svc.LCN, tunestring, key) {
+			svc.LCN = vt.nextFreeLCN()
+		}
+
+		freq.Services[key] = svc
+
+		log.Printf("Scan found service %d (%s) LCN %d on %s\n", svc.SID, svc.Name, svc.LCN, tunestring)
+	}
+
+	// services of a previous scan which left the stream are removed, unless the program list may be incomplete
+	if complete {
+		for key, svc := range freq.Services {
+			if svc.Scanned && !present[svc.SID] {
+				log.Printf("Scan removed service %d (%s) not found anymore on %s\n", svc.SID, svc.Name, tunestring)
+				delete(freq.Services, key)
+			}
+		}
+	}
+
+	if tsid := vt.programs.GetTransportStreamID(); tsid > 0 && freq.TSID == 0 {
+		freq.TSID = tsid
+	}
+
+	if onid, _ := vt.services.GetActualTransportStream(); onid > 0 && freq.ONID == 0 {
+		freq.ONID = onid
+	}
+
+	vt.config.Frequencies[tunestring] = freq
+}
+
+// write scanned services and stream ids back to the configuration file, other content keeps its comments and order
+func (vt *VirtualTuner) WriteConfig() error {
+	source, err := ioutil.ReadFile(vt.configfile)
+	if err != nil {
+		return err
+	}
+
+	var document yaml.Node
+
+	err = yaml.Unmarshal(source, &document)
+	if err != nil {
+		return err
+	}
+
+	if document.Kind != yaml.DocumentNode || len(document.Content) == 0 {
+		return errors.New("configuration file is empty")
+	}
+
+	vt.configmutex.Lock()
+	err = vt.updateConfigNode(document.Content[0])
+	vt.configmutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	// indentation of hand written files
+	var out bytes.Buffer
+
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+
+	err = encoder.Encode(&document)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(vt.configfile, out.Bytes())
+}
+
+// update frequencies of the configuration document from scan results, services written by hand are not touched (lock must be held)
+func (vt *VirtualTuner) updateConfigNode(root *yaml.Node) error {
+	frequencies := mappingValue(root, "frequencies")
+
+	for tunestring, freq := range vt.config.Frequencies {
+		node := mappingValue(frequencies, tunestring)
+		if node == nil || node.Kind != yaml.MappingNode {
+			continue
+		}
+
+		if freq.TSID != 0 {
+			if err := setMappingValue(node, "tsid", freq.TSID); err != nil {
+				return err
+			}
+		}
+
+		if freq.ONID != 0 {
+			if err := setMappingValue(node, "onid", freq.ONID); err != nil {
+				return err
+			}
+		}
+
+		services := mappingValue(node, "services")
+		if services == nil || services.Kind != yaml.MappingNode {
+			if len(freq.Services) == 0 {
+				continue
+			}
+			if err := setMappingValue(node, "services", map[string]VirtualServiceConfig{}); err != nil {
+				return err
+			}
+			// an empty map is encoded in flow style
+			services = mappingValue(node, "services")
+			services.Style = 0
+		}
+
+		// drop services removed by the scan, replace scanned ones
+		content := make([]*yaml.Node, 0, len(services.Content))
+		written := make(map[string]bool)
+
+		for _, entry := range mappingEntries(services) {
+			svc, found := freq.Services[entry[0].Value]
+			if !found {
+				continue
+			}
+
+			written[entry[0].Value] = true
+			value := entry[1]
+
+			if svc.Scanned {
+				var err error
+				value, err = encodeValueNode(svc, entry[1])
+				if err != nil {
+					return err
+				}
+			}
+
+			content = append(content, entry[0], value)
+		}
+		services.Content = content
+
+		// new services in a fixed order
+		keys := make([]string, 0, len(freq.Services))
+		for key := range freq.Services {
+			if !written[key] {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if err := setMappingValue(services, key, freq.Services[key]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// encode a value replacing a node, comments of the previous node are kept (previous can be nil)
+func encodeValueNode(value interface{}, previous *yaml.Node) (*yaml.Node, error) {
+	encoded := new(yaml.Node)
+
+	err := encoded.Encode(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if previous != nil {
+		encoded.HeadComment = previous.HeadComment
+		encoded.LineComment = previous.LineComment
+		encoded.FootComment = previous.FootComment
+	}
+
+	return encoded, nil
+}
+
+// set the value of a key in a mapping node, a replaced value keeps its comments
+func setMappingValue(node *yaml.Node, key string, value interface{}) error {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			encoded, err := encodeValueNode(value, node.Content[i+1])
+			if err != nil {
+				return err
+			}
+
+			node.Content[i+1] = encoded
+			return nil
+		}
+	}
+
+	encoded, err := encodeValueNode(value, nil)
+	if err != nil {
+		return err
+	}
+
+	node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, encoded)
+
+	return nil
+}
+
 func (vt *VirtualTuner) GetChannelInfo() ChannelMap {
 	cm := new(ChannelMap)
 
 	cm.Description = vt.config.Description
 	cm.Provider = vt.config.Provider
 	cm.ProviderURL = vt.config.ProviderURL
+	cm.ServiceListDiscoveryConfig = vt.config.ServiceListDiscoveryConfig
 	cm.Channels = make(map[int]Channel)
 
 	return *cm
@@ -387,6 +709,9 @@ func (vt *VirtualTuner) GetChannelInfo() ChannelMap {
 func (vt *VirtualTuner) GetChannelMap() ChannelMap {
 	cm := vt.GetChannelInfo()
 
+	vt.configmutex.Lock()
+	defer vt.configmutex.Unlock()
+
 	for tunestring, freq := range vt.config.Frequencies {
 		for sid, svc := range freq.Services {
 			var newchannel Channel
@@ -394,6 +719,9 @@ func (vt *VirtualTuner) GetChannelMap() ChannelMap {
 			newchannel.Tune = tunestring
 			newchannel.Source = tunestring + "/" + sid
 			newchannel.Dynamic = true
+			newchannel.ONID = freq.ONID
+			newchannel.TSID = freq.TSID
+			newchannel.SID = svc.SID
 			cm.Channels[svc.LCN] = newchannel
 		}
 	}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// scan results are written back without losing comments, order and services written by hand
+func TestVirtualTunerWriteConfig(t *testing.T) {
+	source := `# test multiplexes
+description: test
+provider: Test
+frequencies:
+  B:
+    tunestring: B
+    # local file
+    file: b.ts
+    services:
+      hand: # written by hand
+        name: Hand
+        lcn: 1
+        sid: 10
+      "11":
+        name: Old
+        lcn: 2
+        sid: 11
+        scanned: true
+      "12":
+        name: Gone
+        lcn: 3
+        sid: 12
+        scanned: true
+  A:
+    tunestring: A
+    port: 5004 # multicast
+savescan: true
+`
+
+	file := filepath.Join(t.TempDir(), "tuner.yaml")
+	if err := ioutil.WriteFile(file, []byte(source), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	vt := &VirtualTuner{configfile: file}
+	if err := yaml.Unmarshal([]byte(source), &vt.config); err != nil {
+		t.Fatal(err)
+	}
+
+	// result of a scan: 11 renamed, 12 left, 13 and stream ids found
+	b := vt.config.Frequencies["B"]
+	b.Services["11"] = VirtualServiceConfig{Name: "New", LCN: 2, SID: 11, Scanned: true}
+	b.Services["13"] = VirtualServiceConfig{Name: "Added", LCN: 4, SID: 13, Scanned: true}
+	delete(b.Services, "12")
+	b.TSID = 7
+	vt.config.Frequencies["B"] = b
+
+	a := vt.config.Frequencies["A"]
+	a.Services = map[string]VirtualServiceConfig{"20": {Name: "Radio", LCN: 5, SID: 20, Scanned: true}}
+	vt.config.Frequencies["A"] = a
+
+	if err := vt.WriteConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("file mode %o, want 644", info.Mode().Perm())
+	}
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := string(content)
+
+	for _, want := range []string{"# test multiplexes", "# local file", "# written by hand", "# multicast", "\n  B:\n", "name: Hand", "name: New", "name: Added", "name: Radio", "tsid: 7"} {
+		if !strings.Contains(written, want) {
+			t.Errorf("written configuration misses %q\n%s", want, written)
+		}
+	}
+
+	for _, unwanted := range []string{"Old", "Gone"} {
+		if strings.Contains(written, unwanted) {
+			t.Errorf("written configuration still has %q\n%s", unwanted, written)
+		}
+	}
+
+	// keys keep their order
+	if strings.Index(written, "B:") > strings.Index(written, "A:") || strings.Index(written, "description") > strings.Index(written, "frequencies") {
+		t.Errorf("order of keys changed\n%s", written)
+	}
+
+	var reread VirtualTunerConfig
+	if err := yaml.Unmarshal(content, &reread); err != nil {
+		t.Fatal(err)
+	}
+	if len(reread.Frequencies["B"].Services) != 3 || len(reread.Frequencies["A"].Services) != 1 {
+		t.Errorf("written configuration has services %v", reread.Frequencies)
+	}
+}